@@ -0,0 +1,254 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+	"github.com/alde/ale/retry"
+	"github.com/alde/ale/version"
+)
+
+// SignatureHeader holds the HMAC-SHA256 of the body, keyed with the secret of the callback
+const SignatureHeader = "X-Ale-Signature"
+
+var deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ale_callback_deliveries_total",
+	Help: "Attempts at notifying the callback url of a crawl, by outcome.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(deliveries)
+}
+
+// Notification is the body POSTed to the callback url once a crawl is over
+type Notification struct {
+	BuildID       string    `json:"build_id"`
+	BuildURL      string    `json:"build_url"`
+	JenkinsStatus string    `json:"jenkins_status"`
+	CrawlState    string    `json:"crawl_state"`
+	Error         string    `json:"error,omitempty"`
+	Location      string    `json:"location"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Notifier posts the outcome of crawls to their callback url
+type Notifier struct {
+	database db.Database
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	now      func() time.Time
+}
+
+// NewNotifier creates a notifier recording its deliveries in the database
+func NewNotifier(database db.Database, cfg *config.Config) *Notifier {
+	return &Notifier{
+		database: database,
+		client:   newClient(cfg),
+		retries:  cfg.Callbacks.Retries,
+		backoff:  cfg.Callbacks.RetryBackoff.Duration,
+		now:      time.Now,
+	}
+}
+
+// errInternal is returned for callbacks to an internal address while no hosts
+// are explicitly allowed
+var errInternal = errors.New("callbacks to internal addresses are not allowed")
+
+// newClient creates the client posting the notifications. Unless the allowed
+// hosts are configured, it refuses to connect to internal addresses, which is
+// checked once the host is resolved so that a name can't point it at one.
+func newClient(cfg *config.Config) *http.Client {
+	client := &http.Client{Timeout: cfg.Callbacks.Timeout.Duration}
+	if len(cfg.Callbacks.AllowedHosts) > 0 {
+		return client
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internal(ip) {
+				return fmt.Errorf("%w: %s", errInternal, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	client.Transport = transport
+	return client
+}
+
+// internal tells whether the address is on a loopback, private or link-local
+// network, such as the ones of ale itself or of cloud metadata servers
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Validate checks that the callback url is absolute, over http or https, and
+// to one of the allowed hosts if any are configured. Otherwise callbacks to
+// localhost and internal addresses are refused.
+func Validate(callbackURL string, cfg *config.Config) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid callbackUrl: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callbackUrl must be an absolute http or https url")
+	}
+	if len(cfg.Callbacks.AllowedHosts) == 0 {
+		host := strings.ToLower(u.Hostname())
+		if ip := net.ParseIP(host); host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internal(ip)) {
+			return fmt.Errorf("callbacks to %s are not allowed", u.Hostname())
+		}
+		return nil
+	}
+	for _, host := range cfg.Callbacks.AllowedHosts {
+		if strings.EqualFold(host, u.Hostname()) || strings.EqualFold(host, u.Host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("callbacks to %s are not allowed", u.Hostname())
+}
+
+// Sign computes the signature of the body sent in SignatureHeader, such as sha256=3f0a...
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify delivers the notification of a finished crawl in the background,
+// if the crawl has a callback url
+func (n *Notifier) Notify(crawl *ale.Crawl) {
+	if crawl == nil || crawl.CallbackURL == "" {
+		return
+	}
+	go n.Deliver(context.Background(), crawl)
+}
+
+// Deliver posts the notification of a finished crawl to its callback url,
+// retrying connection failures and 5xx responses with a jittered exponential
+// backoff. Every attempt is added to the deliveries of the stored crawl record.
+// The crawl is only read from, so that its record can be changed meanwhile.
+func (n *Notifier) Deliver(ctx context.Context, crawl *ale.Crawl) error {
+	body, err := json.Marshal(&Notification{
+		BuildID:       crawl.BuildID,
+		BuildURL:      crawl.BuildURL,
+		JenkinsStatus: crawl.JenkinsStatus,
+		CrawlState:    crawl.State,
+		Error:         crawl.LastError,
+		Location:      crawl.Location,
+		Timestamp:     n.now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	fields := logrus.Fields{"build_id": crawl.BuildID, "callback_url": crawl.CallbackURL}
+	for attempt := 1; ; attempt++ {
+		delivery := ale.Delivery{Attempt: attempt, Time: n.now()}
+		delivery.StatusCode, err = n.post(ctx, crawl, body)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		n.record(ctx, crawl, delivery)
+		if err == nil {
+			deliveries.WithLabelValues("delivered").Inc()
+			logrus.WithFields(fields).Info("notified callback url")
+			return nil
+		}
+		again := attempt <= n.retries && !retry.Permanent(delivery.StatusCode) && !errors.Is(err, errInternal)
+		if !again {
+			deliveries.WithLabelValues("failed").Inc()
+			logrus.WithError(err).WithFields(fields).Error("giving up on notifying callback url")
+			return err
+		}
+		deliveries.WithLabelValues("retried").Inc()
+		delay := retry.Jitter(n.backoff << uint(attempt-1))
+		logrus.WithError(err).WithFields(fields).
+			WithField("attempt", attempt).
+			WithField("delay", delay).
+			Warn("unable to notify callback url, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record adds the delivery to the stored record of the crawl. The record is
+// read again first, so that it is left alone when the build has been removed or
+// crawled anew since, and so that only the deliveries of the record are changed.
+func (n *Notifier) record(ctx context.Context, crawl *ale.Crawl, delivery ale.Delivery) {
+	fields := logrus.Fields{"build_id": crawl.BuildID, "callback_url": crawl.CallbackURL}
+	stored, err := n.database.GetCrawl(ctx, crawl.BuildID)
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Warn("unable to record callback delivery")
+		return
+	}
+	if !sameCrawl(stored, crawl) {
+		logrus.WithFields(fields).Warn("crawl was replaced, not recording callback delivery")
+		return
+	}
+	stored.Deliveries = append(stored.Deliveries, delivery)
+	if err := n.database.PutCrawl(ctx, stored); err != nil {
+		logrus.WithError(err).WithFields(fields).Warn("unable to record callback delivery")
+	}
+}
+
+// sameCrawl tells whether both records are of the same crawl, allowing for the
+// databases storing its creation time with less precision
+func sameCrawl(a, b *ale.Crawl) bool {
+	d := a.Created.Sub(b.Created)
+	return d > -time.Millisecond && d < time.Millisecond
+}
+
+// post sends the signed notification once, returning the status code of the response
+func (n *Notifier) post(ctx context.Context, crawl *ale.Crawl, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, crawl.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ale/"+version.Version)
+	if crawl.CallbackSecret != "" {
+		req.Header.Set(SignatureHeader, Sign(crawl.CallbackSecret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, crawl.CallbackURL)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,183 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/mock"
+)
+
+var ctx = context.Background()
+
+func newNotifier(database *mock.DB) *Notifier {
+	cfg := config.DefaultConfig()
+	cfg.Callbacks.Retries = 2
+	cfg.Callbacks.RetryBackoff = config.Duration{}
+	cfg.Callbacks.AllowedHosts = []string{"127.0.0.1"}
+	return NewNotifier(database, cfg)
+}
+
+func finishedCrawl(callbackURL string) *ale.Crawl {
+	return &ale.Crawl{
+		BuildID:        "1",
+		BuildURL:       "http://jenkins.local/job/app/1",
+		State:          ale.CrawlFinished,
+		JenkinsStatus:  "SUCCESS",
+		CallbackURL:    callbackURL,
+		CallbackSecret: "s3cr3t",
+		Location:       "http://ale.local/api/v1/build/1",
+	}
+}
+
+// storedCrawl stores a finished crawl, as the crawler does before notifying
+func storedCrawl(database *mock.DB, callbackURL string) *ale.Crawl {
+	crawl := finishedCrawl(callbackURL)
+	database.PutCrawl(ctx, crawl)
+	return crawl
+}
+
+func Test_Sign(t *testing.T) {
+	assert.Equal(t,
+		"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func Test_DeliverSignsTheNotification(t *testing.T) {
+	var received Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, Sign("s3cr3t", body), r.Header.Get(SignatureHeader))
+		json.Unmarshal(body, &received)
+	}))
+	defer ts.Close()
+	database := &mock.DB{}
+
+	assert.Nil(t, newNotifier(database).Deliver(ctx, storedCrawl(database, ts.URL)))
+	assert.Equal(t, "1", received.BuildID)
+	assert.Equal(t, "SUCCESS", received.JenkinsStatus)
+	assert.Equal(t, ale.CrawlFinished, received.CrawlState)
+	assert.Equal(t, "http://ale.local/api/v1/build/1", received.Location)
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, []int{200}, statusCodes(crawl.Deliveries))
+}
+
+func Test_DeliverRetries(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	database := &mock.DB{}
+
+	assert.Nil(t, newNotifier(database).Deliver(ctx, storedCrawl(database, ts.URL)))
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, []int{503, 503, 200}, statusCodes(crawl.Deliveries))
+	assert.NotEmpty(t, crawl.Deliveries[0].Error)
+}
+
+func Test_DeliverGivesUp(t *testing.T) {
+	for status, attempts := range map[int]int{
+		http.StatusBadGateway: 3,
+		http.StatusNotFound:   1,
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		database := &mock.DB{}
+
+		assert.NotNil(t, newNotifier(database).Deliver(ctx, storedCrawl(database, ts.URL)))
+		crawl, _ := database.GetCrawl(ctx, "1")
+		assert.Len(t, crawl.Deliveries, attempts, "status %d", status)
+		ts.Close()
+	}
+}
+
+func Test_DeliverLeavesNewerCrawlAlone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	database := &mock.DB{}
+	crawl := storedCrawl(database, ts.URL)
+	database.PutCrawl(ctx, &ale.Crawl{
+		BuildID: "1",
+		State:   ale.CrawlRunning,
+		Created: time.Now(),
+	})
+
+	assert.Nil(t, newNotifier(database).Deliver(ctx, crawl))
+	stored, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlRunning, stored.State)
+	assert.Empty(t, stored.Deliveries)
+}
+
+func Test_DeliverRefusesInternalAddresses(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+	database := &mock.DB{}
+	cfg := config.DefaultConfig()
+	cfg.Callbacks.Retries = 2
+
+	assert.NotNil(t, NewNotifier(database, cfg).Deliver(ctx, storedCrawl(database, ts.URL)))
+	assert.False(t, called)
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Len(t, crawl.Deliveries, 1)
+	assert.Contains(t, crawl.Deliveries[0].Error, "internal addresses")
+}
+
+func Test_DeliverStopsWithTheContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	n := newNotifier(&mock.DB{})
+	n.backoff = time.Hour
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, n.Deliver(cancelled, finishedCrawl(ts.URL)))
+}
+
+func Test_Validate(t *testing.T) {
+	cfg := config.DefaultConfig()
+	assert.Nil(t, Validate("https://ci-bot.local/hooks/ale", cfg))
+	assert.NotNil(t, Validate("ftp://ci-bot.local/hooks/ale", cfg))
+	assert.NotNil(t, Validate("/hooks/ale", cfg))
+	for _, internal := range []string{
+		"http://localhost:8080/",
+		"http://127.0.0.1/",
+		"http://[::1]/",
+		"http://10.1.2.3/",
+		"http://192.168.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://0.0.0.0/",
+	} {
+		assert.NotNil(t, Validate(internal, cfg), internal)
+	}
+
+	cfg.Callbacks.AllowedHosts = []string{"ci-bot.local"}
+	assert.Nil(t, Validate("https://ci-bot.local:8443/hooks/ale", cfg))
+	assert.NotNil(t, Validate("https://metadata.internal/", cfg))
+}
+
+func statusCodes(deliveries []ale.Delivery) []int {
+	var codes []int
+	for _, delivery := range deliveries {
+		codes = append(codes, delivery.StatusCode)
+	}
+	return codes
+}
@@ -6,10 +6,15 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 
 	"github.com/alde/ale/config"
 	"github.com/alde/ale/db"
 	"github.com/alde/ale/db/postgres"
+	"github.com/alde/ale/db/sqlite"
+	"github.com/alde/ale/jenkins"
+	"github.com/alde/ale/retention"
 	"github.com/alde/ale/server"
 	"github.com/alde/ale/version"
 
@@ -27,7 +32,25 @@ func main() {
 	cfg := config.Initialize(*configFile)
 	setupLogging(cfg)
 	ctx := context.Background()
+	switch flag.Arg(0) {
+	case "migrate":
+		runMigrate(cfg, flag.Args()[1:])
+		return
+	case "export":
+		runExport(ctx, cfg, flag.Args()[1:])
+		return
+	case "import":
+		runImport(ctx, cfg, flag.Args()[1:])
+		return
+	case "migrate-data":
+		runMigrateData(ctx, cfg, flag.Args()[1:])
+		return
+	}
 	database := setupDatabase(ctx, cfg)
+	client, err := jenkins.NewClient(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to configure jenkins client")
+	}
 
 	bind := fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.Port)
 	logrus.WithFields(logrus.Fields{
@@ -35,55 +58,160 @@ func main() {
 		"address": cfg.Server.Address,
 		"port":    cfg.Server.Port,
 	}).Info("Launching ALE")
-	router := server.NewRouter(cfg, database)
+	crawls := jenkins.NewManager(database, cfg, client)
+	crawls.Start()
+	onShutdown(crawls.Stop)
+	go func() {
+		if err := crawls.Resume(ctx); err != nil {
+			logrus.WithError(err).Error("unable to resume unfinished crawls")
+		}
+	}()
+	if retention.Enabled(cfg) {
+		go retention.NewJanitor(database, cfg).Start()
+	}
+	router := server.NewRouter(cfg, database, client, crawls)
 	if err := manners.ListenAndServe(bind, router); err != nil {
 		logrus.WithError(err).Fatal("Unrecoverable error!")
 	}
 }
 
+// The backends builds can be stored in
+const (
+	backendPostgres  = "postgres"
+	backendDatastore = "datastore"
+	backendFilestore = "filestore"
+	backendSQLite    = "sqlite"
+)
+
 func setupDatabase(ctx context.Context, cfg *config.Config) db.Database {
-	if (config.SQLConf{}) != cfg.PostgreSQL {
+	backend := defaultBackend(cfg)
+	if backend == backendSQLite {
+		warnLegacyFilestore()
+	}
+	database, err := openDatabase(ctx, cfg, backend)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up the database")
+	}
+	return database
+}
+
+// defaultBackend is the first configured backend, or SQLite if none is
+func defaultBackend(cfg *config.Config) string {
+	switch {
+	case (config.SQLConf{}) != cfg.PostgreSQL:
+		return backendPostgres
+	case (config.DatastoreConf{}) != cfg.GoogleCloudDatastore:
+		return backendDatastore
+	case (config.FilestoreConf{}) != cfg.Filestore:
+		return backendFilestore
+	}
+	return backendSQLite
+}
+
+// warnLegacyFilestore points out the builds kept next to the executable by
+// earlier versions of ale, which used that folder as a Filestore by default
+// and now start on an empty SQLite database instead
+func warnLegacyFilestore() {
+	folder, err := osext.ExecutableFolder()
+	if err != nil {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(folder, "out_*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"folder": folder,
+		"builds": len(files),
+	}).Warn("builds of an earlier version of ale were found next to the executable, and are not read from there anymore. " +
+		"Set [filestore] folder to this folder and run migrate-data -from filestore -to sqlite to keep them")
+}
+
+// openDatabase connects to the backend, as configured in its section of the config
+func openDatabase(ctx context.Context, cfg *config.Config, backend string) (db.Database, error) {
+	switch backend {
+	case backendPostgres:
+		if (config.SQLConf{}) == cfg.PostgreSQL {
+			return nil, fmt.Errorf("%s is not configured", backend)
+		}
 		logrus.WithFields(logrus.Fields{
 			"host":     cfg.PostgreSQL.Host,
 			"port":     cfg.PostgreSQL.Port,
 			"username": cfg.PostgreSQL.Username,
 		}).Info("configuring postgres connection")
-		db, err := postgres.New(cfg)
-		if err != nil {
-			logrus.WithError(err).Fatal("unable to create postgres client")
-		}
-		return db
-	}
+		return postgres.New(cfg)
 
-	if (config.DatastoreConf{}) != cfg.GoogleCloudDatastore {
+	case backendDatastore:
+		if (config.DatastoreConf{}) == cfg.GoogleCloudDatastore {
+			return nil, fmt.Errorf("%s is not configured", backend)
+		}
 		logrus.WithFields(logrus.Fields{
 			"namespace": cfg.GoogleCloudDatastore.Namespace,
 			"project":   cfg.GoogleCloudDatastore.Project,
 		}).Info("configuring datastore connection")
 		ds, err := datastore.NewClient(ctx, cfg.GoogleCloudDatastore.Project)
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to initialize datastore library")
+			return nil, fmt.Errorf("unable to initialize datastore library: %v", err)
+		}
+		database, err := db.NewDatastore(cfg, ds)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := database.Has(ctx, "0"); err != nil {
+			return nil, fmt.Errorf("unable to check connection to the database: %v", err)
 		}
-		database, err := db.NewDatastore(ctx, cfg, ds)
+		// Builds stored before summaries existed would be missing from listings
+		added, err := database.(*db.Datastore).Backfill(ctx)
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to create datastore client")
+			return nil, fmt.Errorf("unable to backfill build summaries: %v", err)
 		}
-		if _, err := database.Has("0"); err != nil {
-			logrus.WithError(err).Fatal("unable to check connection to the database")
+		if added > 0 {
+			logrus.WithField("count", added).Info("backfilled build summaries")
+		}
+		return database, nil
+
+	case backendFilestore:
+		if (config.FilestoreConf{}) == cfg.Filestore {
+			return nil, fmt.Errorf("%s is not configured", backend)
 		}
-		return database
+		logrus.WithField("folder", cfg.Filestore.Folder).Info("configuring filestore")
+		if err := os.MkdirAll(cfg.Filestore.Folder, 0755); err != nil {
+			return nil, err
+		}
+		return db.NewFilestore(cfg.Filestore.Folder, cfg.Storage.Compression)
+
+	case backendSQLite:
+		setDefaultSQLitePath(cfg)
+		logrus.WithField("path", cfg.SQLite.Path).Info("configuring sqlite database")
+		return sqlite.New(cfg)
+	}
+	return nil, fmt.Errorf("unknown backend %q, use %s, %s, %s or %s",
+		backend, backendPostgres, backendDatastore, backendFilestore, backendSQLite)
+}
+
+// setDefaultSQLitePath keeps the database in the data directory unless
+// configured otherwise, creating the directory if needed
+func setDefaultSQLitePath(cfg *config.Config) {
+	if cfg.SQLite.Path != "" {
+		return
+	}
+	folder := dataFolder()
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		logrus.WithError(err).WithField("folder", folder).Fatal("unable to create the data folder, configure [sqlite] path")
 	}
+	cfg.SQLite.Path = filepath.Join(folder, "ale.db")
+}
 
-	logrus.Info("setting up filesystem pretend database")
-	folder, err := osext.ExecutableFolder()
-	if err != nil {
-		logrus.WithError(err).Fatal("unable to create fake database")
+// dataFolder is $XDG_DATA_HOME/ale, which defaults to ~/.local/share/ale,
+// or /var/lib/ale for users without a home
+func dataFolder() string {
+	if folder := os.Getenv("XDG_DATA_HOME"); folder != "" {
+		return filepath.Join(folder, "ale")
 	}
-	database, err := db.NewFilestore(folder)
-	if err != nil {
-		logrus.WithError(err).Fatal("unable to create fake database")
+	if home, err := os.UserHomeDir(); err == nil && home != "" && home != "/" {
+		return filepath.Join(home, ".local", "share", "ale")
 	}
-	return database
+	return "/var/lib/ale"
 }
 
 func setupLogging(cfg *config.Config) {
@@ -102,6 +230,18 @@ func setupLogging(cfg *config.Config) {
 	logrus.SetLevel(level)
 }
 
+var (
+	shutdownMutex sync.Mutex
+	shutdownHooks []func()
+)
+
+// onShutdown registers fn to be run once ale is interrupted, before it exits
+func onShutdown(fn func()) {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
 func catchInterrupt() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
@@ -110,5 +250,10 @@ func catchInterrupt() {
 		return
 	}
 	logrus.Info("Shutting down.")
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	for _, fn := range shutdownHooks {
+		fn()
+	}
 	os.Exit(0)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	gosql "database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db/postgres"
+	"github.com/alde/ale/db/sqlite"
+	"github.com/alde/ale/db/sqlstore"
+)
+
+const migrateUsage = `usage: ale [-config file] migrate [command]
+
+commands:
+  up [version]    apply the migrations up to version, or all of them (default)
+  down [version]  revert the migrations newer than version, or only the last one
+  status          list the migrations and whether they have been applied`
+
+// runMigrate upgrades or downgrades the schema of the configured Postgres
+// database, or of the SQLite database otherwise
+func runMigrate(cfg *config.Config, args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	version := -1
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		version = v
+	}
+
+	var database *gosql.DB
+	var migrator *sqlstore.Migrator
+	var err error
+	if (config.SQLConf{}) != cfg.PostgreSQL {
+		database, err = postgres.Connect(cfg)
+		if err == nil {
+			migrator, err = postgres.NewMigrator(database)
+		}
+	} else {
+		setDefaultSQLitePath(cfg)
+		database, err = sqlite.Connect(cfg)
+		if err == nil {
+			migrator, err = sqlite.NewMigrator(database)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to prepare database migrations")
+	}
+	defer database.Close()
+	current, err := migrator.Version()
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read the schema version")
+	}
+
+	switch command {
+	case "up":
+		if version < 0 {
+			version = 0
+		}
+		err = migrator.Up(version)
+	case "down":
+		if version < 0 {
+			version = current - 1
+		}
+		err = migrator.Down(version)
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to read the applied migrations")
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied"
+			}
+			fmt.Printf("%04d %-32s %s\n", s.Version, s.Description, applied)
+		}
+		return
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("migration failed")
+	}
+	current, _ = migrator.Version()
+	logrus.WithField("version", current).Info("database schema migrated")
+}
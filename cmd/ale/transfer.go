@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/transfer"
+)
+
+const transferUsage = `usage:
+  ale [-config file] export [-from backend] [-gzip] [file]
+  ale [-config file] import [-to backend] [-overwrite] [file]
+  ale [-config file] migrate-data -from backend -to backend [-overwrite] [-checkpoint file]
+
+backends: postgres, datastore, filestore, sqlite
+file defaults to stdout or stdin, archives named *.gz are gzipped`
+
+func transferFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, transferUsage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// runExport writes every build of a backend to an NDJSON archive
+func runExport(ctx context.Context, cfg *config.Config, args []string) {
+	flags := transferFlags("export")
+	from := flags.String("from", defaultBackend(cfg), "backend to export the builds from")
+	gzipped := flags.Bool("gzip", false, "gzip the archive, the default for files named *.gz")
+	flags.Parse(args)
+
+	database, err := openDatabase(ctx, cfg, *from)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up the database")
+	}
+	var out io.WriteCloser = os.Stdout
+	file := flags.Arg(0)
+	if file != "" && file != "-" {
+		out, err = os.Create(file)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to create the archive")
+		}
+		*gzipped = *gzipped || strings.HasSuffix(file, ".gz")
+	}
+	var w io.WriteCloser = out
+	if *gzipped {
+		w = gzip.NewWriter(out)
+	}
+	stats, err := transfer.Export(ctx, database, w)
+	if err != nil {
+		logrus.WithError(err).Fatal("export failed")
+	}
+	if err := w.Close(); err != nil {
+		logrus.WithError(err).Fatal("unable to write the archive")
+	}
+	if err := out.Close(); err != nil {
+		logrus.WithError(err).Fatal("unable to write the archive")
+	}
+	logrus.WithFields(logrus.Fields{
+		"exported": stats.Copied,
+		"failed":   stats.Failed,
+	}).Info("export finished")
+}
+
+// runImport reads an archive written by export into a backend
+func runImport(ctx context.Context, cfg *config.Config, args []string) {
+	flags := transferFlags("import")
+	to := flags.String("to", defaultBackend(cfg), "backend to import the builds into")
+	overwrite := flags.Bool("overwrite", false, "replace the builds already in the backend")
+	flags.Parse(args)
+
+	database, err := openDatabase(ctx, cfg, *to)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up the database")
+	}
+	var in io.ReadCloser = os.Stdin
+	if file := flags.Arg(0); file != "" && file != "-" {
+		in, err = os.Open(file)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to open the archive")
+		}
+	}
+	defer in.Close()
+	stats, err := transfer.Import(ctx, database, in, transfer.Options{Overwrite: *overwrite})
+	fields := logrus.Fields{
+		"imported": stats.Copied,
+		"skipped":  stats.Skipped,
+		"failed":   stats.Failed,
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Fatal("import failed")
+	}
+	logrus.WithFields(fields).Info("import finished")
+}
+
+// runMigrateData copies every build from one backend to another
+func runMigrateData(ctx context.Context, cfg *config.Config, args []string) {
+	flags := transferFlags("migrate-data")
+	from := flags.String("from", "", "backend to copy the builds from")
+	to := flags.String("to", "", "backend to copy the builds to")
+	overwrite := flags.Bool("overwrite", false, "replace the builds already in the destination")
+	checkpoint := flags.String("checkpoint", "migrate-data.checkpoint",
+		"file remembering the progress of the copy, so that it resumes if interrupted")
+	flags.Parse(args)
+	if *from == "" || *to == "" || *from == *to {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	source, err := openDatabase(ctx, cfg, *from)
+	if err != nil {
+		logrus.WithError(err).WithField("backend", *from).Fatal("unable to set up the source database")
+	}
+	destination, err := openDatabase(ctx, cfg, *to)
+	if err != nil {
+		logrus.WithError(err).WithField("backend", *to).Fatal("unable to set up the destination database")
+	}
+	stats, err := transfer.Copy(ctx, source, destination, transfer.Options{
+		Overwrite:  *overwrite,
+		Checkpoint: *checkpoint,
+	})
+	fields := logrus.Fields{
+		"from":    *from,
+		"to":      *to,
+		"copied":  stats.Copied,
+		"skipped": stats.Skipped,
+		"failed":  stats.Failed,
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Fatal("migration of the builds failed, run again to resume")
+	}
+	logrus.WithFields(fields).Info("migration of the builds finished")
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/kardianos/osext"
@@ -13,6 +14,10 @@ import (
 type DatastoreConf struct {
 	Namespace string
 	Project   string
+
+	// ReadTimeout and WriteTimeout bound each operation, unless zero
+	ReadTimeout  Duration
+	WriteTimeout Duration
 }
 
 // SQLConf holds the config values for SQL databases
@@ -23,6 +28,52 @@ type SQLConf struct {
 	Port         int
 	Database     string
 	DisableSSL   bool
+
+	// ReadTimeout and WriteTimeout bound each operation, unless zero
+	ReadTimeout  Duration
+	WriteTimeout Duration
+
+	// SkipMigrations leaves upgrading the schema to the migrate command
+	SkipMigrations bool
+}
+
+// SQLiteConf holds the config values for the embedded SQLite database
+type SQLiteConf struct {
+	Path string
+
+	// ReadTimeout and WriteTimeout bound each operation, unless zero
+	ReadTimeout  Duration
+	WriteTimeout Duration
+
+	// SkipMigrations leaves upgrading the schema to the migrate command
+	SkipMigrations bool
+}
+
+// FilestoreConf holds the config values for the Filestore
+type FilestoreConf struct {
+	Folder string
+}
+
+// Duration is a time.Duration which can be read from strings such as "5s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses the duration from the config file
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// JenkinsConf holds the credentials used when talking to a Jenkins host
+type JenkinsConf struct {
+	Host       string
+	Username   string
+	TokenFile  string
+	CACert     string
+	ClientCert string
+	ClientKey  string
 }
 
 // Config struct holds the current configuration
@@ -41,9 +92,56 @@ type Config struct {
 
 	GoogleCloudDatastore DatastoreConf
 	PostgreSQL           SQLConf
+	SQLite               SQLiteConf
+	Filestore            FilestoreConf
+
+	Storage struct {
+		// Compression of the builds stored in Datastore and the Filestore. The SQL
+		// backends keep one row per log line, which they index for searching.
+		Compression string
+	}
 
 	Crawler struct {
 		LogPattern string
+		Workers    int
+		QueueSize  int
+
+		PollInterval    Duration
+		Backoff         float64
+		MaxPollInterval Duration
+		MaxDuration     Duration
+
+		RequestTimeout Duration
+		Retries        int
+		RetryBackoff   Duration
+	}
+
+	Jenkins []JenkinsConf
+
+	Webhook struct {
+		// SecretFile holds the secret Jenkins must present, the webhook is disabled without it
+		SecretFile string
+		// Include and Exclude are patterns such as team/* matched against the full
+		// name of the job, team/** also matching the jobs in nested folders
+		Include []string
+		Exclude []string
+	}
+
+	Callbacks struct {
+		Timeout      Duration
+		Retries      int
+		RetryBackoff Duration
+		// AllowedHosts limits the hosts callbacks can be sent to. When empty,
+		// callbacks may go to any host but those with an internal address.
+		AllowedHosts []string
+	}
+
+	Retention struct {
+		MaxAge          Duration
+		MaxBuildsPerJob int
+		FailedMaxAge    Duration
+		Interval        Duration
+		DryRun          bool
 	}
 }
 
@@ -69,6 +167,20 @@ func DefaultConfig() *Config {
 	cfg.Metadata["owner"] = os.Getenv("USER")
 
 	cfg.Crawler.LogPattern = `.*\[([\d{4}\-\d{2}\-\d{2}T\d{2}:\d{2}:\d{2}.\d*Z]*)\].*?\s(.*)$`
+	cfg.Crawler.Workers = 4
+	cfg.Crawler.QueueSize = 100
+	cfg.Crawler.PollInterval = Duration{5 * time.Second}
+	cfg.Crawler.Backoff = 1.5
+	cfg.Crawler.MaxPollInterval = Duration{time.Minute}
+	cfg.Crawler.MaxDuration = Duration{12 * time.Hour}
+	cfg.Crawler.RequestTimeout = Duration{30 * time.Second}
+	cfg.Crawler.Retries = 3
+	cfg.Crawler.RetryBackoff = Duration{time.Second}
+	cfg.Callbacks.Timeout = Duration{10 * time.Second}
+	cfg.Callbacks.Retries = 5
+	cfg.Callbacks.RetryBackoff = Duration{2 * time.Second}
+	cfg.Retention.Interval = Duration{time.Hour}
+	cfg.Storage.Compression = "gzip"
 
 	return cfg
 }
@@ -107,4 +219,23 @@ func ReadConfigFile(cfg *Config, path string) {
 	if _, err := toml.DecodeFile(path, cfg); err != nil {
 		logrus.WithError(err).Fatal("unable to read config")
 	}
+	cfg.clampPollIntervals()
+}
+
+// MinPollInterval is the shortest time the crawler waits between two polls of a build
+const MinPollInterval = time.Second
+
+// clampPollIntervals raises the poll intervals configured below MinPollInterval
+// to it, as the crawler would otherwise poll Jenkins in a busy loop
+func (cfg *Config) clampPollIntervals() {
+	if cfg.Crawler.PollInterval.Duration < MinPollInterval {
+		logrus.WithField("pollinterval", cfg.Crawler.PollInterval.Duration).
+			Warnf("poll interval is too short, using %s", MinPollInterval)
+		cfg.Crawler.PollInterval.Duration = MinPollInterval
+	}
+	if max := cfg.Crawler.MaxPollInterval.Duration; max > 0 && max < MinPollInterval {
+		logrus.WithField("maxpollinterval", max).
+			Warnf("maximum poll interval is too short, using %s", MinPollInterval)
+		cfg.Crawler.MaxPollInterval.Duration = MinPollInterval
+	}
 }
@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +18,13 @@ func Test_DefaultConfig(t *testing.T) {
 	assert.Equal(t, "DEBUG", c.Logging.Level)
 	assert.Equal(t, DatastoreConf{}, c.GoogleCloudDatastore)
 	assert.Equal(t, os.Getenv("USER"), c.Metadata["owner"])
+	assert.Equal(t, 5*time.Second, c.Crawler.PollInterval.Duration)
+	assert.Equal(t, 12*time.Hour, c.Crawler.MaxDuration.Duration)
+	assert.Equal(t, time.Hour, c.Retention.Interval.Duration)
+	assert.Zero(t, c.Retention.MaxAge.Duration)
+	assert.Equal(t, "gzip", c.Storage.Compression)
+	assert.Equal(t, 5, c.Callbacks.Retries)
+	assert.Empty(t, c.Callbacks.AllowedHosts)
 
 }
 
@@ -33,6 +42,37 @@ func Test_ReadConfigFile(t *testing.T) {
 	assert.NotEqual(t, DatastoreConf{}, c.GoogleCloudDatastore)
 	assert.Equal(t, "my-gcs-project", c.GoogleCloudDatastore.Project)
 	assert.Equal(t, "ale-jenkinslog", c.GoogleCloudDatastore.Namespace)
+
+	assert.Equal(t, 2*time.Second, c.Crawler.PollInterval.Duration)
+	assert.Equal(t, 2.0, c.Crawler.Backoff)
+	assert.Equal(t, 30*time.Second, c.Crawler.MaxPollInterval.Duration)
+	assert.Equal(t, 3*time.Hour, c.Crawler.MaxDuration.Duration)
+
+	assert.Len(t, c.Jenkins, 2)
+	assert.Equal(t, "https://jenkins.local/", c.Jenkins[0].Host)
+	assert.Equal(t, "ale", c.Jenkins[0].Username)
+	assert.Equal(t, "/path/to/file/with/token", c.Jenkins[0].TokenFile)
+	assert.Equal(t, "/path/to/ca.pem", c.Jenkins[0].CACert)
+	assert.Equal(t, "/path/to/client.pem", c.Jenkins[1].ClientCert)
+	assert.Equal(t, "/path/to/client.key", c.Jenkins[1].ClientKey)
+
+	assert.Equal(t, 720*time.Hour, c.Retention.MaxAge.Duration)
+	assert.Equal(t, 50, c.Retention.MaxBuildsPerJob)
+	assert.Equal(t, 2160*time.Hour, c.Retention.FailedMaxAge.Duration)
+	assert.Equal(t, 30*time.Minute, c.Retention.Interval.Duration)
+	assert.True(t, c.Retention.DryRun)
+
+	assert.Equal(t, 5*time.Second, c.Callbacks.Timeout.Duration)
+	assert.Equal(t, 2, c.Callbacks.Retries)
+	assert.Equal(t, 2*time.Second, c.Callbacks.RetryBackoff.Duration)
+	assert.Equal(t, []string{"ci-bot.internal"}, c.Callbacks.AllowedHosts)
+
+	assert.Equal(t, "/path/to/file/with/webhook/secret", c.Webhook.SecretFile)
+	assert.Equal(t, []string{"team/**"}, c.Webhook.Include)
+	assert.Equal(t, []string{"team/sandbox/*"}, c.Webhook.Exclude)
+
+	assert.Equal(t, "zstd", c.Storage.Compression)
+	assert.Equal(t, "/var/lib/ale/builds", c.Filestore.Folder)
 }
 
 func Test_ReadConfigFilePostgres(t *testing.T) {
@@ -48,6 +88,33 @@ func Test_ReadConfigFilePostgres(t *testing.T) {
 	assert.Equal(t, 5432, c.PostgreSQL.Port)
 	assert.Equal(t, "ale_database_name", c.PostgreSQL.Database)
 	assert.Equal(t, true, c.PostgreSQL.DisableSSL)
+	assert.Equal(t, 5*time.Second, c.PostgreSQL.ReadTimeout.Duration)
+	assert.Equal(t, 30*time.Second, c.PostgreSQL.WriteTimeout.Duration)
+}
+
+func Test_ReadConfigFileSQLite(t *testing.T) {
+	c := DefaultConfig()
+	wd, _ := os.Getwd()
+
+	ReadConfigFile(c, fmt.Sprintf("%s/config_sqlite_test.toml", wd))
+
+	assert.Equal(t, SQLConf{}, c.PostgreSQL)
+	assert.Equal(t, "/var/lib/ale/ale.db", c.SQLite.Path)
+	assert.True(t, c.SQLite.SkipMigrations)
+}
+
+func Test_ReadConfigFileClampsPollIntervals(t *testing.T) {
+	file, _ := ioutil.TempFile(os.TempDir(), "config")
+	defer os.Remove(file.Name())
+	file.WriteString("[crawler]\npollinterval = \"0s\"\nbackoff = 2.0\nmaxpollinterval = \"100ms\"\n")
+	file.Close()
+	c := DefaultConfig()
+
+	ReadConfigFile(c, file.Name())
+
+	assert.Equal(t, MinPollInterval, c.Crawler.PollInterval.Duration)
+	assert.Equal(t, MinPollInterval, c.Crawler.MaxPollInterval.Duration)
+	assert.Equal(t, 2.0, c.Crawler.Backoff)
 }
 
 func Test_ReadConfigFile_Error(t *testing.T) {
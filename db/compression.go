@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/alde/ale"
+)
+
+// The algorithms the log payload can be compressed with
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// The magic numbers opening gzip and zstd streams mark the format of a
+// payload, plain JSON opens with neither
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ValidateCompression refuses unknown compression algorithms
+func ValidateCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, use %s, %s or %s",
+		compression, CompressionGzip, CompressionZstd, CompressionNone)
+}
+
+// EncodeBuild serializes the build to JSON, compressed with the given algorithm.
+// No compression is applied if the algorithm is empty.
+func EncodeBuild(data *ale.JenkinsData, compression string) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return Compress(b, compression)
+}
+
+// DecodeBuild deserializes a build written by EncodeBuild, or stored as plain
+// JSON before compression was enabled
+func DecodeBuild(payload []byte) (*ale.JenkinsData, error) {
+	b, err := Decompress(payload)
+	if err != nil {
+		return nil, err
+	}
+	var data ale.JenkinsData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Compress compresses the payload with the given algorithm
+func Compress(payload []byte, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case "", CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CompressionZstd:
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ValidateCompression(compression)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress recognizes the compression of the payload by its magic number,
+// and returns payloads without one as they are
+func Decompress(payload []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(payload, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case bytes.HasPrefix(payload, zstdMagic):
+		r, err := zstd.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return payload, nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+)
+
+func compressionFixture() *ale.JenkinsData {
+	return &ale.JenkinsData{
+		BuildID: "foobar",
+		Status:  "SUCCESS",
+		Stages: []*ale.JenkinsStage{
+			{Name: "Build", Logs: []*ale.Log{{Line: "compiling"}, {Line: "compiling"}, {Line: "done"}}},
+		},
+	}
+}
+
+func Test_EncodeDecodeBuild(t *testing.T) {
+	plain, _ := json.Marshal(compressionFixture())
+	for _, compression := range []string{"", CompressionNone, CompressionGzip, CompressionZstd} {
+		payload, err := EncodeBuild(compressionFixture(), compression)
+		assert.Nil(t, err, compression)
+
+		data, err := DecodeBuild(payload)
+		assert.Nil(t, err, compression)
+		assert.Equal(t, compressionFixture(), data, compression)
+
+		if compression == CompressionGzip || compression == CompressionZstd {
+			assert.NotEqual(t, plain, payload, compression)
+		} else {
+			assert.Equal(t, plain, payload, compression)
+		}
+	}
+}
+
+func Test_DecodeBuildUncompressed(t *testing.T) {
+	// As written by earlier versions of the Filestore
+	indented, _ := json.MarshalIndent(compressionFixture(), "", "\t")
+	data, err := DecodeBuild(indented)
+	assert.Nil(t, err)
+	assert.Equal(t, compressionFixture(), data)
+}
+
+func Test_UnknownCompression(t *testing.T) {
+	assert.NotNil(t, ValidateCompression("lz4"))
+	_, err := EncodeBuild(compressionFixture(), "lz4")
+	assert.NotNil(t, err)
+	_, err = NewFilestore("/tmp", "lz4")
+	assert.NotNil(t, err)
+}
@@ -1,13 +1,54 @@
 package db
 
 import (
+	"context"
+	"time"
+
 	"github.com/alde/ale"
 )
 
-// Database interface providing the contract that we expect
+// ErrNotFound is returned when the requested entry does not exist. It is
+// declared in the ale package, so that the mocks can return it too.
+var ErrNotFound = ale.ErrNotFound
+
+// Database interface providing the contract that we expect. Every operation
+// gives up once the context is done.
 type Database interface {
-	Put(data *ale.JenkinsData, buildID string) error
-	Get(buildID string) (*ale.JenkinsData, error)
-	Has(buildID string) (bool, error)
-	Remove(buildID string) error
+	Put(ctx context.Context, data *ale.JenkinsData, buildID string) error
+	Get(ctx context.Context, buildID string) (*ale.JenkinsData, error)
+	Has(ctx context.Context, buildID string) (bool, error)
+	Remove(ctx context.Context, buildID string) error
+
+	PutCrawl(ctx context.Context, crawl *ale.Crawl) error
+	GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error)
+	PendingCrawls(ctx context.Context) ([]*ale.Crawl, error)
+
+	List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error)
+	// RemoveBuilds deletes the builds along with their crawl records,
+	// returning how many builds there were to delete
+	RemoveBuilds(ctx context.Context, buildIDs []string) (int, error)
+}
+
+// Timeouts bound how long a single operation on a backend may take, on top
+// of the deadline of the context it's given. Zero leaves it unbounded.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+// ReadContext bounds an operation reading from the backend
+func (t Timeouts) ReadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+// WriteContext bounds an operation writing to the backend
+func (t Timeouts) WriteContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
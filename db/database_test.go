@@ -0,0 +1,25 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Timeouts(t *testing.T) {
+	timeouts := Timeouts{Read: time.Minute}
+
+	readCtx, cancel := timeouts.ReadContext(context.Background())
+	defer cancel()
+	deadline, ok := readCtx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	writeCtx, cancel := timeouts.WriteContext(context.Background())
+	_, ok = writeCtx.Deadline()
+	assert.False(t, ok, "no write timeout is configured")
+	cancel()
+	assert.Equal(t, context.Canceled, writeCtx.Err())
+}
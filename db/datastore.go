@@ -2,6 +2,9 @@ package db
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/alde/ale"
@@ -11,9 +14,10 @@ import (
 
 // Datastore is a Google Cloud Datastore implementation of the Database interface
 type Datastore struct {
-	Client    datastoreInterface
-	ctx       context.Context
-	namespace string
+	Client      datastoreInterface
+	namespace   string
+	compression string
+	timeouts    Timeouts
 }
 
 type datastoreInterface interface {
@@ -21,39 +25,161 @@ type datastoreInterface interface {
 	Get(context.Context, *datastore.Key, interface{}) error
 	Count(context.Context, *datastore.Query) (int, error)
 	Delete(context.Context, *datastore.Key) error
+	DeleteMulti(context.Context, []*datastore.Key) error
+	GetAll(context.Context, *datastore.Query, interface{}) ([]*datastore.Key, error)
 }
 
 // NewDatastore creates a new Datastore database object
-func NewDatastore(ctx context.Context, cfg *config.Config, dsClient datastoreInterface) (Database, error) {
+func NewDatastore(cfg *config.Config, dsClient datastoreInterface) (Database, error) {
+	if err := ValidateCompression(cfg.Storage.Compression); err != nil {
+		return nil, err
+	}
 	return &Datastore{
-		Client:    dsClient,
-		ctx:       ctx,
-		namespace: cfg.GoogleCloudDatastore.Namespace,
+		Client:      dsClient,
+		namespace:   cfg.GoogleCloudDatastore.Namespace,
+		compression: cfg.Storage.Compression,
+		timeouts: Timeouts{
+			Read:  cfg.GoogleCloudDatastore.ReadTimeout.Duration,
+			Write: cfg.GoogleCloudDatastore.WriteTimeout.Duration,
+		},
 	}, nil
 }
 
 func (db *Datastore) makeKey(buildID string) *datastore.Key {
+	return db.makeKindKey("JenkinsBuild", buildID)
+}
+
+func (db *Datastore) makeKindKey(kind string, buildID string) *datastore.Key {
 	return &datastore.Key{
-		Kind:      "JenkinsBuild",
+		Kind:      kind,
 		Name:      buildID,
 		Parent:    nil,
 		Namespace: db.namespace,
 	}
 }
 
+// makeChunkKey is the key of the nth chunk of a generation of a build, the
+// first being the build itself. Chunks written before generations were
+// introduced belong to generation 0.
+func (db *Datastore) makeChunkKey(buildID string, generation int64, n int) *datastore.Key {
+	name := strconv.Itoa(n)
+	if generation != 0 {
+		name = chunkPrefix(generation) + name
+	}
+	key := db.makeKindKey("JenkinsBuildChunk", name)
+	key.Parent = db.makeKey(buildID)
+	return key
+}
+
+func chunkPrefix(generation int64) string {
+	return strconv.FormatInt(generation, 10) + "-"
+}
+
+// chunkKeys looks up the keys of every chunk of a build
+func (db *Datastore) chunkKeys(ctx context.Context, buildID string) ([]*datastore.Key, error) {
+	query := datastore.
+		NewQuery("JenkinsBuildChunk").
+		Namespace(db.namespace).
+		Ancestor(db.makeKey(buildID)).
+		KeysOnly()
+	return db.Client.GetAll(ctx, query, nil)
+}
+
 // Put inserts data into the database
-func (db *Datastore) Put(data *ale.JenkinsData, buildID string) error {
-	key := db.makeKey(buildID)
+func (db *Datastore) Put(ctx context.Context, data *ale.JenkinsData, buildID string) error {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	payload, err := EncodeBuild(data, db.compression)
+	if err != nil {
+		return err
+	}
+	var chunks [][]byte
+	for len(payload) > datastoreChunkSize {
+		chunks = append(chunks, payload[:datastoreChunkSize])
+		payload = payload[datastoreChunkSize:]
+	}
+	chunks = append(chunks, payload)
+	// The continuation is written under a new generation first, so that readers
+	// see either the previous version of the build or this one, never a mix
+	generation := time.Now().UnixNano()
+	for n := 1; n < len(chunks); n++ {
+		chunk := &ale.DatastoreChunk{Data: chunks[n]}
+		if _, err := db.Client.Put(ctx, db.makeChunkKey(buildID, generation, n), chunk); err != nil {
+			return err
+		}
+	}
 	entity := &ale.DatastoreEntity{
-		Key:   buildID,
-		Value: *data,
+		Key:        buildID,
+		Data:       chunks[0],
+		Chunks:     len(chunks),
+		Generation: generation,
 	}
-	_, err := db.Client.Put(db.ctx, key, entity)
+	if _, err := db.Client.Put(ctx, db.makeKey(buildID), entity); err != nil {
+		return err
+	}
+	if err := db.removeStaleChunks(ctx, buildID, generation); err != nil {
+		logrus.WithError(err).WithField("build_id", buildID).Warn("unable to remove the chunks of a previous version of the build")
+	}
+	// The build itself isn't indexed, so a small summary is kept for listings
+	return db.putSummary(ctx, data, buildID)
+}
+
+// removeStaleChunks deletes the chunks of the build which aren't part of the
+// given generation, once the build no longer points to them
+func (db *Datastore) removeStaleChunks(ctx context.Context, buildID string, generation int64) error {
+	keys, err := db.chunkKeys(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	var stale []*datastore.Key
+	for _, key := range keys {
+		if !strings.HasPrefix(key.Name, chunkPrefix(generation)) {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return db.Client.DeleteMulti(ctx, stale)
+}
+
+func (db *Datastore) putSummary(ctx context.Context, data *ale.JenkinsData, buildID string) error {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	summary := Summarize(data, buildID)
+	// The crawl may be recorded before the build, whose summary then carries its state
+	if crawl, err := db.GetCrawl(ctx, buildID); err == nil {
+		summary.CrawlState = crawl.State
+	} else if err != ErrNotFound {
+		return err
+	}
+	_, err := db.Client.Put(ctx, db.makeKindKey("JenkinsBuildSummary", buildID), summary)
+	return err
+}
+
+// putSummaryCrawlState records the state of the crawl on the summary of the
+// build, so that listings can filter on it. Builds not stored yet are skipped.
+func (db *Datastore) putSummaryCrawlState(ctx context.Context, buildID, state string) error {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	key := db.makeKindKey("JenkinsBuildSummary", buildID)
+	var summary ale.BuildSummary
+	err := db.Client.Get(ctx, key, &summary)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	summary.CrawlState = state
+	_, err = db.Client.Put(ctx, key, &summary)
 	return err
 }
 
 // Has verifies the existance of a key
-func (db *Datastore) Has(buildID string) (bool, error) {
+func (db *Datastore) Has(ctx context.Context, buildID string) (bool, error) {
+	ctx, cancel := db.timeouts.ReadContext(ctx)
+	defer cancel()
 	key := db.makeKey(buildID)
 	query := datastore.
 		NewQuery("JenkinsBuild").
@@ -63,7 +189,7 @@ func (db *Datastore) Has(buildID string) (bool, error) {
 	logrus.WithFields(logrus.Fields{
 		"build_id": buildID,
 	}).Debug("checking the existance of database entry")
-	count, err := db.Client.Count(db.ctx, query)
+	count, err := db.Client.Count(ctx, query)
 	if err != nil {
 		logrus.WithError(err).WithField("build_id", buildID).Debug("database entry not found")
 		return false, err
@@ -82,21 +208,307 @@ func (db *Datastore) Has(buildID string) (bool, error) {
 }
 
 // Get retrieves data from the database
-func (db *Datastore) Get(buildID string) (*ale.JenkinsData, error) {
-	var entity ale.DatastoreEntity
+func (db *Datastore) Get(ctx context.Context, buildID string) (*ale.JenkinsData, error) {
+	ctx, cancel := db.timeouts.ReadContext(ctx)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		var entity ale.DatastoreEntity
+		key := db.makeKey(buildID)
+		err := db.Client.Get(ctx, key, &entity)
+		if err != nil {
+			return nil, err
+		}
+		if entity.Data == nil {
+			// Stored before compression was introduced
+			jdata := entity.Value
+			return &jdata, nil
+		}
+		payload, err := db.readChunks(ctx, buildID, &entity)
+		// The chunks are gone when the build was replaced since it was read
+		if err == datastore.ErrNoSuchEntity && attempt < datastoreReadAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return DecodeBuild(payload)
+	}
+}
+
+// readChunks joins the payload of the entity with the continuation in its chunks
+func (db *Datastore) readChunks(ctx context.Context, buildID string, entity *ale.DatastoreEntity) ([]byte, error) {
+	payload := entity.Data
+	for n := 1; n < entity.Chunks; n++ {
+		var chunk ale.DatastoreChunk
+		if err := db.Client.Get(ctx, db.makeChunkKey(buildID, entity.Generation, n), &chunk); err != nil {
+			return nil, err
+		}
+		payload = append(payload, chunk.Data...)
+	}
+	return payload, nil
+}
+
+// Remove is used to remove an entry from the database
+func (db *Datastore) Remove(ctx context.Context, buildID string) error {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	chunks, err := db.chunkKeys(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	if len(chunks) > 0 {
+		if err := db.Client.DeleteMulti(ctx, chunks); err != nil {
+			return err
+		}
+	}
 	key := db.makeKey(buildID)
-	err := db.Client.Get(db.ctx, key, &entity)
+	if err := db.Client.Delete(ctx, key); err != nil {
+		return err
+	}
+	return db.Client.Delete(ctx, db.makeKindKey("JenkinsBuildSummary", buildID))
+}
+
+// PutCrawl inserts the crawl record into the database
+func (db *Datastore) PutCrawl(ctx context.Context, crawl *ale.Crawl) error {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	key := db.makeKindKey("JenkinsCrawl", crawl.BuildID)
+	if _, err := db.Client.Put(ctx, key, crawl); err != nil {
+		return err
+	}
+	return db.putSummaryCrawlState(ctx, crawl.BuildID, crawl.State)
+}
+
+// GetCrawl retrieves the crawl record from the database
+func (db *Datastore) GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error) {
+	ctx, cancel := db.timeouts.ReadContext(ctx)
+	defer cancel()
+	var crawl ale.Crawl
+	key := db.makeKindKey("JenkinsCrawl", buildID)
+	err := db.Client.Get(ctx, key, &crawl)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
+	return &crawl, nil
+}
 
-	jdata := entity.Value
+// PendingCrawls retrieves every crawl record which has not yet finished
+func (db *Datastore) PendingCrawls(ctx context.Context) ([]*ale.Crawl, error) {
+	ctx, cancel := db.timeouts.ReadContext(ctx)
+	defer cancel()
+	var pending []*ale.Crawl
+	for _, state := range []string{ale.CrawlQueued, ale.CrawlRunning} {
+		query := datastore.
+			NewQuery("JenkinsCrawl").
+			Namespace(db.namespace).
+			Filter("state =", state)
+		var crawls []*ale.Crawl
+		if _, err := db.Client.GetAll(ctx, query, &crawls); err != nil {
+			return nil, err
+		}
+		pending = append(pending, crawls...)
+	}
+	return pending, nil
+}
 
-	return &jdata, nil
+// List pages through the build summaries matching the query. Each page is
+// queried from where the cursor points, ordered by start time and build id,
+// which requires the composite indexes of index.yaml.
+func (db *Datastore) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	ctx, cancel := db.timeouts.ReadContext(ctx)
+	defer cancel()
+	cursor, err := DecodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	// One more build than requested tells whether there is a next page
+	batch := datastoreBatchSize
+	if query.Limit > 0 && query.Limit < batch {
+		batch = query.Limit + 1
+	}
+	list := &ale.BuildList{Builds: []*ale.BuildSummary{}}
+	for {
+		builds, err := db.summaryPage(ctx, query, cursor, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, build := range builds {
+			cursor = &Cursor{StartTime: build.StartTime, BuildID: build.BuildID}
+			if query.Limit > 0 && len(list.Builds) == query.Limit {
+				list.NextCursor = EncodeCursor(list.Builds[len(list.Builds)-1])
+				return list, nil
+			}
+			list.Builds = append(list.Builds, build)
+		}
+		if len(builds) < batch {
+			return list, nil
+		}
+	}
 }
 
-// Remove is used to remove an entry from the database
-func (db *Datastore) Remove(buildID string) error {
-	key := db.makeKey(buildID)
-	return db.Client.Delete(db.ctx, key)
+// summaryPage queries up to limit build summaries matching the job, status,
+// crawl state and start time of the query, which come after the cursor in the listing
+func (db *Datastore) summaryPage(ctx context.Context, query *ale.BuildQuery, after *Cursor, limit int) ([]*ale.BuildSummary, error) {
+	direction, past := "-", "<"
+	if query.Ascending {
+		direction, past = "", ">"
+	}
+	filtered := func() *datastore.Query {
+		q := datastore.NewQuery("JenkinsBuildSummary").Namespace(db.namespace)
+		if query.Job != "" {
+			q = q.Filter("job =", query.Job)
+		}
+		if query.Status != "" {
+			q = q.Filter("status =", query.Status)
+		}
+		if query.CrawlState != "" {
+			q = q.Filter("crawl_state =", query.CrawlState)
+		}
+		return q
+	}
+
+	var builds []*ale.BuildSummary
+	if after != nil {
+		// The builds started at the same time as the last one of the previous page
+		q := filtered().
+			Filter("start_time =", after.StartTime).
+			Filter("build_id "+past, after.BuildID).
+			Order(direction + "build_id").
+			Limit(limit)
+		if _, err := db.Client.GetAll(ctx, q, &builds); err != nil {
+			return nil, err
+		}
+		if len(builds) >= limit {
+			return builds, nil
+		}
+	}
+	q := filtered()
+	if query.From > 0 {
+		q = q.Filter("start_time >=", query.From)
+	}
+	if query.To > 0 {
+		q = q.Filter("start_time <=", query.To)
+	}
+	if after != nil {
+		q = q.Filter("start_time "+past, after.StartTime)
+	}
+	q = q.Order(direction + "start_time").Order(direction + "build_id").Limit(limit - len(builds))
+	var rest []*ale.BuildSummary
+	if _, err := db.Client.GetAll(ctx, q, &rest); err != nil {
+		return nil, err
+	}
+	return append(builds, rest...), nil
+}
+
+// Backfill adds the summaries listing the builds to those stored before
+// summaries existed, so that they can be listed, pruned and exported, and
+// records the crawl state on the summaries written before they held it. It
+// returns how many summaries were added or completed.
+func (db *Datastore) Backfill(ctx context.Context) (int, error) {
+	keys := func(q *datastore.Query) ([]*datastore.Key, error) {
+		ctx, cancel := db.timeouts.ReadContext(ctx)
+		defer cancel()
+		return db.Client.GetAll(ctx, q.Namespace(db.namespace).KeysOnly(), nil)
+	}
+	builds, err := keys(datastore.NewQuery("JenkinsBuild"))
+	if err != nil {
+		return 0, err
+	}
+	summaries, err := keys(datastore.NewQuery("JenkinsBuildSummary"))
+	if err != nil {
+		return 0, err
+	}
+	// Only the summaries holding the property are part of its index
+	stated, err := keys(datastore.NewQuery("JenkinsBuildSummary").Filter("crawl_state >=", ""))
+	if err != nil {
+		return 0, err
+	}
+	summarized := make(map[string]bool, len(summaries))
+	for _, key := range summaries {
+		summarized[key.Name] = true
+	}
+	added := 0
+	for _, key := range builds {
+		if summarized[key.Name] {
+			continue
+		}
+		data, err := db.Get(ctx, key.Name)
+		if err != nil {
+			logrus.WithError(err).WithField("build_id", key.Name).Warn("unable to read build to summarize")
+			continue
+		}
+		if err := db.putSummary(ctx, data, key.Name); err != nil {
+			return added, err
+		}
+		added++
+		if added%datastoreBatchSize == 0 {
+			logrus.WithField("count", added).Info("backfilling build summaries")
+		}
+	}
+	hasState := make(map[string]bool, len(stated))
+	for _, key := range stated {
+		hasState[key.Name] = true
+	}
+	for _, key := range summaries {
+		if hasState[key.Name] {
+			continue
+		}
+		state := ""
+		crawl, err := db.GetCrawl(ctx, key.Name)
+		if err == nil {
+			state = crawl.State
+		} else if err != ErrNotFound {
+			return added, err
+		}
+		if err := db.putSummaryCrawlState(ctx, key.Name, state); err != nil {
+			return added, err
+		}
+		added++
+		if added%datastoreBatchSize == 0 {
+			logrus.WithField("count", added).Info("backfilling build summaries")
+		}
+	}
+	return added, nil
+}
+
+const (
+	// datastoreBatchSize is the most entities Datastore accepts in one batch operation
+	datastoreBatchSize = 500
+	// datastoreChunkSize keeps each part of a payload well within the 1 MiB entity limit
+	datastoreChunkSize = 1000 * 1000
+	// datastoreReadAttempts bounds how often a build replaced while being read is read again
+	datastoreReadAttempts = 3
+)
+
+// RemoveBuilds deletes the builds, their chunks, summaries and crawls in batches.
+// Datastore doesn't tell whether the entities existed, so every build is counted.
+func (db *Datastore) RemoveBuilds(ctx context.Context, buildIDs []string) (int, error) {
+	ctx, cancel := db.timeouts.WriteContext(ctx)
+	defer cancel()
+	var keys []*datastore.Key
+	for _, buildID := range buildIDs {
+		chunks, err := db.chunkKeys(ctx, buildID)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, chunks...)
+		keys = append(keys,
+			db.makeKey(buildID),
+			db.makeKindKey("JenkinsBuildSummary", buildID),
+			db.makeKindKey("JenkinsCrawl", buildID))
+	}
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		// Deleting missing entities isn't an error in Datastore
+		if err := db.Client.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	return len(buildIDs), nil
 }
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
 
 	"cloud.google.com/go/datastore"
@@ -24,13 +25,13 @@ var (
 )
 
 func Test_CreateDatastore(t *testing.T) {
-	database, err := NewDatastore(ctx, cfg, &mock.Datastore{})
+	database, err := NewDatastore(cfg, &mock.Datastore{})
 	assert.NotNil(t, database)
 	assert.Nil(t, err)
 }
 
 func Test_makeKey(t *testing.T) {
-	database, _ := NewDatastore(ctx, cfg, &mock.Datastore{})
+	database, _ := NewDatastore(cfg, &mock.Datastore{})
 	key := database.(*Datastore).makeKey("foobar")
 
 	assert.Equal(t, "JenkinsBuild", key.Kind)
@@ -44,7 +45,7 @@ func Test_Put(t *testing.T) {
 	database := &Datastore{
 		Client: m,
 	}
-	database.Put(&ale.JenkinsData{}, "foobar")
+	database.Put(ctx, &ale.JenkinsData{}, "foobar")
 	assert.True(t, m.PutFnInvoked)
 }
 
@@ -53,9 +54,9 @@ func Test_Get(t *testing.T) {
 	database := &Datastore{
 		Client: m,
 	}
-	database.Put(&ale.JenkinsData{}, "foobar")
+	database.Put(ctx, &ale.JenkinsData{}, "foobar")
 
-	j, _ := database.Get("foobar")
+	j, _ := database.Get(ctx, "foobar")
 	assert.True(t, m.GetFnInvoked)
 	assert.NotNil(t, j)
 }
@@ -70,9 +71,9 @@ func Test_GetWithError(t *testing.T) {
 		Client: m,
 	}
 
-	database.Put(&ale.JenkinsData{}, "foobar")
+	database.Put(ctx, &ale.JenkinsData{}, "foobar")
 
-	_, err := database.Get("foobar")
+	_, err := database.Get(ctx, "foobar")
 	assert.True(t, m.GetFnInvoked)
 	assert.NotNil(t, err)
 }
@@ -82,13 +83,13 @@ func Test_Has(t *testing.T) {
 	database := &Datastore{
 		Client: m,
 	}
-	b, _ := database.Has("foobar")
+	b, _ := database.Has(ctx, "foobar")
 	assert.True(t, m.CountFnInvoked)
 	assert.False(t, b)
 
-	database.Put(&ale.JenkinsData{}, "foobar")
+	database.Put(ctx, &ale.JenkinsData{}, "foobar")
 
-	b, _ = database.Has("foobar")
+	b, _ = database.Has(ctx, "foobar")
 	assert.True(t, m.CountFnInvoked)
 	assert.True(t, b)
 }
@@ -102,7 +103,324 @@ func Test_HasNotButNoError(t *testing.T) {
 	database := &Datastore{
 		Client: m,
 	}
-	b, _ := database.Has("foobar")
+	b, _ := database.Has(ctx, "foobar")
 	assert.True(t, m.CountFnInvoked)
 	assert.False(t, b)
 }
+
+func Test_PutGetCrawl(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	_, err := database.GetCrawl(ctx, "foobar")
+	assert.Equal(t, ErrNotFound, err)
+
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "foobar", State: ale.CrawlQueued})
+	crawl, err := database.GetCrawl(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Equal(t, ale.CrawlQueued, crawl.State)
+}
+
+func Test_PendingCrawls(t *testing.T) {
+	m := &mock.Datastore{
+		GetAllFn: func(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+			crawls := dst.(*[]*ale.Crawl)
+			*crawls = append(*crawls, &ale.Crawl{BuildID: "foobar"})
+			return nil, nil
+		},
+	}
+	database := &Datastore{
+		Client: m,
+	}
+	pending, err := database.PendingCrawls(ctx)
+	assert.Nil(t, err)
+	assert.True(t, m.GetAllFnInvoked)
+	// once for queued and once for crawling
+	assert.Len(t, pending, 2)
+}
+
+func Test_PutCrawlRecordsStateOnSummary(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	summary := func() *ale.BuildSummary {
+		var summary ale.BuildSummary
+		assert.Nil(t, m.Get(ctx, database.makeKindKey("JenkinsBuildSummary", "foobar"), &summary))
+		return &summary
+	}
+	// The crawl is recorded before the build is stored
+	assert.Nil(t, database.PutCrawl(ctx, &ale.Crawl{BuildID: "foobar", State: ale.CrawlRunning}))
+	assert.Nil(t, database.Put(ctx, &ale.JenkinsData{Status: "BUILDING"}, "foobar"))
+	assert.Equal(t, ale.CrawlRunning, summary().CrawlState)
+
+	assert.Nil(t, database.PutCrawl(ctx, &ale.Crawl{BuildID: "foobar", State: ale.CrawlFinished}))
+	assert.Equal(t, ale.CrawlFinished, summary().CrawlState)
+	assert.Equal(t, "BUILDING", summary().Status)
+}
+
+func Test_ListReadsCrawlStateFromSummaries(t *testing.T) {
+	m := &mock.Datastore{
+		GetAllFn: func(_ context.Context, _ *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+			if builds, ok := dst.(*[]*ale.BuildSummary); ok {
+				*builds = []*ale.BuildSummary{
+					{BuildID: "newer", StartTime: 200, CrawlState: ale.CrawlRunning},
+					{BuildID: "older", StartTime: 100, CrawlState: ale.CrawlRunning},
+				}
+			}
+			return nil, nil
+		},
+	}
+	database := &Datastore{
+		Client: m,
+	}
+
+	list, err := database.List(ctx, &ale.BuildQuery{CrawlState: ale.CrawlRunning, Limit: 1})
+	assert.Nil(t, err)
+	assert.True(t, m.GetAllFnInvoked)
+	// The state is filtered by the query, without reading the crawls
+	assert.False(t, m.GetFnInvoked)
+	assert.Len(t, list.Builds, 1)
+	assert.Equal(t, "newer", list.Builds[0].BuildID)
+	assert.Equal(t, ale.CrawlRunning, list.Builds[0].CrawlState)
+	assert.NotEmpty(t, list.NextCursor)
+}
+
+func Test_ListContinuesFromCursor(t *testing.T) {
+	// The first query holds the builds started at the same time as the
+	// cursor, the second those started earlier
+	pages := [][]*ale.BuildSummary{
+		{{BuildID: "a", StartTime: 200}},
+		{{BuildID: "c", StartTime: 100, Status: "FAILED"}, {BuildID: "d", StartTime: 50}},
+	}
+	calls := 0
+	m := &mock.Datastore{
+		GetAllFn: func(_ context.Context, _ *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+			builds := dst.(*[]*ale.BuildSummary)
+			*builds = append(*builds, pages[calls]...)
+			calls++
+			return nil, nil
+		},
+	}
+	database := &Datastore{
+		Client: m,
+	}
+	cursor := EncodeCursor(&ale.BuildSummary{BuildID: "b", StartTime: 200})
+
+	list, err := database.List(ctx, &ale.BuildQuery{Cursor: cursor, Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, list.Builds, 2)
+	assert.Equal(t, "a", list.Builds[0].BuildID)
+	assert.Equal(t, "c", list.Builds[1].BuildID)
+	assert.Equal(t, EncodeCursor(list.Builds[1]), list.NextCursor)
+
+	_, err = database.List(ctx, &ale.BuildQuery{Cursor: "not a cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func Test_Backfill(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	// As stored before summaries were introduced
+	m.Put(ctx, database.makeKey("legacy"), &ale.DatastoreEntity{
+		Key:   "legacy",
+		Value: ale.JenkinsData{Job: "team/app", Status: "FAILED", StartTime: 100},
+	})
+	keys := [][]*datastore.Key{
+		{database.makeKey("legacy"), database.makeKey("summarized")},
+		{database.makeKindKey("JenkinsBuildSummary", "summarized")},
+		{database.makeKindKey("JenkinsBuildSummary", "summarized")},
+	}
+	calls := 0
+	var summary *ale.BuildSummary
+	m.GetAllFn = func(_ context.Context, _ *datastore.Query, _ interface{}) ([]*datastore.Key, error) {
+		calls++
+		return keys[calls-1], nil
+	}
+	m.PutFn = func(_ context.Context, key *datastore.Key, data interface{}) (*datastore.Key, error) {
+		assert.Equal(t, "JenkinsBuildSummary", key.Kind)
+		summary = data.(*ale.BuildSummary)
+		return key, nil
+	}
+
+	added, err := database.Backfill(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, &ale.BuildSummary{BuildID: "legacy", Job: "team/app", Status: "FAILED", StartTime: 100}, summary)
+}
+
+func Test_BackfillRecordsCrawlState(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	// As stored before summaries held the crawl state
+	m.Put(ctx, database.makeKindKey("JenkinsBuildSummary", "foobar"), &ale.BuildSummary{BuildID: "foobar", Status: "SUCCESS"})
+	m.Put(ctx, database.makeKindKey("JenkinsCrawl", "foobar"), &ale.Crawl{BuildID: "foobar", State: ale.CrawlFinished})
+	keys := [][]*datastore.Key{
+		{database.makeKey("foobar")},
+		{database.makeKindKey("JenkinsBuildSummary", "foobar")},
+		{},
+	}
+	calls := 0
+	m.GetAllFn = func(_ context.Context, _ *datastore.Query, _ interface{}) ([]*datastore.Key, error) {
+		calls++
+		return keys[calls-1], nil
+	}
+
+	added, err := database.Backfill(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	var summary ale.BuildSummary
+	assert.Nil(t, m.Get(ctx, database.makeKindKey("JenkinsBuildSummary", "foobar"), &summary))
+	assert.Equal(t, &ale.BuildSummary{BuildID: "foobar", Status: "SUCCESS", CrawlState: ale.CrawlFinished}, &summary)
+}
+
+func Test_RemoveBuilds(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	database.Put(ctx, &ale.JenkinsData{}, "foobar")
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "foobar", State: ale.CrawlFinished})
+
+	removed, err := database.RemoveBuilds(ctx, []string{"foobar"})
+	assert.Nil(t, err)
+	assert.True(t, m.DeleteMultiFnInvoked)
+	assert.Equal(t, 1, removed)
+	_, err = database.GetCrawl(ctx, "foobar")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func Test_PutGetCompressed(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client:      m,
+		compression: CompressionZstd,
+	}
+	data := &ale.JenkinsData{BuildID: "foobar", Status: "SUCCESS"}
+	assert.Nil(t, database.Put(ctx, data, "foobar"))
+
+	j, err := database.Get(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Equal(t, data, j)
+}
+
+func Test_PutGetChunked(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client:      m,
+		compression: CompressionNone,
+	}
+	stage := &ale.JenkinsStage{Name: "Build"}
+	for i := 0; i < 30000; i++ {
+		stage.Logs = append(stage.Logs, &ale.Log{Line: fmt.Sprintf("line %d of a build too large for a single entity", i)})
+	}
+	data := &ale.JenkinsData{BuildID: "foobar", Stages: []*ale.JenkinsStage{stage}}
+	assert.Nil(t, database.Put(ctx, data, "foobar"))
+
+	var entity ale.DatastoreEntity
+	m.Get(ctx, database.makeKey("foobar"), &entity)
+	assert.True(t, entity.Chunks > 1)
+	assert.Len(t, entity.Data, datastoreChunkSize)
+
+	j, err := database.Get(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Len(t, j.Stages[0].Logs, 30000)
+	assert.Equal(t, data, j)
+}
+
+func largeBuild(lines int) *ale.JenkinsData {
+	stage := &ale.JenkinsStage{Name: "Build"}
+	for i := 0; i < lines; i++ {
+		stage.Logs = append(stage.Logs, &ale.Log{Line: fmt.Sprintf("line %d of a build too large for a single entity", i)})
+	}
+	return &ale.JenkinsData{BuildID: "foobar", Stages: []*ale.JenkinsStage{stage}}
+}
+
+func Test_PutRemovesStaleChunks(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client:      m,
+		compression: CompressionNone,
+	}
+	assert.Nil(t, database.Put(ctx, largeBuild(30000), "foobar"))
+	var previous ale.DatastoreEntity
+	m.Get(ctx, database.makeKey("foobar"), &previous)
+	assert.NotZero(t, previous.Generation)
+
+	var staleKeys []*datastore.Key
+	for n := 1; n < previous.Chunks; n++ {
+		staleKeys = append(staleKeys, database.makeChunkKey("foobar", previous.Generation, n))
+	}
+	// Left over by a version of the build written before generations
+	staleKeys = append(staleKeys, database.makeChunkKey("foobar", 0, 1))
+	m.GetAllFn = func(_ context.Context, _ *datastore.Query, _ interface{}) ([]*datastore.Key, error) {
+		return staleKeys, nil
+	}
+	var deleted []*datastore.Key
+	m.DeleteMultiFn = func(_ context.Context, keys []*datastore.Key) error {
+		deleted = keys
+		return nil
+	}
+
+	data := &ale.JenkinsData{BuildID: "foobar", Status: "SUCCESS"}
+	assert.Nil(t, database.Put(ctx, data, "foobar"))
+	assert.Equal(t, staleKeys, deleted)
+	j, err := database.Get(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Equal(t, data, j)
+}
+
+func Test_GetRereadsReplacedBuild(t *testing.T) {
+	store := &mock.Datastore{}
+	database := &Datastore{
+		Client:      store,
+		compression: CompressionNone,
+	}
+	assert.Nil(t, database.Put(ctx, largeBuild(30000), "foobar"))
+	var stale ale.DatastoreEntity
+	store.Get(ctx, database.makeKey("foobar"), &stale)
+	data := largeBuild(40000)
+	assert.Nil(t, database.Put(ctx, data, "foobar"))
+	store.DeleteMulti(ctx, []*datastore.Key{database.makeChunkKey("foobar", stale.Generation, 1)})
+
+	// The first read sees the build as it was before being replaced
+	reads := 0
+	database.Client = &mock.Datastore{
+		GetFn: func(ctx context.Context, key *datastore.Key, dst interface{}) error {
+			if entity, ok := dst.(*ale.DatastoreEntity); ok {
+				reads++
+				if reads == 1 {
+					*entity = stale
+					return nil
+				}
+			}
+			return store.Get(ctx, key, dst)
+		},
+	}
+	j, err := database.Get(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, data, j)
+}
+
+func Test_GetUncompressed(t *testing.T) {
+	m := &mock.Datastore{}
+	database := &Datastore{
+		Client: m,
+	}
+	// As stored before compression was introduced
+	m.Put(ctx, database.makeKey("foobar"), &ale.DatastoreEntity{
+		Key:   "foobar",
+		Value: ale.JenkinsData{BuildID: "foobar", Status: "FAILURE"},
+	})
+
+	j, err := database.Get(ctx, "foobar")
+	assert.Nil(t, err)
+	assert.Equal(t, "FAILURE", j.Status)
+}
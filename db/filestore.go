@@ -1,24 +1,35 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/alde/ale"
 	"github.com/sirupsen/logrus"
 )
 
 // Filestore is a hacky filesystem "database". To be removed.
+// The filesystem can't be interrupted, so contexts are only checked between files.
 type Filestore struct {
-	folder string
+	folder      string
+	compression string
 }
 
-// NewFilestore creates a new Datastore database object
-func NewFilestore(folder string) (Database, error) {
+// NewFilestore creates a new Filestore database object, writing the builds
+// compressed with the given algorithm
+func NewFilestore(folder string, compression string) (Database, error) {
+	if err := ValidateCompression(compression); err != nil {
+		return nil, err
+	}
 	return &Filestore{
-		folder: folder,
+		folder:      folder,
+		compression: compression,
 	}, nil
 }
 
@@ -27,10 +38,13 @@ func (db *Filestore) makeFileName(buildID string) string {
 }
 
 // Put writes a file to the filesystem
-func (db *Filestore) Put(data *ale.JenkinsData, buildID string) error {
+func (db *Filestore) Put(ctx context.Context, data *ale.JenkinsData, buildID string) error {
 	file := db.makeFileName(buildID)
-	b, _ := json.MarshalIndent(data, "", "\t")
-	err := ioutil.WriteFile(file, b, 0644)
+	b, err := EncodeBuild(data, db.compression)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, b, 0644)
 	if err != nil {
 		logrus.WithError(err).Error("error writing file")
 		return err
@@ -40,9 +54,9 @@ func (db *Filestore) Put(data *ale.JenkinsData, buildID string) error {
 }
 
 // Has checks for the existance of the file
-func (db *Filestore) Has(buildID string) (bool, error) {
+func (db *Filestore) Has(ctx context.Context, buildID string) (bool, error) {
 	file := db.makeFileName(buildID)
-	_, err := os.Open(file)
+	_, err := os.Stat(file)
 	if err != nil {
 		return false, err
 	}
@@ -51,22 +65,176 @@ func (db *Filestore) Has(buildID string) (bool, error) {
 }
 
 // Get reads a file from the filesystem
-func (db *Filestore) Get(buildID string) (*ale.JenkinsData, error) {
+func (db *Filestore) Get(ctx context.Context, buildID string) (*ale.JenkinsData, error) {
 	file := db.makeFileName(buildID)
 	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	var resp ale.JenkinsData
-	err = json.Unmarshal(b, &resp)
-	if err != nil {
-		return nil, err
-	}
-	return &resp, nil
+	return DecodeBuild(b)
 }
 
 // Remove is used to delete a file from the filesystem
-func (db *Filestore) Remove(buildID string) error {
+func (db *Filestore) Remove(ctx context.Context, buildID string) error {
 	file := db.makeFileName(buildID)
 	return os.Remove(file)
 }
+
+func (db *Filestore) makeCrawlFileName(buildID string) string {
+	return fmt.Sprintf("%s/crawl_%s.json", db.folder, buildID)
+}
+
+// PutCrawl writes the crawl record to the filesystem
+func (db *Filestore) PutCrawl(ctx context.Context, crawl *ale.Crawl) error {
+	file := db.makeCrawlFileName(crawl.BuildID)
+	b, _ := json.MarshalIndent(crawl, "", "\t")
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// GetCrawl reads the crawl record from the filesystem
+func (db *Filestore) GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error) {
+	b, err := ioutil.ReadFile(db.makeCrawlFileName(buildID))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var crawl ale.Crawl
+	if err := json.Unmarshal(b, &crawl); err != nil {
+		return nil, err
+	}
+	return &crawl, nil
+}
+
+// PendingCrawls reads every crawl record which has not yet finished
+func (db *Filestore) PendingCrawls(ctx context.Context) ([]*ale.Crawl, error) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/crawl_*.json", db.folder))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*ale.Crawl
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var crawl ale.Crawl
+		if err := json.Unmarshal(b, &crawl); err != nil {
+			logrus.WithError(err).WithField("file", file).Warn("skipping unreadable crawl record")
+			continue
+		}
+		if crawl.State == ale.CrawlQueued || crawl.State == ale.CrawlRunning {
+			pending = append(pending, &crawl)
+		}
+	}
+	return pending, nil
+}
+
+// buildIDs lists the IDs of every build written to the filesystem
+func (db *Filestore) buildIDs() ([]string, error) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/out_*.json", db.folder))
+	if err != nil {
+		return nil, err
+	}
+	buildIDs := make([]string, 0, len(files))
+	for _, file := range files {
+		buildIDs = append(buildIDs, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "out_"), ".json"))
+	}
+	return buildIDs, nil
+}
+
+// List reads every build from the filesystem, and pages through those matching
+// the query. Going through all the builds is better done with Walk.
+func (db *Filestore) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	var builds []*ale.BuildSummary
+	err := db.Walk(ctx, "", func(build *ale.BuildSummary) error {
+		builds = append(builds, build)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Paginate(builds, query)
+}
+
+// Walk reads the builds from the filesystem one at a time, in the order of
+// their IDs, skipping those which can't be read
+func (db *Filestore) Walk(ctx context.Context, after string, fn func(*ale.BuildSummary) error) error {
+	buildIDs, err := db.buildIDs()
+	if err != nil {
+		return err
+	}
+	sort.Strings(buildIDs)
+	for _, buildID := range buildIDs {
+		if buildID <= after {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := db.Get(ctx, buildID)
+		if err != nil {
+			logrus.WithError(err).WithField("build_id", buildID).Warn("skipping unreadable build")
+			continue
+		}
+		build := Summarize(data, buildID)
+		if crawl, err := db.GetCrawl(ctx, buildID); err == nil {
+			build.CrawlState = crawl.State
+		}
+		if err := fn(build); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search scans the logs of every build on the filesystem
+func (db *Filestore) Search(ctx context.Context, query *ale.SearchQuery) (*ale.SearchResult, error) {
+	buildIDs, err := db.buildIDs()
+	if err != nil {
+		return nil, err
+	}
+	terms := SearchTerms(query.Query)
+	hits := []*ale.SearchHit{}
+	for _, buildID := range buildIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := db.Get(ctx, buildID)
+		if err != nil {
+			logrus.WithError(err).WithField("build_id", buildID).Warn("skipping unreadable build")
+			continue
+		}
+		if query.Job != "" && data.Job != query.Job {
+			continue
+		}
+		if hit := SearchBuild(data, buildID, terms); hit != nil {
+			hits = append(hits, hit)
+		}
+	}
+	return &ale.SearchResult{Query: query.Query, Builds: SortHits(hits, query)}, nil
+}
+
+// RemoveBuilds deletes the files of the builds and of their crawls
+func (db *Filestore) RemoveBuilds(ctx context.Context, buildIDs []string) (int, error) {
+	removed := 0
+	for _, buildID := range buildIDs {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		err := os.Remove(db.makeFileName(buildID))
+		if err == nil {
+			removed++
+		} else if !os.IsNotExist(err) {
+			return removed, err
+		}
+		if err := os.Remove(db.makeCrawlFileName(buildID)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
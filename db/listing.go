@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alde/ale"
+)
+
+// ErrInvalidCursor is returned when a listing is requested with a malformed cursor
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Walker is implemented by the backends which go through all of their builds
+// more cheaply in one pass than by paging with List, such as the Filestore
+// which has to read every build to list a single page
+type Walker interface {
+	// Walk calls fn with the summary of every build whose ID sorts after the
+	// given one, in the order of their IDs, and stops at the first error
+	Walk(ctx context.Context, after string, fn func(*ale.BuildSummary) error) error
+}
+
+// Cursor points at the last build of a page, the next page starts right after it
+type Cursor struct {
+	StartTime int
+	BuildID   string
+}
+
+// EncodeCursor makes an opaque cursor pointing at the given build
+func EncodeCursor(build *ale.BuildSummary) string {
+	raw := fmt.Sprintf("%d:%s", build.StartTime, build.BuildID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor reads a cursor made by EncodeCursor. An empty cursor yields nil.
+func DecodeCursor(cursor string) (*Cursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	startTime, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{StartTime: startTime, BuildID: parts[1]}, nil
+}
+
+// Summarize strips the stages from a build
+func Summarize(data *ale.JenkinsData, buildID string) *ale.BuildSummary {
+	return &ale.BuildSummary{
+		BuildID:   buildID,
+		ID:        data.ID,
+		Name:      data.Name,
+		Job:       data.Job,
+		Status:    data.Status,
+		StartTime: data.StartTime,
+		EndTime:   data.EndTime,
+		Duration:  data.Duration,
+	}
+}
+
+// Matches reports whether the build passes the filters of the query
+func Matches(build *ale.BuildSummary, query *ale.BuildQuery) bool {
+	if query.Job != "" && build.Job != query.Job {
+		return false
+	}
+	if query.Status != "" && build.Status != query.Status {
+		return false
+	}
+	if query.CrawlState != "" && build.CrawlState != query.CrawlState {
+		return false
+	}
+	if query.From > 0 && build.StartTime < query.From {
+		return false
+	}
+	if query.To > 0 && build.StartTime > query.To {
+		return false
+	}
+	return true
+}
+
+// Paginate filters, sorts and pages build summaries in memory, for the
+// backends which can't do it as part of their query
+func Paginate(builds []*ale.BuildSummary, query *ale.BuildQuery) (*ale.BuildList, error) {
+	cursor, err := DecodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	before := func(a, b *ale.BuildSummary) bool {
+		if a.StartTime != b.StartTime {
+			return (a.StartTime < b.StartTime) == query.Ascending
+		}
+		if a.BuildID == b.BuildID {
+			return false
+		}
+		return (a.BuildID < b.BuildID) == query.Ascending
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return before(builds[i], builds[j])
+	})
+
+	list := &ale.BuildList{Builds: []*ale.BuildSummary{}}
+	var last *ale.BuildSummary
+	if cursor != nil {
+		last = &ale.BuildSummary{StartTime: cursor.StartTime, BuildID: cursor.BuildID}
+	}
+	for _, build := range builds {
+		if last != nil && !before(last, build) {
+			continue
+		}
+		if !Matches(build, query) {
+			continue
+		}
+		if query.Limit > 0 && len(list.Builds) == query.Limit {
+			list.NextCursor = EncodeCursor(list.Builds[len(list.Builds)-1])
+			break
+		}
+		list.Builds = append(list.Builds, build)
+	}
+	return list, nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+)
+
+func listingFixture() []*ale.BuildSummary {
+	return []*ale.BuildSummary{
+		{BuildID: "a", Job: "team/app", Status: "SUCCESS", StartTime: 100},
+		{BuildID: "b", Job: "team/app", Status: "FAILED", StartTime: 300},
+		{BuildID: "c", Job: "other", Status: "SUCCESS", StartTime: 200},
+		{BuildID: "d", Job: "team/app", Status: "SUCCESS", StartTime: 300},
+	}
+}
+
+func buildIDs(list *ale.BuildList) []string {
+	var ids []string
+	for _, build := range list.Builds {
+		ids = append(ids, build.BuildID)
+	}
+	return ids
+}
+
+func Test_PaginateNewestFirst(t *testing.T) {
+	list, err := Paginate(listingFixture(), &ale.BuildQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d", "b", "c", "a"}, buildIDs(list))
+	assert.Empty(t, list.NextCursor)
+}
+
+func Test_PaginateFollowsCursor(t *testing.T) {
+	query := &ale.BuildQuery{Limit: 3, Ascending: true}
+	list, err := Paginate(listingFixture(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "c", "b"}, buildIDs(list))
+	assert.NotEmpty(t, list.NextCursor)
+
+	query.Cursor = list.NextCursor
+	list, err = Paginate(listingFixture(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d"}, buildIDs(list))
+	assert.Empty(t, list.NextCursor)
+}
+
+func Test_PaginateFollowsCursorNewestFirst(t *testing.T) {
+	query := &ale.BuildQuery{Limit: 2}
+	list, err := Paginate(listingFixture(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d", "b"}, buildIDs(list))
+
+	query.Cursor = list.NextCursor
+	list, err = Paginate(listingFixture(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "a"}, buildIDs(list))
+	assert.Empty(t, list.NextCursor)
+}
+
+func Test_PaginateFilters(t *testing.T) {
+	list, _ := Paginate(listingFixture(), &ale.BuildQuery{Job: "team/app", Status: "SUCCESS"})
+	assert.Equal(t, []string{"d", "a"}, buildIDs(list))
+
+	list, _ = Paginate(listingFixture(), &ale.BuildQuery{From: 150, To: 250})
+	assert.Equal(t, []string{"c"}, buildIDs(list))
+}
+
+func Test_PaginateInvalidCursor(t *testing.T) {
+	_, err := Paginate(listingFixture(), &ale.BuildQuery{Cursor: "%%%"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func Test_FilestoreWalk(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "filestore")
+	defer os.RemoveAll(folder)
+	database, _ := NewFilestore(folder, CompressionNone)
+	for _, buildID := range []string{"b", "a-1", "a", "c"} {
+		database.Put(ctx, &ale.JenkinsData{Job: "app", StartTime: 100}, buildID)
+	}
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "b", State: ale.CrawlRunning})
+
+	var walked []string
+	err := database.(Walker).Walk(ctx, "a-1", func(build *ale.BuildSummary) error {
+		walked = append(walked, build.BuildID)
+		if build.BuildID == "b" {
+			assert.Equal(t, ale.CrawlRunning, build.CrawlState)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "c"}, walked)
+}
@@ -0,0 +1,110 @@
+package postgres
+
+import (
+	"context"
+	gosql "database/sql"
+	"embed"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db/sqlstore"
+)
+
+// The schema is described by the numbered files in migrations/, named
+// NNNN_description.up.sql and NNNN_description.down.sql. Never change a
+// migration which has been released, add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// dataMigrations are the steps which move data in ways SQL alone can't
+var dataMigrations = []*sqlstore.Migration{
+	{Version: 3, Description: "move_jsonb_logs", Up: migrateJSONLogs, Down: restoreJSONLogs},
+}
+
+// NewMigrator prepares the migrations of the database, without applying any
+func NewMigrator(db *gosql.DB) (*sqlstore.Migrator, error) {
+	migrations, err := sqlstore.LoadMigrations(migrationFiles, "migrations", dataMigrations...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.NewMigrator(db, dialect{}, migrations)
+}
+
+// migrateJSONLogs copies every build stored as a single jsonb blob into the
+// normalized tables, and drops the old table once they are all moved
+func migrateJSONLogs(tx *gosql.Tx) error {
+	buildIDs, err := listBuildIDs(tx, "SELECT build_id FROM ale_jenkins_logs")
+	if err != nil {
+		return err
+	}
+	for _, buildID := range buildIDs {
+		var raw []byte
+		if err := tx.QueryRow("SELECT log FROM ale_jenkins_logs WHERE build_id = $1", buildID).Scan(&raw); err != nil {
+			return err
+		}
+		var data ale.JenkinsData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return err
+		}
+		if err := sqlstore.PutBuild(context.Background(), tx, &data, buildID); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("count", len(buildIDs)).Info("moved jsonb logs into the normalized tables")
+	_, err = tx.Exec("DROP TABLE ale_jenkins_logs")
+	return err
+}
+
+// restoreJSONLogs moves the builds back into a single jsonb blob each
+func restoreJSONLogs(tx *gosql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE ale_jenkins_logs ( \n" +
+		" build_id VARCHAR(128) NOT NULL, \n" +
+		" log jsonb NOT NULL, \n" +
+		" PRIMARY KEY (build_id) \n" +
+		")")
+	if err != nil {
+		return err
+	}
+	buildIDs, err := listBuildIDs(tx, "SELECT build_id FROM ale_builds")
+	if err != nil {
+		return err
+	}
+	for _, buildID := range buildIDs {
+		data, err := sqlstore.GetBuild(context.Background(), tx, buildID)
+		if err != nil {
+			return err
+		}
+		j, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO ale_jenkins_logs(build_id, log) VALUES ($1, $2::jsonb)", buildID, string(j)); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("count", len(buildIDs)).Info("moved logs back into jsonb")
+	_, err = tx.Exec("DELETE FROM ale_builds")
+	return err
+}
+
+// listBuildIDs reads every ID up front, as the driver can't run statements
+// while reading rows within a transaction
+func listBuildIDs(tx *gosql.Tx, query string) ([]string, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buildIDs []string
+	for rows.Next() {
+		var buildID string
+		if err := rows.Scan(&buildID); err != nil {
+			return nil, err
+		}
+		buildIDs = append(buildIDs, buildID)
+	}
+	return buildIDs, rows.Err()
+}
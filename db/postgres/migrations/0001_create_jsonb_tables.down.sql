@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ale_crawls;
+DROP TABLE IF EXISTS ale_jenkins_logs;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS ale_jenkins_logs (
+    build_id VARCHAR(128) NOT NULL,
+    log jsonb NOT NULL,
+    PRIMARY KEY (build_id)
+);
+
+CREATE TABLE IF NOT EXISTS ale_crawls (
+    build_id VARCHAR(128) NOT NULL,
+    build_url TEXT NOT NULL,
+    state VARCHAR(32) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created TIMESTAMPTZ NOT NULL,
+    last_poll TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    jenkins_status VARCHAR(32) NOT NULL DEFAULT '',
+    PRIMARY KEY (build_id)
+);
@@ -0,0 +1,48 @@
+CREATE TABLE ale_builds (
+    build_id VARCHAR(128) NOT NULL,
+    id VARCHAR(128) NOT NULL DEFAULT '',
+    name TEXT NOT NULL DEFAULT '',
+    job TEXT NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL DEFAULT '',
+    start_time BIGINT NOT NULL DEFAULT 0,
+    end_time BIGINT NOT NULL DEFAULT 0,
+    duration BIGINT NOT NULL DEFAULT 0,
+    queue_duration BIGINT NOT NULL DEFAULT 0,
+    pause_duration BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (build_id)
+);
+
+CREATE INDEX ale_builds_job ON ale_builds (job, start_time);
+CREATE INDEX ale_builds_start_time ON ale_builds (start_time, build_id);
+
+CREATE TABLE ale_stages (
+    build_id VARCHAR(128) NOT NULL REFERENCES ale_builds ON DELETE CASCADE,
+    stage_key VARCHAR(128) NOT NULL,
+    parent_key VARCHAR(128) NOT NULL DEFAULT '',
+    position INTEGER NOT NULL,
+    id VARCHAR(128) NOT NULL DEFAULT '',
+    name TEXT NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL DEFAULT '',
+    branch TEXT NOT NULL DEFAULT '',
+    start_time BIGINT NOT NULL DEFAULT 0,
+    duration BIGINT NOT NULL DEFAULT 0,
+    task TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    log_length INTEGER NOT NULL DEFAULT 0,
+    log_offset INTEGER NOT NULL DEFAULT 0,
+    log_tail TEXT NOT NULL DEFAULT '',
+    line_count INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (build_id, stage_key)
+);
+
+CREATE TABLE ale_log_lines (
+    build_id VARCHAR(128) NOT NULL,
+    stage_key VARCHAR(128) NOT NULL,
+    line_no INTEGER NOT NULL,
+    timestamp VARCHAR(64) NOT NULL DEFAULT '',
+    line TEXT NOT NULL,
+    PRIMARY KEY (build_id, stage_key, line_no),
+    FOREIGN KEY (build_id, stage_key) REFERENCES ale_stages ON DELETE CASCADE
+);
+
+CREATE INDEX ale_log_lines_search ON ale_log_lines USING GIN (to_tsvector('simple', line));
@@ -0,0 +1,5 @@
+ALTER TABLE ale_crawls
+    DROP COLUMN deliveries,
+    DROP COLUMN location,
+    DROP COLUMN callback_secret,
+    DROP COLUMN callback_url;
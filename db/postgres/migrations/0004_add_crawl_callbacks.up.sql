@@ -0,0 +1,5 @@
+ALTER TABLE ale_crawls
+    ADD COLUMN callback_url TEXT NOT NULL DEFAULT '',
+    ADD COLUMN callback_secret TEXT NOT NULL DEFAULT '',
+    ADD COLUMN location TEXT NOT NULL DEFAULT '',
+    ADD COLUMN deliveries JSONB;
@@ -0,0 +1,2 @@
+DROP INDEX ale_log_lines_trigrams;
+CREATE INDEX ale_log_lines_search ON ale_log_lines USING GIN (to_tsvector('simple', line));
@@ -0,0 +1,5 @@
+-- Search matches substrings of the lines, which the words of the full-text
+-- index can't find inside longer tokens such as java.lang.NullPointerException
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+DROP INDEX ale_log_lines_search;
+CREATE INDEX ale_log_lines_trigrams ON ale_log_lines USING GIN (line gin_trgm_ops);
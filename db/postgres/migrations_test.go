@@ -0,0 +1,23 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale/db/sqlstore"
+)
+
+func Test_LoadMigrations(t *testing.T) {
+	migrations, err := sqlstore.LoadMigrations(migrationFiles, "migrations", dataMigrations...)
+	assert.Nil(t, err)
+	assert.True(t, len(migrations) >= 3)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Description)
+		assert.NotNil(t, m.Up)
+		assert.NotNil(t, m.Down)
+	}
+	assert.Equal(t, "create_normalized_tables", migrations[1].Description)
+	assert.Equal(t, "move_jsonb_logs", migrations[2].Description)
+}
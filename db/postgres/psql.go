@@ -1,8 +1,7 @@
 package postgres
 
 import (
-	"database/sql"
-	"encoding/json"
+	gosql "database/sql"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,14 +11,15 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 
-	"github.com/alde/ale"
 	"github.com/alde/ale/config"
 	"github.com/alde/ale/db"
+	"github.com/alde/ale/db/sqlstore"
 )
 
 // SQL struct implementing the Database interface with PostgreSQL backend
 type SQL struct {
-	db *sql.DB
+	*sqlstore.Store
+	db *gosql.DB
 }
 
 func readPasswordFile(filename string) string {
@@ -32,8 +32,8 @@ func readPasswordFile(filename string) string {
 	return strings.Trim(string(password), "")
 }
 
-// New is used to create a new PostgreSQL database connection
-func New(cfg *config.Config) (db.Database, error) {
+// Connect opens the connection to the configured PostgreSQL database
+func Connect(cfg *config.Config) (*gosql.DB, error) {
 	password := readPasswordFile(cfg.PostgreSQL.PasswordFile)
 
 	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s",
@@ -48,7 +48,7 @@ func New(cfg *config.Config) (db.Database, error) {
 		connectionString += " sslmode=disable"
 	}
 
-	db, err := sql.Open("postgres", connectionString)
+	db, err := gosql.Open("postgres", connectionString)
 	if err != nil {
 		logrus.
 			WithField("connectionString", connectionString).
@@ -64,101 +64,66 @@ func New(cfg *config.Config) (db.Database, error) {
 			Error("failed to ping database")
 		return nil, err
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS ale_jenkins_logs ( \n" +
-		" build_id VARCHAR(128) NOT NULL, \n" +
-		" log jsonb NOT NULL, \n" +
-		" PRIMARY KEY (build_id) \n" +
-		")")
+	return db, nil
+}
+
+// New is used to create a new PostgreSQL database connection. The schema is
+// migrated to the latest version unless migrations are skipped in the config.
+func New(cfg *config.Config) (db.Database, error) {
+	db, err := Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := NewMigrator(db)
 	if err != nil {
 		logrus.
 			WithError(err).
-			Error("unable to create database table")
+			Error("unable to prepare database migrations")
+		return nil, err
+	}
+	if err := migrator.Check(cfg.PostgreSQL.SkipMigrations); err != nil {
 		return nil, err
 	}
 
 	return &SQL{
-		db: db,
+		Store: sqlstore.New(db, dialect{}, timeouts(cfg)),
+		db:    db,
 	}, nil
 }
 
-// Put inserts data into the database
-func (sql *SQL) Put(data *ale.JenkinsData, buildID string) error {
-	j, err := json.Marshal(data)
-	if err != nil {
-		logrus.
-			WithField("buildId", buildID).
-			WithError(err).
-			Error("error marshalling data into json")
+// timeouts bounds the operations on the database as configured
+func timeouts(cfg *config.Config) db.Timeouts {
+	return db.Timeouts{
+		Read:  cfg.PostgreSQL.ReadTimeout.Duration,
+		Write: cfg.PostgreSQL.WriteTimeout.Duration,
 	}
-	jstring := string(j)
-	query := `INSERT INTO ale_jenkins_logs(build_id, log)
-		 VALUES ($1, $2::jsonb)
-		 ON CONFLICT (build_id) DO UPDATE SET log = $3::jsonb`
-	_, err = sql.db.Exec(query, buildID, jstring, jstring)
+}
 
-	if err != nil {
-		logrus.
-			WithField("buildId", buildID).
-			WithError(err).
-			Error("error inserting logs into database")
-		return err
-	}
+// dialect holds what's specific to PostgreSQL in the shared schema
+type dialect struct{}
 
-	logrus.
-		WithField("buildId", buildID).
-		Info("inserted log into database")
+// migrationLock is the advisory lock held while migrating, so that several
+// instances starting at once don't apply the same migration twice
+const migrationLock = 0x616c65
 
-	return nil
+func (dialect) Lock(tx *gosql.Tx) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLock)
+	return err
 }
 
-// Has verifies the existance of a log
-func (sql *SQL) Has(buildID string) (bool, error) {
-	// TODO: don't re-use Get
-	b, err := sql.Get(buildID)
-	if err != nil {
-		return false, err
-	}
-	if (&ale.JenkinsData{}) == b {
-		return false, nil
-	}
-	return true, nil
-}
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
 
-// Get retrieves logs from the database
-func (sql *SQL) Get(buildID string) (*ale.JenkinsData, error) {
-	query := "SELECT log FROM ale_jenkins_logs WHERE build_id = $1"
-	row := sql.db.QueryRow(query, buildID)
-	var data []byte
-	err := row.Scan(&data)
-	if err != nil {
-		logrus.
-			WithError(err).
-			WithFields(logrus.Fields{
-				"buildId": buildID,
-				"data":    data,
-			}).
-			Error("unable to deserialize data")
-		return nil, err
+// MatchLine looks for every word of the query within the log lines, like
+// SearchLine does, using the trigram index of the lines
+func (dialect) MatchLine(arg func(v interface{}) string, query string) string {
+	terms := db.SearchTerms(query)
+	if len(terms) == 0 {
+		return "1 = 0"
 	}
-
-	var jlog ale.JenkinsData
-	err = json.Unmarshal([]byte(data), &jlog)
-	return &jlog, err
-}
-
-// Remove is used to remove an entry from the database
-func (sql *SQL) Remove(buildID string) error {
-	query := "DELETE FROM ale_jenkins_logs WHERE build_id = $1"
-	_, err := sql.db.Exec(query, buildID)
-	if err != nil {
-		logrus.
-			WithField("buildId", buildID).
-			WithError(err).
-			Error("error deleting logs from database")
-	} else {
-		logrus.
-			WithField("buildId", buildID).
-			Info("deleted log from database")
+	var conditions []string
+	for _, term := range terms {
+		conditions = append(conditions, "l.line ILIKE "+arg("%"+likeEscaper.Replace(term)+"%"))
 	}
-	return err
+	return "(" + strings.Join(conditions, " AND ") + ")"
 }
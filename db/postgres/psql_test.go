@@ -2,6 +2,7 @@ package postgres
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/alde/ale"
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
 )
 
 func setupPostgreSQLTestContainer() *config.Config {
@@ -52,47 +54,157 @@ func setupPostgreSQLTestContainer() *config.Config {
 func Test_Postgres(t *testing.T) {
 	cfg := setupPostgreSQLTestContainer()
 	sql, err := New(cfg)
+	ctx := context.Background()
 
 	assert.Nil(t, err)
 
 	t.Run("test inserting into the database", func(t *testing.T) {
-		err := sql.Put(&ale.JenkinsData{BuildID: "test_put"}, "test_put")
+		err := sql.Put(ctx, &ale.JenkinsData{BuildID: "test_put"}, "test_put")
 		assert.Nil(t, err)
 	})
 
 	t.Run("test retrieve from db", func(t *testing.T) {
-		sql.Put(&ale.JenkinsData{BuildID: "test_get"}, "test_get")
-		j, err := sql.Get("test_get")
+		sql.Put(ctx, &ale.JenkinsData{BuildID: "test_get"}, "test_get")
+		j, err := sql.Get(ctx, "test_get")
 		assert.Equal(t, "test_get", j.BuildID)
 		assert.Nil(t, err)
 	})
 
 	t.Run("test inserting replaces in the database", func(t *testing.T) {
-		_ = sql.Put(&ale.JenkinsData{BuildID: "test_replace", Name: "Original"}, "test_replace")
-		j0, _ := sql.Get("test_replace")
+		_ = sql.Put(ctx, &ale.JenkinsData{BuildID: "test_replace", Name: "Original"}, "test_replace")
+		j0, _ := sql.Get(ctx, "test_replace")
 		assert.Equal(t, "Original", j0.Name)
-		_ = sql.Put(&ale.JenkinsData{BuildID: "test_replace", Name: "Replacement"}, "test_replace")
-		j1, _ := sql.Get("test_replace")
+		_ = sql.Put(ctx, &ale.JenkinsData{BuildID: "test_replace", Name: "Replacement"}, "test_replace")
+		j1, _ := sql.Get(ctx, "test_replace")
 		assert.Equal(t, "Replacement", j1.Name)
 	})
 
 	t.Run("test to ensure Get will exit correctly if item isn't found", func(t *testing.T) {
-		_, err := sql.Get("test_get_not_found")
+		_, err := sql.Get(ctx, "test_get_not_found")
 		assert.NotNil(t, err)
 	})
 
 	t.Run("test to ensure Has returns true if it is in the database", func(t *testing.T) {
-		b, _ := sql.Has("test_has")
+		b, _ := sql.Has(ctx, "test_has")
 		assert.False(t, b)
 
-		sql.Put(&ale.JenkinsData{BuildID: "test_has"}, "test_has")
-		b, _ = sql.Has("test_has")
+		sql.Put(ctx, &ale.JenkinsData{BuildID: "test_has"}, "test_has")
+		b, _ = sql.Has(ctx, "test_has")
 		assert.True(t, b)
 	})
 
 	t.Run("test to ensure Has returns false if it's not in the database", func(t *testing.T) {
-		b, _ := sql.Has("test_has_not")
+		b, _ := sql.Has(ctx, "test_has_not")
 		assert.False(t, b)
 	})
 
+	t.Run("test storing and retrieving the crawl state", func(t *testing.T) {
+		_, err := sql.GetCrawl(ctx, "test_crawl")
+		assert.Equal(t, db.ErrNotFound, err)
+
+		crawl := &ale.Crawl{BuildID: "test_crawl", State: ale.CrawlQueued, Created: time.Now()}
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+		crawl.State = ale.CrawlRunning
+		crawl.Attempts = 1
+		crawl.LastPoll = time.Now()
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+
+		actual, err := sql.GetCrawl(ctx, "test_crawl")
+		assert.Nil(t, err)
+		assert.Equal(t, ale.CrawlRunning, actual.State)
+		assert.Equal(t, 1, actual.Attempts)
+	})
+
+	t.Run("test listing the unfinished crawls", func(t *testing.T) {
+		sql.PutCrawl(ctx, &ale.Crawl{BuildID: "test_pending", State: ale.CrawlQueued, Created: time.Now()})
+		sql.PutCrawl(ctx, &ale.Crawl{BuildID: "test_done", State: ale.CrawlFinished, Created: time.Now()})
+
+		pending, err := sql.PendingCrawls(ctx)
+		assert.Nil(t, err)
+		var ids []string
+		for _, crawl := range pending {
+			ids = append(ids, crawl.BuildID)
+		}
+		assert.Contains(t, ids, "test_pending")
+		assert.NotContains(t, ids, "test_done")
+	})
+
+	t.Run("test searching the logs", func(t *testing.T) {
+		sql.Put(ctx, &ale.JenkinsData{
+			Job: "search",
+			Stages: []*ale.JenkinsStage{
+				{Name: "Build", Logs: []*ale.Log{{Line: "ok"}, {Line: "Connection reset by peer"}}},
+			},
+		}, "test_search")
+
+		result, err := sql.(db.Searcher).Search(ctx, &ale.SearchQuery{Query: "reset peer", Job: "search"})
+		assert.Nil(t, err)
+		assert.Len(t, result.Builds, 1)
+		assert.Equal(t, 2, result.Builds[0].Matches[0].Line)
+	})
+	t.Run("test stages and log lines survive polls", func(t *testing.T) {
+		data := &ale.JenkinsData{
+			Status: "IN_PROGRESS",
+			Stages: []*ale.JenkinsStage{
+				{ID: "6", Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{Line: "compiled"}}},
+				{ID: "9", Name: "Test", Status: "IN_PROGRESS", SubStages: []*ale.JenkinsStage{
+					{ID: "12", Name: "unit", Branch: "unit", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}}},
+				}},
+			},
+		}
+		assert.Nil(t, sql.Put(ctx, data, "test_stages"))
+		data.Status = "SUCCESS"
+		data.Stages[1].SubStages[0].Logs = append(data.Stages[1].SubStages[0].Logs, &ale.Log{Line: "two"})
+		assert.Nil(t, sql.Put(ctx, data, "test_stages"))
+
+		j, err := sql.Get(ctx, "test_stages")
+		assert.Nil(t, err)
+		assert.Equal(t, "SUCCESS", j.Status)
+		assert.Len(t, j.Stages, 2)
+		assert.Equal(t, "unit", j.Stages[1].SubStages[0].Branch)
+		assert.Equal(t, []*ale.Log{{Line: "one"}, {Line: "two"}}, j.Stages[1].SubStages[0].Logs)
+
+		assert.Nil(t, sql.Remove(ctx, "test_stages"))
+		b, _ := sql.Has(ctx, "test_stages")
+		assert.False(t, b)
+	})
+	t.Run("test migrating down and up again", func(t *testing.T) {
+		migrator, err := NewMigrator(sql.(*SQL).db)
+		assert.Nil(t, err)
+		sql.Put(ctx, &ale.JenkinsData{Name: "kept"}, "test_migrate")
+
+		assert.Nil(t, migrator.Down(2))
+		version, _ := migrator.Version()
+		assert.Equal(t, 2, version)
+
+		assert.Nil(t, migrator.Up(0))
+		version, _ = migrator.Version()
+		assert.Equal(t, migrator.Latest(), version)
+		j, err := sql.Get(ctx, "test_migrate")
+		assert.Nil(t, err)
+		assert.Equal(t, "kept", j.Name)
+	})
+
+	t.Run("test refusing a newer schema", func(t *testing.T) {
+		database := sql.(*SQL).db
+		_, err := database.Exec("INSERT INTO schema_migrations(version) VALUES (9999)")
+		assert.Nil(t, err)
+		defer database.Exec("DELETE FROM schema_migrations WHERE version = 9999")
+
+		_, err = New(cfg)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_MatchLine(t *testing.T) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	condition := dialect{}.MatchLine(arg, "NullPointerException 100%_done")
+	assert.Equal(t, "(l.line ILIKE $1 AND l.line ILIKE $2)", condition)
+	assert.Equal(t, []interface{}{"%nullpointerexception%", `%100\%\_done%`}, args)
+	assert.Equal(t, "1 = 0", dialect{}.MatchLine(arg, "  "))
 }
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alde/ale"
+)
+
+// Searcher is implemented by the backends able to search the stored logs
+type Searcher interface {
+	Search(ctx context.Context, query *ale.SearchQuery) (*ale.SearchResult, error)
+}
+
+const (
+	// MaxMatchesPerBuild caps the number of matching lines reported for a single build
+	MaxMatchesPerBuild = 100
+
+	snippetLength  = 200
+	highlightStart = "<b>"
+	highlightEnd   = "</b>"
+)
+
+// SearchTerms splits a search query into the lowercase words a line must all contain
+func SearchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// SearchBuild finds the log lines of a build containing every term. Lines are
+// numbered from 1 within each stage, and stages are named by their path in the tree.
+func SearchBuild(data *ale.JenkinsData, buildID string, terms []string) *ale.SearchHit {
+	if len(terms) == 0 {
+		return nil
+	}
+	hit := &ale.SearchHit{
+		BuildID:   buildID,
+		Name:      data.Name,
+		Job:       data.Job,
+		Status:    data.Status,
+		StartTime: data.StartTime,
+	}
+	searchStages(hit, data.Stages, "", terms)
+	if len(hit.Matches) == 0 {
+		return nil
+	}
+	return hit
+}
+
+func searchStages(hit *ale.SearchHit, stages []*ale.JenkinsStage, parent string, terms []string) {
+	for _, stage := range stages {
+		name := stage.Name
+		if parent != "" {
+			name = parent + " / " + stage.Name
+		}
+		for i, log := range stage.Logs {
+			match := SearchLine(log.Line, terms)
+			if match == nil {
+				continue
+			}
+			if len(hit.Matches) == MaxMatchesPerBuild {
+				hit.Truncated = true
+				return
+			}
+			match.Stage = name
+			match.StageID = stage.ID
+			match.Line = i + 1
+			match.TimeStamp = log.TimeStamp
+			hit.Matches = append(hit.Matches, match)
+		}
+		searchStages(hit, stage.SubStages, name, terms)
+		if hit.Truncated {
+			return
+		}
+	}
+}
+
+// SearchLine returns a match with a highlighted snippet if the line contains every term
+func SearchLine(line string, terms []string) *ale.SearchMatch {
+	if len(terms) == 0 || !matchesAll(line, terms) {
+		return nil
+	}
+	return &ale.SearchMatch{Snippet: snippet(line, terms)}
+}
+
+func matchesAll(line string, terms []string) bool {
+	lower := strings.ToLower(line)
+	for _, term := range terms {
+		if !strings.Contains(lower, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// snippet cuts long lines down to the part around the first match, and
+// highlights every occurrence of the terms. The snippet is HTML, so the text
+// of the line is escaped around the highlights.
+func snippet(line string, terms []string) string {
+	lower := strings.ToLower(line)
+	if len(lower) != len(line) {
+		// Offsets in the lowercased line wouldn't line up with the original
+		return html.EscapeString(line)
+	}
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		for offset := 0; ; {
+			i := strings.Index(lower[offset:], term)
+			if i < 0 {
+				break
+			}
+			spans = append(spans, span{offset + i, offset + i + len(term)})
+			offset += i + len(term)
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	from, to := 0, len(line)
+	if len(line) > snippetLength && len(spans) > 0 {
+		from = spans[0].start - snippetLength/4
+		if from < 0 {
+			from = 0
+		}
+		to = from + snippetLength
+		if to > len(line) {
+			to = len(line)
+		}
+		// Offsets are in bytes, so they are moved back to the start of a
+		// character rather than cutting one in two
+		for from > 0 && !utf8.RuneStart(line[from]) {
+			from--
+		}
+		for to < len(line) && !utf8.RuneStart(line[to]) {
+			to--
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("...")
+	}
+	pos := from
+	for _, s := range spans {
+		if s.start < pos || s.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(line[pos:s.start]))
+		b.WriteString(highlightStart)
+		b.WriteString(html.EscapeString(line[s.start:s.end]))
+		b.WriteString(highlightEnd)
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(line[pos:to]))
+	if to < len(line) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+// SortHits orders the hits most recent first and applies the limit of the query
+func SortHits(hits []*ale.SearchHit, query *ale.SearchQuery) []*ale.SearchHit {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].StartTime != hits[j].StartTime {
+			return hits[i].StartTime > hits[j].StartTime
+		}
+		return hits[i].BuildID < hits[j].BuildID
+	})
+	if query.Limit > 0 && len(hits) > query.Limit {
+		hits = hits[:query.Limit]
+	}
+	return hits
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+)
+
+func searchFixture() *ale.JenkinsData {
+	return &ale.JenkinsData{
+		Name:      "#12",
+		Job:       "team/app",
+		Status:    "FAILED",
+		StartTime: 100,
+		Stages: []*ale.JenkinsStage{
+			{
+				ID:   "6",
+				Name: "Test",
+				Logs: []*ale.Log{
+					{Line: "running tests"},
+					{TimeStamp: "2019-02-14T15:38:12.376Z", Line: "read: Connection reset by peer"},
+				},
+				SubStages: []*ale.JenkinsStage{
+					{
+						ID:   "9",
+						Name: "unit",
+						Logs: []*ale.Log{{Line: "connection was reset"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func Test_SearchBuild(t *testing.T) {
+	hit := SearchBuild(searchFixture(), "build-12", SearchTerms("CONNECTION reset"))
+
+	assert.Equal(t, "team/app", hit.Job)
+	assert.Equal(t, []*ale.SearchMatch{
+		{Stage: "Test", StageID: "6", Line: 2, TimeStamp: "2019-02-14T15:38:12.376Z", Snippet: "read: <b>Connection</b> <b>reset</b> by peer"},
+		{Stage: "Test / unit", StageID: "9", Line: 1, Snippet: "<b>connection</b> was <b>reset</b>"},
+	}, hit.Matches)
+}
+
+func Test_SearchBuildWithoutMatch(t *testing.T) {
+	assert.Nil(t, SearchBuild(searchFixture(), "build-12", SearchTerms("timeout")))
+	assert.Nil(t, SearchBuild(searchFixture(), "build-12", SearchTerms("  ")))
+}
+
+func Test_SnippetOfLongLine(t *testing.T) {
+	line := ""
+	for len(line) < 1000 {
+		line += "padding "
+	}
+	line += "NullPointerException " + line
+	s := snippet(line, SearchTerms("nullpointerexception"))
+
+	assert.Contains(t, s, "<b>NullPointerException</b>")
+	assert.True(t, len(s) < 250)
+}
+
+func Test_SnippetEscapesHTML(t *testing.T) {
+	s := snippet(`<script>alert("failed")</script> & FAILED`, SearchTerms("failed"))
+	assert.Equal(t, `&lt;script&gt;alert(&#34;<b>failed</b>&#34;)&lt;/script&gt; &amp; <b>FAILED</b>`, s)
+
+	s = snippet("<img src=x onerror=alert(1)> İstanbul", SearchTerms("istanbul"))
+	assert.NotContains(t, s, "<img")
+}
+
+func Test_SnippetKeepsCharactersWhole(t *testing.T) {
+	for shift := 0; shift < 4; shift++ {
+		line := strings.Repeat("é", 60+shift) + " needle " + strings.Repeat("日本", 60)
+		s := snippet(line, SearchTerms("needle"))
+		assert.True(t, utf8.ValidString(s), s)
+		assert.NotContains(t, s, "\uFFFD")
+		assert.Contains(t, s, "<b>needle</b>")
+	}
+}
+
+func Test_FilestoreSearch(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "filestore")
+	defer os.RemoveAll(folder)
+	database, _ := NewFilestore(folder, CompressionZstd)
+	database.Put(ctx, searchFixture(), "build-12")
+	database.Put(ctx, &ale.JenkinsData{Name: "#13", Job: "other"}, "build-13")
+
+	result, err := database.(Searcher).Search(ctx, &ale.SearchQuery{Query: "peer"})
+	assert.Nil(t, err)
+	assert.Len(t, result.Builds, 1)
+	assert.Equal(t, "build-12", result.Builds[0].BuildID)
+
+	result, _ = database.(Searcher).Search(ctx, &ale.SearchQuery{Query: "peer", Job: "other"})
+	assert.Empty(t, result.Builds)
+}
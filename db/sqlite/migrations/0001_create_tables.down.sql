@@ -0,0 +1,4 @@
+DROP TABLE ale_log_lines;
+DROP TABLE ale_stages;
+DROP TABLE ale_builds;
+DROP TABLE ale_crawls;
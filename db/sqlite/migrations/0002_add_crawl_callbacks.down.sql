@@ -0,0 +1,4 @@
+ALTER TABLE ale_crawls DROP COLUMN deliveries;
+ALTER TABLE ale_crawls DROP COLUMN location;
+ALTER TABLE ale_crawls DROP COLUMN callback_secret;
+ALTER TABLE ale_crawls DROP COLUMN callback_url;
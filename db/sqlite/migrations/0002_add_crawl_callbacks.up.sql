@@ -0,0 +1,4 @@
+ALTER TABLE ale_crawls ADD COLUMN callback_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE ale_crawls ADD COLUMN callback_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE ale_crawls ADD COLUMN location TEXT NOT NULL DEFAULT '';
+ALTER TABLE ale_crawls ADD COLUMN deliveries TEXT;
@@ -0,0 +1,114 @@
+package sqlite
+
+import (
+	gosql "database/sql"
+	"embed"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	// Import the pure Go sqlite driver into the scope of this package (required)
+	_ "modernc.org/sqlite"
+
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+	"github.com/alde/ale/db/sqlstore"
+)
+
+// The schema matches the one of the PostgreSQL backend, described by the
+// numbered files in migrations/
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// SQLite implements the Database interface with an embedded SQLite database
+type SQLite struct {
+	*sqlstore.Store
+	db *gosql.DB
+}
+
+// Connect opens the configured SQLite database file, creating it if needed
+func Connect(cfg *config.Config) (*gosql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		cfg.SQLite.Path)
+	db, err := gosql.Open("sqlite", dsn)
+	if err != nil {
+		logrus.
+			WithField("path", cfg.SQLite.Path).
+			WithError(err).
+			Error("failed to initialize driver")
+		return nil, err
+	}
+	// SQLite allows a single writer, so it's simplest to share one connection
+	db.SetMaxOpenConns(1)
+
+	if err = db.Ping(); err != nil {
+		logrus.
+			WithField("path", cfg.SQLite.Path).
+			WithError(err).
+			Error("failed to open database")
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewMigrator prepares the migrations of the database, without applying any
+func NewMigrator(db *gosql.DB) (*sqlstore.Migrator, error) {
+	migrations, err := sqlstore.LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.NewMigrator(db, dialect{}, migrations)
+}
+
+// New opens the SQLite database, migrating the schema to the latest version
+// unless migrations are skipped in the config
+func New(cfg *config.Config) (db.Database, error) {
+	db, err := Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		logrus.
+			WithError(err).
+			Error("unable to prepare database migrations")
+		return nil, err
+	}
+	if err := migrator.Check(cfg.SQLite.SkipMigrations); err != nil {
+		return nil, err
+	}
+	return &SQLite{
+		Store: sqlstore.New(db, dialect{}, timeouts(cfg)),
+		db:    db,
+	}, nil
+}
+
+// timeouts bounds the operations on the database as configured
+func timeouts(cfg *config.Config) db.Timeouts {
+	return db.Timeouts{
+		Read:  cfg.SQLite.ReadTimeout.Duration,
+		Write: cfg.SQLite.WriteTimeout.Duration,
+	}
+}
+
+// dialect holds what's specific to SQLite in the shared schema
+type dialect struct{}
+
+// Lock does nothing, as SQLite already serializes writing transactions
+func (dialect) Lock(tx *gosql.Tx) error {
+	return nil
+}
+
+// MatchLine scans the log lines for every word of the query
+func (dialect) MatchLine(arg func(v interface{}) string, query string) string {
+	terms := db.SearchTerms(query)
+	if len(terms) == 0 {
+		return "1 = 0"
+	}
+	var conditions []string
+	for _, term := range terms {
+		conditions = append(conditions, "instr(lower(l.line), "+arg(term)+") > 0")
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")"
+}
@@ -0,0 +1,233 @@
+package sqlite
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+)
+
+func Test_SQLite(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "sqlite")
+	defer os.RemoveAll(folder)
+	cfg := config.DefaultConfig()
+	cfg.SQLite.Path = filepath.Join(folder, "ale.db")
+
+	sql, err := New(cfg)
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	t.Run("test retrieve from db", func(t *testing.T) {
+		assert.Nil(t, sql.Put(ctx, &ale.JenkinsData{BuildID: "test_get", Name: "#1"}, "test_get"))
+		j, err := sql.Get(ctx, "test_get")
+		assert.Nil(t, err)
+		assert.Equal(t, "test_get", j.BuildID)
+		assert.Equal(t, "#1", j.Name)
+	})
+
+	t.Run("test giving up once the context is done", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := sql.Get(cancelled, "test_get")
+		assert.Equal(t, context.Canceled, err)
+		assert.NotNil(t, sql.Put(cancelled, &ale.JenkinsData{}, "test_cancelled"))
+		b, _ := sql.Has(ctx, "test_cancelled")
+		assert.False(t, b)
+	})
+
+	t.Run("test to ensure Get will exit correctly if item isn't found", func(t *testing.T) {
+		_, err := sql.Get(ctx, "test_get_not_found")
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("test Has and Remove", func(t *testing.T) {
+		b, _ := sql.Has(ctx, "test_has")
+		assert.False(t, b)
+		sql.Put(ctx, &ale.JenkinsData{}, "test_has")
+		b, _ = sql.Has(ctx, "test_has")
+		assert.True(t, b)
+		assert.Nil(t, sql.Remove(ctx, "test_has"))
+		b, _ = sql.Has(ctx, "test_has")
+		assert.False(t, b)
+	})
+
+	t.Run("test stages and log lines survive polls", func(t *testing.T) {
+		data := &ale.JenkinsData{
+			Status: "IN_PROGRESS",
+			Stages: []*ale.JenkinsStage{
+				{ID: "6", Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{Line: "compiled"}}},
+				{ID: "9", Name: "Test", Status: "IN_PROGRESS", SubStages: []*ale.JenkinsStage{
+					{ID: "12", Name: "unit", Branch: "unit", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}}},
+				}},
+			},
+		}
+		assert.Nil(t, sql.Put(ctx, data, "test_stages"))
+		data.Status = "SUCCESS"
+		data.Stages[1].SubStages[0].Logs = append(data.Stages[1].SubStages[0].Logs, &ale.Log{TimeStamp: "2019-02-14T15:38:12.376Z", Line: "two"})
+		data.Stages = append(data.Stages, &ale.JenkinsStage{ID: "20", Name: "Deploy"})
+		assert.Nil(t, sql.Put(ctx, data, "test_stages"))
+
+		j, err := sql.Get(ctx, "test_stages")
+		assert.Nil(t, err)
+		assert.Equal(t, "SUCCESS", j.Status)
+		assert.Equal(t, data.Stages, j.Stages)
+
+		data.Stages = data.Stages[:1]
+		assert.Nil(t, sql.Put(ctx, data, "test_stages"))
+		j, _ = sql.Get(ctx, "test_stages")
+		assert.Len(t, j.Stages, 1)
+	})
+
+	t.Run("test reading stages and ranges of their logs", func(t *testing.T) {
+		sql.Put(ctx, &ale.JenkinsData{
+			Stages: []*ale.JenkinsStage{
+				{ID: "6", Name: "Build", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}, {Line: "three"}}},
+				{ID: "9", Name: "Test", SubStages: []*ale.JenkinsStage{
+					{ID: "12", Name: "unit", Logs: []*ale.Log{{TimeStamp: "10:00:00", Line: "ok"}}},
+				}},
+			},
+		}, "test_stage_log")
+		reader := sql.(db.StageReader)
+
+		stages, err := reader.Stages(ctx, "test_stage_log")
+		assert.Nil(t, err)
+		assert.Len(t, stages, 3)
+		assert.Equal(t, 3, stages[0].Lines)
+		assert.Equal(t, "Test / unit", stages[2].Path)
+
+		log, err := reader.StageLog(ctx, "test_stage_log", 0, 2, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []*ale.LogLine{{Number: 2, Line: "two"}}, log.Lines)
+
+		log, err = reader.StageLog(ctx, "test_stage_log", 2, 0, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, log.To)
+		assert.Equal(t, "10:00:00", log.Lines[0].TimeStamp)
+
+		_, err = reader.StageLog(ctx, "test_stage_log", 3, 0, 0)
+		assert.Equal(t, db.ErrStageNotFound, err)
+	})
+
+	t.Run("test storing and retrieving the crawl state", func(t *testing.T) {
+		_, err := sql.GetCrawl(ctx, "test_crawl")
+		assert.Equal(t, db.ErrNotFound, err)
+
+		crawl := &ale.Crawl{BuildID: "test_crawl", State: ale.CrawlQueued, Created: time.Now()}
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+		crawl.State = ale.CrawlRunning
+		crawl.LastPoll = time.Now()
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+
+		actual, err := sql.GetCrawl(ctx, "test_crawl")
+		assert.Nil(t, err)
+		assert.Equal(t, ale.CrawlRunning, actual.State)
+		assert.False(t, actual.LastPoll.IsZero())
+
+		pending, err := sql.PendingCrawls(ctx)
+		assert.Nil(t, err)
+		assert.Len(t, pending, 1)
+	})
+
+	t.Run("test storing the callback of a crawl and its deliveries", func(t *testing.T) {
+		crawl := &ale.Crawl{
+			BuildID:        "test_callback",
+			State:          ale.CrawlFinished,
+			Created:        time.Now(),
+			CallbackURL:    "http://ci-bot.local/done",
+			CallbackSecret: "s3cr3t",
+			Location:       "http://ale.local/api/v1/build/test_callback",
+		}
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+		actual, _ := sql.GetCrawl(ctx, "test_callback")
+		assert.Equal(t, "s3cr3t", actual.CallbackSecret)
+		assert.Empty(t, actual.Deliveries)
+
+		crawl.Deliveries = []ale.Delivery{{Attempt: 1, StatusCode: 502, Error: "bad gateway"}, {Attempt: 2, StatusCode: 200}}
+		assert.Nil(t, sql.PutCrawl(ctx, crawl))
+		actual, err := sql.GetCrawl(ctx, "test_callback")
+		assert.Nil(t, err)
+		assert.Len(t, actual.Deliveries, 2)
+		assert.Equal(t, "bad gateway", actual.Deliveries[0].Error)
+		assert.Equal(t, crawl.Location, actual.Location)
+	})
+
+	t.Run("test listing builds", func(t *testing.T) {
+		sql.Put(ctx, &ale.JenkinsData{Job: "list", Status: "SUCCESS", StartTime: 100}, "test_list_1")
+		sql.Put(ctx, &ale.JenkinsData{Job: "list", Status: "FAILED", StartTime: 200}, "test_list_2")
+		sql.Put(ctx, &ale.JenkinsData{Job: "list", Status: "SUCCESS", StartTime: 300}, "test_list_3")
+		sql.PutCrawl(ctx, &ale.Crawl{BuildID: "test_list_3", State: ale.CrawlFinished, Created: time.Now()})
+
+		list, err := sql.List(ctx, &ale.BuildQuery{Job: "list", Limit: 2})
+		assert.Nil(t, err)
+		assert.Len(t, list.Builds, 2)
+		assert.Equal(t, "test_list_3", list.Builds[0].BuildID)
+		assert.Equal(t, ale.CrawlFinished, list.Builds[0].CrawlState)
+
+		list, err = sql.List(ctx, &ale.BuildQuery{Job: "list", Limit: 2, Cursor: list.NextCursor})
+		assert.Nil(t, err)
+		assert.Len(t, list.Builds, 1)
+		assert.Equal(t, "test_list_1", list.Builds[0].BuildID)
+		assert.Empty(t, list.NextCursor)
+
+		list, _ = sql.List(ctx, &ale.BuildQuery{Job: "list", Status: "FAILED"})
+		assert.Len(t, list.Builds, 1)
+	})
+
+	t.Run("test removing builds in bulk", func(t *testing.T) {
+		sql.Put(ctx, &ale.JenkinsData{Stages: []*ale.JenkinsStage{{Name: "Build", Logs: []*ale.Log{{Line: "x"}}}}}, "test_remove_1")
+		sql.Put(ctx, &ale.JenkinsData{}, "test_remove_2")
+		sql.PutCrawl(ctx, &ale.Crawl{BuildID: "test_remove_1", State: ale.CrawlFinished, Created: time.Now()})
+
+		removed, err := sql.RemoveBuilds(ctx, []string{"test_remove_1", "test_remove_2", "test_remove_missing"})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, removed)
+		b, _ := sql.Has(ctx, "test_remove_1")
+		assert.False(t, b)
+		_, err = sql.GetCrawl(ctx, "test_remove_1")
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("test searching the logs", func(t *testing.T) {
+		sql.Put(ctx, &ale.JenkinsData{
+			Job: "search",
+			Stages: []*ale.JenkinsStage{
+				{Name: "Build", Logs: []*ale.Log{{Line: "ok"}, {Line: "Connection reset by peer"}}},
+			},
+		}, "test_search")
+
+		result, err := sql.(db.Searcher).Search(ctx, &ale.SearchQuery{Query: "reset PEER", Job: "search"})
+		assert.Nil(t, err)
+		assert.Len(t, result.Builds, 1)
+		assert.Equal(t, 2, result.Builds[0].Matches[0].Line)
+		assert.Equal(t, "Build", result.Builds[0].Matches[0].Stage)
+	})
+
+	t.Run("test migrating down and up again", func(t *testing.T) {
+		migrator, err := NewMigrator(sql.(*SQLite).db)
+		assert.Nil(t, err)
+		assert.Nil(t, migrator.Down(0))
+		version, _ := migrator.Version()
+		assert.Equal(t, 0, version)
+		assert.Nil(t, migrator.Up(0))
+		version, _ = migrator.Version()
+		assert.Equal(t, migrator.Latest(), version)
+	})
+
+	t.Run("test refusing a newer schema", func(t *testing.T) {
+		database := sql.(*SQLite).db
+		_, err := database.Exec("INSERT INTO schema_migrations(version) VALUES (9999)")
+		assert.Nil(t, err)
+		defer database.Exec("DELETE FROM schema_migrations WHERE version = 9999")
+
+		migrator, _ := NewMigrator(database)
+		assert.NotNil(t, migrator.Check(false))
+	})
+}
@@ -0,0 +1,293 @@
+package sqlstore
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+)
+
+// Querier is implemented by both connections and transactions
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (gosql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*gosql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *gosql.Row
+}
+
+// storedStage is what's compared to tell whether a stage changed since the last poll
+type storedStage struct {
+	parentKey string
+	position  int
+	status    string
+	duration  int
+	logLength int
+	logOffset int
+	logTail   string
+	lineCount int
+}
+
+// PutBuild writes a build, only touching the stages and log lines which
+// changed since it was last written
+func PutBuild(ctx context.Context, tx *gosql.Tx, data *ale.JenkinsData, buildID string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO ale_builds(build_id, id, name, job, status, start_time, end_time, duration, queue_duration, pause_duration)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (build_id) DO UPDATE SET
+		 id = $2, name = $3, job = $4, status = $5, start_time = $6, end_time = $7,
+		 duration = $8, queue_duration = $9, pause_duration = $10`,
+		buildID, data.ID, data.Name, data.Job, data.Status, data.StartTime, data.EndTime,
+		data.Duration, data.QueueDuration, data.PauseDuration)
+	if err != nil {
+		return err
+	}
+
+	stored, err := storedStages(ctx, tx, buildID)
+	if err != nil {
+		return err
+	}
+	var insertLine *gosql.Stmt
+	defer func() {
+		if insertLine != nil {
+			insertLine.Close()
+		}
+	}()
+	for _, row := range db.FlattenStages(data.Stages) {
+		stage := row.Stage
+		current := storedStage{
+			parentKey: row.ParentKey,
+			position:  row.Position,
+			status:    stage.Status,
+			duration:  stage.Duration,
+			logLength: stage.LogLength,
+			logOffset: stage.LogOffset,
+			logTail:   stage.LogTail,
+			lineCount: len(stage.Logs),
+		}
+		previous, known := stored[row.Key]
+		delete(stored, row.Key)
+		if !known || previous != current {
+			if err := putStage(ctx, tx, buildID, row); err != nil {
+				return err
+			}
+		}
+
+		// Logs only grow while a build runs, so only the new lines are written
+		from := 0
+		if known {
+			from = previous.lineCount
+		}
+		if current.lineCount < from {
+			_, err := tx.ExecContext(ctx, "DELETE FROM ale_log_lines WHERE build_id = $1 AND stage_key = $2 AND line_no > $3",
+				buildID, row.Key, current.lineCount)
+			if err != nil {
+				return err
+			}
+			from = current.lineCount
+		}
+		for i := from; i < current.lineCount; i++ {
+			if insertLine == nil {
+				insertLine, err = tx.PrepareContext(ctx, `INSERT INTO ale_log_lines(build_id, stage_key, line_no, timestamp, line)
+					 VALUES ($1, $2, $3, $4, $5)
+					 ON CONFLICT (build_id, stage_key, line_no) DO UPDATE SET timestamp = $4, line = $5`)
+				if err != nil {
+					return err
+				}
+			}
+			log := stage.Logs[i]
+			if _, err := insertLine.ExecContext(ctx, buildID, row.Key, i+1, log.TimeStamp, log.Line); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key := range stored {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM ale_stages WHERE build_id = $1 AND stage_key = $2", buildID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storedStages(ctx context.Context, q Querier, buildID string) (map[string]storedStage, error) {
+	rows, err := q.QueryContext(ctx, `SELECT stage_key, parent_key, position, status, duration, log_length, log_offset, log_tail, line_count
+		 FROM ale_stages WHERE build_id = $1`, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stored := make(map[string]storedStage)
+	for rows.Next() {
+		var key string
+		var s storedStage
+		err := rows.Scan(&key, &s.parentKey, &s.position, &s.status, &s.duration,
+			&s.logLength, &s.logOffset, &s.logTail, &s.lineCount)
+		if err != nil {
+			return nil, err
+		}
+		stored[key] = s
+	}
+	return stored, rows.Err()
+}
+
+func putStage(ctx context.Context, tx *gosql.Tx, buildID string, row *db.StageRow) error {
+	stage := row.Stage
+	_, err := tx.ExecContext(ctx, `INSERT INTO ale_stages(build_id, stage_key, parent_key, position, id, name, status, branch,
+		 start_time, duration, task, description, log_length, log_offset, log_tail, line_count)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		 ON CONFLICT (build_id, stage_key) DO UPDATE SET
+		 parent_key = $3, position = $4, id = $5, name = $6, status = $7, branch = $8,
+		 start_time = $9, duration = $10, task = $11, description = $12,
+		 log_length = $13, log_offset = $14, log_tail = $15, line_count = $16`,
+		buildID, row.Key, row.ParentKey, row.Position, stage.ID, stage.Name, stage.Status, stage.Branch,
+		stage.StartTime, stage.Duration, stage.Task, stage.Description,
+		stage.LogLength, stage.LogOffset, stage.LogTail, len(stage.Logs))
+	return err
+}
+
+// GetBuild reads a build with all of its stages and log lines
+func GetBuild(ctx context.Context, q Querier, buildID string) (*ale.JenkinsData, error) {
+	data := &ale.JenkinsData{BuildID: buildID}
+	err := q.QueryRowContext(ctx, `SELECT id, name, job, status, start_time, end_time, duration, queue_duration, pause_duration
+		 FROM ale_builds WHERE build_id = $1`, buildID).
+		Scan(&data.ID, &data.Name, &data.Job, &data.Status, &data.StartTime, &data.EndTime,
+			&data.Duration, &data.QueueDuration, &data.PauseDuration)
+	if err == gosql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stages, err := getStages(ctx, q, buildID)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*ale.JenkinsStage, len(stages))
+	for _, row := range stages {
+		byKey[row.Key] = row.Stage
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT stage_key, timestamp, line FROM ale_log_lines
+		 WHERE build_id = $1 ORDER BY stage_key, line_no`, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var log ale.Log
+		if err := rows.Scan(&key, &log.TimeStamp, &log.Line); err != nil {
+			return nil, err
+		}
+		if stage, ok := byKey[key]; ok {
+			stage.Logs = append(stage.Logs, &log)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	data.Stages = db.StageTree(stages)
+	return data, nil
+}
+
+// getStages reads the stages of a build without their logs, in the order of the tree
+func getStages(ctx context.Context, q Querier, buildID string) ([]*db.StageRow, error) {
+	rows, err := q.QueryContext(ctx, `SELECT stage_key, parent_key, position, id, name, status, branch,
+		 start_time, duration, task, description, log_length, log_offset, log_tail, line_count
+		 FROM ale_stages WHERE build_id = $1 ORDER BY position`, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stages []*db.StageRow
+	for rows.Next() {
+		row := &db.StageRow{Stage: &ale.JenkinsStage{}}
+		stage := row.Stage
+		err := rows.Scan(&row.Key, &row.ParentKey, &row.Position, &stage.ID, &stage.Name, &stage.Status, &stage.Branch,
+			&stage.StartTime, &stage.Duration, &stage.Task, &stage.Description,
+			&stage.LogLength, &stage.LogOffset, &stage.LogTail, &row.Lines)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, row)
+	}
+	return stages, rows.Err()
+}
+
+// getLogLines reads the lines from and to of the log of a stage
+func getLogLines(ctx context.Context, q Querier, buildID string, stageKey string, from, to int) ([]*ale.LogLine, error) {
+	rows, err := q.QueryContext(ctx, `SELECT line_no, timestamp, line FROM ale_log_lines
+		 WHERE build_id = $1 AND stage_key = $2 AND line_no BETWEEN $3 AND $4 ORDER BY line_no`,
+		buildID, stageKey, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lines := []*ale.LogLine{}
+	for rows.Next() {
+		var line ale.LogLine
+		if err := rows.Scan(&line.Number, &line.TimeStamp, &line.Line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, &line)
+	}
+	return lines, rows.Err()
+}
+
+// searchBuildLines adds the lines of the build matching the query to the hit,
+// naming each stage by its path in the tree
+func (s *Store) searchBuildLines(ctx context.Context, hit *ale.SearchHit, query string, terms []string) error {
+	stages, err := getStages(ctx, s.db, hit.BuildID)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string, len(stages))
+	ids := make(map[string]string, len(stages))
+	for _, row := range stages {
+		name := row.Stage.Name
+		if parent, ok := names[row.ParentKey]; ok && row.ParentKey != "" {
+			name = parent + " / " + name
+		}
+		names[row.Key] = name
+		ids[row.Key] = row.Stage.ID
+	}
+
+	args := []interface{}{hit.BuildID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	stmt := "SELECT l.stage_key, l.line_no, l.timestamp, l.line \n" +
+		" FROM ale_log_lines l JOIN ale_stages s ON s.build_id = l.build_id AND s.stage_key = l.stage_key \n" +
+		" WHERE l.build_id = $1 AND " + s.dialect.MatchLine(arg, query) + " \n" +
+		" ORDER BY s.position, l.line_no"
+	stmt += " LIMIT " + arg(db.MaxMatchesPerBuild+1)
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, timestamp, line string
+		var lineNo int
+		if err := rows.Scan(&key, &lineNo, &timestamp, &line); err != nil {
+			return err
+		}
+		match := db.SearchLine(line, terms)
+		if match == nil {
+			continue
+		}
+		if len(hit.Matches) == db.MaxMatchesPerBuild {
+			hit.Truncated = true
+			break
+		}
+		match.Stage = names[key]
+		match.StageID = ids[key]
+		match.Line = lineNo
+		match.TimeStamp = timestamp
+		hit.Matches = append(hit.Matches, match)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,259 @@
+package sqlstore
+
+import (
+	gosql "database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Migration is one version of the schema. Most migrations are read from
+// NNNN_description.up.sql and NNNN_description.down.sql files, those moving
+// data in ways SQL alone can't are written in Go.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *gosql.Tx) error
+	Down        func(tx *gosql.Tx) error
+}
+
+// MigrationStatus tells whether a migration has been applied to the database
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+}
+
+func execSQL(stmt string) func(tx *gosql.Tx) error {
+	return func(tx *gosql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// LoadMigrations reads the migration files in dir and merges them with the
+// migrations written in Go, ordered by version
+func LoadMigrations(files fs.FS, dir string, goMigrations ...*Migration) ([]*Migration, error) {
+	byVersion := make(map[int]*Migration)
+	for _, m := range goMigrations {
+		byVersion[m.Version] = m
+	}
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, "."+direction+".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migration file %s should be named NNNN_description.%s.sql", name, direction)
+		}
+		content, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Description: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = execSQL(string(content))
+		} else {
+			m.Down = execSQL(string(content))
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migration %d needs both an up and a down step", m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrator upgrades and downgrades the schema of the database
+type Migrator struct {
+	db         *gosql.DB
+	dialect    Dialect
+	migrations []*Migration
+}
+
+// NewMigrator prepares the migrations of the database, without applying any
+func NewMigrator(db *gosql.DB, dialect Dialect, migrations []*Migration) (*Migrator, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations ( \n" +
+		" version INTEGER NOT NULL, \n" +
+		" applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, \n" +
+		" PRIMARY KEY (version) \n" +
+		")")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// Latest is the version of the schema this version of ale expects
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Version is the version of the schema in the database
+func (m *Migrator) Version() (int, error) {
+	var version int
+	err := m.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Status lists the known migrations, and whether each of them has been applied
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	rows, err := m.db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var status []*MigrationStatus
+	for _, mig := range m.migrations {
+		status = append(status, &MigrationStatus{
+			Version:     mig.Version,
+			Description: mig.Description,
+			Applied:     applied[mig.Version],
+		})
+	}
+	return status, nil
+}
+
+// Up applies the migrations up to and including the target version, or all of them if target is 0
+func (m *Migrator) Up(target int) error {
+	if target == 0 {
+		target = m.Latest()
+	}
+	if target > m.Latest() {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", target, m.Latest())
+	}
+	for _, mig := range m.migrations {
+		if mig.Version > target {
+			break
+		}
+		if err := m.apply(mig, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down reverts the migrations newer than the target version
+func (m *Migrator) Down(target int) error {
+	if target < 0 {
+		return fmt.Errorf("unknown schema version %d", target)
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= target {
+			break
+		}
+		if err := m.apply(mig, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check migrates the schema to the latest version, unless told to skip it,
+// and refuses a schema of any other version than the latest
+func (m *Migrator) Check(skipMigrations bool) error {
+	if !skipMigrations {
+		if err := m.Up(0); err != nil {
+			return err
+		}
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version > m.Latest() {
+		return fmt.Errorf("database schema version %d is newer than version %d known by this build of ale",
+			version, m.Latest())
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("database schema version %d is older than version %d, run ale migrate",
+			version, m.Latest())
+	}
+	return nil
+}
+
+// apply runs one step of a migration in its own transaction, unless the
+// database already is on the right side of it
+func (m *Migrator) apply(mig *Migration, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.dialect.Lock(tx); err != nil {
+		return err
+	}
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.Version).Scan(&applied)
+	if err != nil || applied == up {
+		return err
+	}
+
+	fields := logrus.Fields{
+		"version":     mig.Version,
+		"description": mig.Description,
+	}
+	if up {
+		logrus.WithFields(fields).Info("applying database migration")
+		err = mig.Up(tx)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations(version) VALUES ($1)", mig.Version)
+		}
+	} else {
+		logrus.WithFields(fields).Info("reverting database migration")
+		err = mig.Down(tx)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Error("unable to migrate database")
+		return err
+	}
+	return tx.Commit()
+}
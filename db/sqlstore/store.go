@@ -0,0 +1,410 @@
+package sqlstore
+
+import (
+	"context"
+	gosql "database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+)
+
+// Dialect holds what differs between the SQL databases sharing the schema
+type Dialect interface {
+	// Lock keeps other instances from migrating the database until the transaction ends
+	Lock(tx *gosql.Tx) error
+	// MatchLine is the condition for the log line l.line to contain the words of
+	// the query, arg binds a value and returns its placeholder
+	MatchLine(arg func(v interface{}) string, query string) string
+}
+
+// removeBatchSize bounds the number of parameters of a single delete
+const removeBatchSize = 500
+
+// Store implements the Database interface on top of the normalized schema
+// shared by the SQL databases
+type Store struct {
+	db       *gosql.DB
+	dialect  Dialect
+	timeouts db.Timeouts
+}
+
+// New creates a Store on a connection to a database of the given dialect
+func New(db *gosql.DB, dialect Dialect, timeouts db.Timeouts) *Store {
+	return &Store{db: db, dialect: dialect, timeouts: timeouts}
+}
+
+// Put inserts data into the database. Only the stages and log lines which
+// changed since the build was last stored are written.
+func (s *Store) Put(ctx context.Context, data *ale.JenkinsData, buildID string) error {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = PutBuild(ctx, tx, data, buildID); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logrus.
+			WithField("buildId", buildID).
+			WithError(err).
+			Error("error inserting logs into database")
+		return err
+	}
+
+	logrus.
+		WithField("buildId", buildID).
+		Info("inserted log into database")
+
+	return nil
+}
+
+// Has verifies the existance of a log
+func (s *Store) Has(ctx context.Context, buildID string) (bool, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM ale_builds WHERE build_id = $1)", buildID).Scan(&exists)
+	return exists, err
+}
+
+// Get retrieves logs from the database
+func (s *Store) Get(ctx context.Context, buildID string) (*ale.JenkinsData, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	data, err := GetBuild(ctx, s.db, buildID)
+	if err != nil && err != db.ErrNotFound {
+		logrus.
+			WithError(err).
+			WithField("buildId", buildID).
+			Error("unable to deserialize data")
+	}
+	return data, err
+}
+
+// Remove is used to remove an entry from the database
+func (s *Store) Remove(ctx context.Context, buildID string) error {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+	query := "DELETE FROM ale_builds WHERE build_id = $1"
+	_, err := s.db.ExecContext(ctx, query, buildID)
+	if err != nil {
+		logrus.
+			WithField("buildId", buildID).
+			WithError(err).
+			Error("error deleting logs from database")
+	} else {
+		logrus.
+			WithField("buildId", buildID).
+			Info("deleted log from database")
+	}
+	return err
+}
+
+// PutCrawl inserts or replaces the crawl record of a build
+func (s *Store) PutCrawl(ctx context.Context, crawl *ale.Crawl) error {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+	query := `INSERT INTO ale_crawls(build_id, build_url, state, attempts, created, last_poll, last_error, jenkins_status,
+		 callback_url, callback_secret, location, deliveries)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		 ON CONFLICT (build_id) DO UPDATE SET
+		 build_url = $2, state = $3, attempts = $4, last_poll = $6, last_error = $7, jenkins_status = $8,
+		 callback_url = $9, callback_secret = $10, location = $11, deliveries = $12`
+	var lastPoll *time.Time
+	if !crawl.LastPoll.IsZero() {
+		lastPoll = &crawl.LastPoll
+	}
+	// The deliveries are kept as a JSON array, left NULL until there are any
+	var deliveries *string
+	if len(crawl.Deliveries) > 0 {
+		b, err := json.Marshal(crawl.Deliveries)
+		if err != nil {
+			return err
+		}
+		encoded := string(b)
+		deliveries = &encoded
+	}
+	_, err := s.db.ExecContext(ctx, query,
+		crawl.BuildID, crawl.BuildURL, crawl.State, crawl.Attempts,
+		crawl.Created, lastPoll, crawl.LastError, crawl.JenkinsStatus,
+		crawl.CallbackURL, crawl.CallbackSecret, crawl.Location, deliveries)
+	if err != nil {
+		logrus.
+			WithField("buildId", crawl.BuildID).
+			WithError(err).
+			Error("error storing crawl state")
+	}
+	return err
+}
+
+const crawlColumns = "build_id, build_url, state, attempts, created, last_poll, last_error, jenkins_status, " +
+	"callback_url, callback_secret, location, deliveries"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCrawl(row scanner) (*ale.Crawl, error) {
+	var crawl ale.Crawl
+	var lastPoll *time.Time
+	var deliveries []byte
+	err := row.Scan(
+		&crawl.BuildID, &crawl.BuildURL, &crawl.State, &crawl.Attempts,
+		&crawl.Created, &lastPoll, &crawl.LastError, &crawl.JenkinsStatus,
+		&crawl.CallbackURL, &crawl.CallbackSecret, &crawl.Location, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	if lastPoll != nil {
+		crawl.LastPoll = *lastPoll
+	}
+	if len(deliveries) > 0 {
+		if err := json.Unmarshal(deliveries, &crawl.Deliveries); err != nil {
+			return nil, err
+		}
+	}
+	return &crawl, nil
+}
+
+// GetCrawl retrieves the crawl record of a build
+func (s *Store) GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	query := "SELECT " + crawlColumns + " FROM ale_crawls WHERE build_id = $1"
+	crawl, err := scanCrawl(s.db.QueryRowContext(ctx, query, buildID))
+	if err == gosql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	return crawl, err
+}
+
+// PendingCrawls retrieves every crawl record which has not yet finished
+func (s *Store) PendingCrawls(ctx context.Context) ([]*ale.Crawl, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	query := "SELECT " + crawlColumns + " FROM ale_crawls WHERE state IN ($1, $2) ORDER BY created"
+	rows, err := s.db.QueryContext(ctx, query, ale.CrawlQueued, ale.CrawlRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []*ale.Crawl
+	for rows.Next() {
+		crawl, err := scanCrawl(rows)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, crawl)
+	}
+	return pending, rows.Err()
+}
+
+// List pages through the stored builds matching the query, newest first unless ascending
+func (s *Store) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	cursor, err := db.DecodeCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.Job != "" {
+		where = append(where, "b.job = "+arg(query.Job))
+	}
+	if query.Status != "" {
+		where = append(where, "b.status = "+arg(query.Status))
+	}
+	if query.CrawlState != "" {
+		where = append(where, "c.state = "+arg(query.CrawlState))
+	}
+	if query.From > 0 {
+		where = append(where, "b.start_time >= "+arg(query.From))
+	}
+	if query.To > 0 {
+		where = append(where, "b.start_time <= "+arg(query.To))
+	}
+	order, cmp := "DESC", "<"
+	if query.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(b.start_time, b.build_id) %s (%s, %s)",
+			cmp, arg(cursor.StartTime), arg(cursor.BuildID)))
+	}
+
+	stmt := "SELECT b.build_id, b.id, b.name, b.job, b.status, b.start_time, b.end_time, b.duration, \n" +
+		" COALESCE(c.state, '') \n" +
+		" FROM ale_builds b LEFT JOIN ale_crawls c ON c.build_id = b.build_id"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += fmt.Sprintf(" ORDER BY b.start_time %s, b.build_id %s", order, order)
+	if query.Limit > 0 {
+		// One extra row tells whether there is a next page
+		stmt += " LIMIT " + arg(query.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		logrus.WithError(err).Error("error listing builds")
+		return nil, err
+	}
+	defer rows.Close()
+	list := &ale.BuildList{Builds: []*ale.BuildSummary{}}
+	for rows.Next() {
+		var build ale.BuildSummary
+		err := rows.Scan(&build.BuildID, &build.ID, &build.Name, &build.Job, &build.Status,
+			&build.StartTime, &build.EndTime, &build.Duration, &build.CrawlState)
+		if err != nil {
+			return nil, err
+		}
+		list.Builds = append(list.Builds, &build)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if query.Limit > 0 && len(list.Builds) > query.Limit {
+		list.Builds = list.Builds[:query.Limit]
+		list.NextCursor = db.EncodeCursor(list.Builds[query.Limit-1])
+	}
+	return list, nil
+}
+
+// Search finds the builds with log lines containing every word of the query
+func (s *Store) Search(ctx context.Context, query *ale.SearchQuery) (*ale.SearchResult, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	stmt := "SELECT b.build_id, b.name, b.job, b.status, b.start_time FROM ale_builds b \n" +
+		" WHERE EXISTS (SELECT 1 FROM ale_log_lines l WHERE l.build_id = b.build_id \n" +
+		" AND " + s.dialect.MatchLine(arg, query.Query) + ")"
+	if query.Job != "" {
+		stmt += " AND b.job = " + arg(query.Job)
+	}
+	stmt += " ORDER BY b.start_time DESC, b.build_id"
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		logrus.WithError(err).Error("error searching logs")
+		return nil, err
+	}
+	var candidates []*ale.SearchHit
+	for rows.Next() {
+		var hit ale.SearchHit
+		if err := rows.Scan(&hit.BuildID, &hit.Name, &hit.Job, &hit.Status, &hit.StartTime); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, &hit)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	terms := db.SearchTerms(query.Query)
+	result := &ale.SearchResult{Query: query.Query, Builds: []*ale.SearchHit{}}
+	for _, hit := range candidates {
+		if err := s.searchBuildLines(ctx, hit, query.Query, terms); err != nil {
+			return nil, err
+		}
+		if len(hit.Matches) == 0 {
+			continue
+		}
+		result.Builds = append(result.Builds, hit)
+		if query.Limit > 0 && len(result.Builds) == query.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Stages lists the stages of a build, without reading their log lines
+func (s *Store) Stages(ctx context.Context, buildID string) ([]*ale.StageInfo, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	rows, err := getStages(ctx, s.db, buildID)
+	if err != nil {
+		return nil, err
+	}
+	return db.StageInfos(rows), nil
+}
+
+// StageLog reads the lines from and to of the log of a stage, leaving the
+// other stages of the build alone
+func (s *Store) StageLog(ctx context.Context, buildID string, index, from, to int) (*ale.StageLog, error) {
+	ctx, cancel := s.timeouts.ReadContext(ctx)
+	defer cancel()
+	rows, err := getStages(ctx, s.db, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(rows) {
+		return nil, db.ErrStageNotFound
+	}
+	stage := db.StageInfos(rows)[index]
+	from, to = db.LineRange(from, to, stage.Lines)
+	lines, err := getLogLines(ctx, s.db, buildID, rows[index].Key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &ale.StageLog{BuildID: buildID, Stage: stage, From: from, To: to, Lines: lines}, nil
+}
+
+// RemoveBuilds deletes the builds, with their stages, log lines and crawl records
+func (s *Store) RemoveBuilds(ctx context.Context, buildIDs []string) (int, error) {
+	ctx, cancel := s.timeouts.WriteContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	removed := 0
+	for start := 0; start < len(buildIDs); start += removeBatchSize {
+		end := start + removeBatchSize
+		if end > len(buildIDs) {
+			end = len(buildIDs)
+		}
+		args := make([]interface{}, 0, end-start)
+		placeholders := make([]string, 0, end-start)
+		for _, buildID := range buildIDs[start:end] {
+			args = append(args, buildID)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		in := "(" + strings.Join(placeholders, ", ") + ")"
+		result, err := tx.ExecContext(ctx, "DELETE FROM ale_builds WHERE build_id IN "+in, args...)
+		if err != nil {
+			return 0, err
+		}
+		count, _ := result.RowsAffected()
+		removed += int(count)
+		if _, err := tx.ExecContext(ctx, "DELETE FROM ale_crawls WHERE build_id IN "+in, args...); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	logrus.
+		WithField("count", removed).
+		Info("deleted builds from database")
+	return removed, nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/alde/ale"
+)
+
+// ErrStageNotFound is returned when a build has no stage with the requested index
+var ErrStageNotFound = errors.New("stage not found")
+
+// StageReader is implemented by the backends able to read the stages of a
+// build, or a range of the log of one, without loading the whole build
+type StageReader interface {
+	Stages(ctx context.Context, buildID string) ([]*ale.StageInfo, error)
+	StageLog(ctx context.Context, buildID string, index, from, to int) (*ale.StageLog, error)
+}
+
+// StageRow is a stage of a build, flattened out of the stage tree for the
+// backends storing one row per stage. Logs are left to the caller.
+type StageRow struct {
+	Key       string
+	ParentKey string
+	Position  int
+	Lines     int
+	Stage     *ale.JenkinsStage
+}
+
+// FlattenStages lists the stages of a build in pre-order. Stages are keyed by
+// their flow node ID, which stays the same across polls, or by their place in
+// the tree when they have none.
+func FlattenStages(stages []*ale.JenkinsStage) []*StageRow {
+	var rows []*StageRow
+	seen := make(map[string]bool)
+	var walk func(stages []*ale.JenkinsStage, parentKey string, path string)
+	walk = func(stages []*ale.JenkinsStage, parentKey string, path string) {
+		for i, stage := range stages {
+			position := path + strconv.Itoa(i)
+			key := stage.ID
+			if key == "" || seen[key] {
+				key = "#" + position
+			}
+			seen[key] = true
+			rows = append(rows, &StageRow{
+				Key:       key,
+				ParentKey: parentKey,
+				Position:  len(rows),
+				Lines:     len(stage.Logs),
+				Stage:     stage,
+			})
+			walk(stage.SubStages, key, position+".")
+		}
+	}
+	walk(stages, "", "")
+	return rows
+}
+
+// StageTree rebuilds the stage tree from rows sorted by position
+func StageTree(rows []*StageRow) []*ale.JenkinsStage {
+	var stages []*ale.JenkinsStage
+	byKey := make(map[string]*ale.JenkinsStage, len(rows))
+	for _, row := range rows {
+		byKey[row.Key] = row.Stage
+		parent, ok := byKey[row.ParentKey]
+		if row.ParentKey == "" || !ok {
+			stages = append(stages, row.Stage)
+			continue
+		}
+		parent.SubStages = append(parent.SubStages, row.Stage)
+	}
+	return stages
+}
+
+// StageInfos describes the stages of rows sorted by position, naming each of
+// them by its path in the tree
+func StageInfos(rows []*StageRow) []*ale.StageInfo {
+	infos := make([]*ale.StageInfo, 0, len(rows))
+	byKey := make(map[string]*ale.StageInfo, len(rows))
+	for i, row := range rows {
+		stage := row.Stage
+		info := &ale.StageInfo{
+			Index:       i,
+			ID:          stage.ID,
+			Name:        stage.Name,
+			Path:        stage.Name,
+			Branch:      stage.Branch,
+			Status:      stage.Status,
+			StartTime:   stage.StartTime,
+			Duration:    stage.Duration,
+			Task:        stage.Task,
+			Description: stage.Description,
+			LogLength:   stage.LogLength,
+			Lines:       row.Lines,
+		}
+		if parent, ok := byKey[row.ParentKey]; ok && row.ParentKey != "" {
+			info.Path = parent.Path + " / " + stage.Name
+			info.Parent = &parent.Index
+		}
+		byKey[row.Key] = info
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// LineRange bounds the lines from and to, numbered from 1, to a log of the
+// given number of lines. A to of 0 stands for the last line.
+func LineRange(from, to, lines int) (int, int) {
+	if from < 1 {
+		from = 1
+	}
+	if to < 1 || to > lines {
+		to = lines
+	}
+	return from, to
+}
+
+// Stages lists the stages of a build, without reading their logs when the
+// database allows it
+func Stages(ctx context.Context, database Database, buildID string) ([]*ale.StageInfo, error) {
+	if reader, ok := database.(StageReader); ok {
+		return reader.Stages(ctx, buildID)
+	}
+	data, err := database.Get(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	return StageInfos(FlattenStages(data.Stages)), nil
+}
+
+// StageLog reads the lines from and to of the log of the stage with the given
+// index, without reading the rest of the build when the database allows it
+func StageLog(ctx context.Context, database Database, buildID string, index, from, to int) (*ale.StageLog, error) {
+	if reader, ok := database.(StageReader); ok {
+		return reader.StageLog(ctx, buildID, index, from, to)
+	}
+	data, err := database.Get(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	rows := FlattenStages(data.Stages)
+	if index < 0 || index >= len(rows) {
+		return nil, ErrStageNotFound
+	}
+	stage := StageInfos(rows)[index]
+	from, to = LineRange(from, to, stage.Lines)
+	log := &ale.StageLog{BuildID: buildID, Stage: stage, From: from, To: to, Lines: []*ale.LogLine{}}
+	for i := from; i <= to; i++ {
+		line := rows[index].Stage.Logs[i-1]
+		log.Lines = append(log.Lines, &ale.LogLine{Number: i, TimeStamp: line.TimeStamp, Line: line.Line})
+	}
+	return log, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/mock"
+)
+
+func Test_FlattenStages(t *testing.T) {
+	stages := []*ale.JenkinsStage{
+		{ID: "6", Name: "Build"},
+		{ID: "9", Name: "Test", SubStages: []*ale.JenkinsStage{
+			{ID: "12", Name: "unit"},
+			{Name: "lint"},
+		}},
+	}
+	rows := FlattenStages(stages)
+
+	var keys, parents []string
+	for i, row := range rows {
+		assert.Equal(t, i, row.Position)
+		keys = append(keys, row.Key)
+		parents = append(parents, row.ParentKey)
+	}
+	assert.Equal(t, []string{"6", "9", "12", "#1.1"}, keys)
+	assert.Equal(t, []string{"", "", "9", "9"}, parents)
+}
+
+func Test_StageTreeRestoresFlattenedStages(t *testing.T) {
+	stages := []*ale.JenkinsStage{
+		{ID: "6", Name: "Build"},
+		{ID: "9", Name: "Test", SubStages: []*ale.JenkinsStage{
+			{ID: "12", Name: "unit", Branch: "unit"},
+			{ID: "12", Name: "duplicate"},
+		}},
+	}
+	var rows []*StageRow
+	for _, row := range FlattenStages(stages) {
+		copied := *row.Stage
+		copied.SubStages = nil
+		rows = append(rows, &StageRow{Key: row.Key, ParentKey: row.ParentKey, Position: row.Position, Stage: &copied})
+	}
+
+	assert.Equal(t, stages, StageTree(rows))
+}
+
+func stagedBuild() *mock.DB {
+	return &mock.DB{Memory: map[string]*ale.JenkinsData{
+		"staged": {Stages: []*ale.JenkinsStage{
+			{ID: "6", Name: "Build", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}, {Line: "three"}}},
+			{ID: "9", Name: "Test", SubStages: []*ale.JenkinsStage{
+				{ID: "12", Name: "unit", Logs: []*ale.Log{{TimeStamp: "10:00:00", Line: "ok"}}},
+			}},
+		}},
+	}}
+}
+
+func Test_Stages(t *testing.T) {
+	stages, err := Stages(context.Background(), stagedBuild(), "staged")
+	assert.Nil(t, err)
+	assert.Len(t, stages, 3)
+	assert.Equal(t, "Test / unit", stages[2].Path)
+	assert.Equal(t, 1, *stages[2].Parent)
+	assert.Nil(t, stages[0].Parent)
+	assert.Equal(t, 3, stages[0].Lines)
+
+	_, err = Stages(context.Background(), stagedBuild(), "missing")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func Test_StageLog(t *testing.T) {
+	log, err := StageLog(context.Background(), stagedBuild(), "staged", 0, 2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, log.From)
+	assert.Equal(t, 3, log.To)
+	assert.Equal(t, []*ale.LogLine{{Number: 2, Line: "two"}, {Number: 3, Line: "three"}}, log.Lines)
+
+	log, err = StageLog(context.Background(), stagedBuild(), "staged", 2, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "10:00:00", log.Lines[0].TimeStamp)
+
+	log, err = StageLog(context.Background(), stagedBuild(), "staged", 0, 5, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, log.Lines)
+
+	_, err = StageLog(context.Background(), stagedBuild(), "staged", 3, 0, 0)
+	assert.Equal(t, ErrStageNotFound, err)
+}
@@ -0,0 +1,6 @@
+package ale
+
+import "errors"
+
+// ErrNotFound is returned when the requested entry does not exist
+var ErrNotFound = errors.New("not found")
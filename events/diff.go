@@ -0,0 +1,98 @@
+package events
+
+import (
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+)
+
+// The names of the events describing the progress of a build
+const (
+	// EventBuild carries a BuildStatus whenever the status of the build changes
+	EventBuild = "build"
+	// EventStage carries the StageInfo of a stage which appeared or changed
+	EventStage = "stage"
+	// EventLog carries the StageLines added to the log of a stage
+	EventLog = "log"
+	// EventEnd carries the BuildStatus of the build once its crawl is over
+	EventEnd = "end"
+)
+
+// Event is a change to a build
+type Event struct {
+	Name string
+	Data interface{}
+}
+
+// BuildStatus describes a build, without its stages
+type BuildStatus struct {
+	BuildID    string `json:"build_id"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	CrawlState string `json:"crawl_state,omitempty"`
+	StartTime  int    `json:"start_time"`
+	EndTime    int    `json:"end_time"`
+	Duration   int    `json:"build_duration"`
+}
+
+// StageLines holds the lines added to the log of a stage
+type StageLines struct {
+	Index int            `json:"index"`
+	Path  string         `json:"path"`
+	Lines []*ale.LogLine `json:"lines"`
+}
+
+// Status describes the build of the update
+func Status(buildID string, data *ale.JenkinsData, state string) *BuildStatus {
+	status := &BuildStatus{BuildID: buildID, CrawlState: state}
+	if data != nil {
+		status.ID = data.ID
+		status.Name = data.Name
+		status.Status = data.Status
+		status.StartTime = data.StartTime
+		status.EndTime = data.EndTime
+		status.Duration = data.Duration
+	}
+	return status
+}
+
+// Diff lists the events leading from the previous state of a build to the
+// current one. Stages are matched by the keys they are stored under, so
+// without a previous state every stage and line is new.
+func Diff(buildID string, previous, current *ale.JenkinsData) []*Event {
+	if current == nil {
+		return nil
+	}
+	var events []*Event
+	if previous == nil || previous.Status != current.Status || previous.Name != current.Name {
+		events = append(events, &Event{Name: EventBuild, Data: Status(buildID, current, "")})
+	}
+
+	known := make(map[string]*ale.JenkinsStage)
+	if previous != nil {
+		for _, row := range db.FlattenStages(previous.Stages) {
+			known[row.Key] = row.Stage
+		}
+	}
+	rows := db.FlattenStages(current.Stages)
+	for i, info := range db.StageInfos(rows) {
+		stage := rows[i].Stage
+		before, ok := known[rows[i].Key]
+		if !ok || before.Status != stage.Status || before.Duration != stage.Duration {
+			events = append(events, &Event{Name: EventStage, Data: info})
+		}
+		from := 0
+		if ok && len(before.Logs) <= len(stage.Logs) {
+			from = len(before.Logs)
+		}
+		if from == len(stage.Logs) {
+			continue
+		}
+		lines := make([]*ale.LogLine, 0, len(stage.Logs)-from)
+		for n, log := range stage.Logs[from:] {
+			lines = append(lines, &ale.LogLine{Number: from + n + 1, TimeStamp: log.TimeStamp, Line: log.Line})
+		}
+		events = append(events, &Event{Name: EventLog, Data: &StageLines{Index: info.Index, Path: info.Path, Lines: lines}})
+	}
+	return events
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+)
+
+func names(events []*Event) []string {
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Name)
+	}
+	return names
+}
+
+func Test_DiffWithoutPreviousState(t *testing.T) {
+	current := &ale.JenkinsData{Status: "IN_PROGRESS", Stages: []*ale.JenkinsStage{
+		{ID: "6", Name: "Build", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}}},
+	}}
+
+	events := Diff("1", nil, current)
+	assert.Equal(t, []string{EventBuild, EventStage, EventLog}, names(events))
+	assert.Equal(t, "IN_PROGRESS", events[0].Data.(*BuildStatus).Status)
+	assert.Equal(t, []*ale.LogLine{{Number: 1, Line: "one"}}, events[2].Data.(*StageLines).Lines)
+	assert.Nil(t, Diff("1", nil, nil))
+}
+
+func Test_DiffSendsWhatChanged(t *testing.T) {
+	previous := &ale.JenkinsData{Status: "IN_PROGRESS", Stages: []*ale.JenkinsStage{
+		{ID: "6", Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{Line: "compiled"}}},
+		{ID: "9", Name: "Test", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}}},
+	}}
+	current := &ale.JenkinsData{Status: "IN_PROGRESS", Stages: []*ale.JenkinsStage{
+		{ID: "6", Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{Line: "compiled"}}},
+		{ID: "9", Name: "Test", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}}},
+		{ID: "12", Name: "Deploy", Status: "IN_PROGRESS"},
+	}}
+
+	events := Diff("1", previous, current)
+	assert.Equal(t, []string{EventLog, EventStage}, names(events))
+	lines := events[0].Data.(*StageLines)
+	assert.Equal(t, "Test", lines.Path)
+	assert.Equal(t, []*ale.LogLine{{Number: 2, Line: "two"}}, lines.Lines)
+	assert.Equal(t, "Deploy", events[1].Data.(*ale.StageInfo).Name)
+
+	finished := *current
+	finished.Status = "SUCCESS"
+	assert.Equal(t, []string{EventBuild}, names(Diff("1", current, &finished)))
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/alde/ale"
+)
+
+// Update is a snapshot of a build, published by the crawler after every poll
+type Update struct {
+	BuildID string
+	// Build is nil when the crawl ended before anything could be stored
+	Build *ale.JenkinsData
+	// State is the state of the crawl, such as CRAWLING or FINISHED
+	State string
+}
+
+// Final reports whether the crawl is over, so that no update will follow
+func (u *Update) Final() bool {
+	return IsFinal(u.State)
+}
+
+// IsFinal reports whether no update will follow a crawl in the given state
+func IsFinal(state string) bool {
+	return state != ale.CrawlQueued && state != ale.CrawlRunning
+}
+
+// Hub fans the updates of the builds out to their subscribers
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*Subscription]bool
+}
+
+// NewHub creates a hub without subscribers
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[string]map[*Subscription]bool)}
+}
+
+// Subscribe starts receiving the updates published for the build. The
+// subscription must be closed once done with.
+func (h *Hub) Subscribe(buildID string) *Subscription {
+	s := &Subscription{
+		hub:     h,
+		buildID: buildID,
+		ready:   make(chan struct{}, 1),
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers[buildID] == nil {
+		h.subscribers[buildID] = make(map[*Subscription]bool)
+	}
+	h.subscribers[buildID][s] = true
+	return s
+}
+
+// Publish hands the update to the subscribers of its build, without waiting
+// for them to receive it
+func (h *Hub) Publish(update *Update) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for s := range h.subscribers[update.BuildID] {
+		s.offer(update)
+	}
+}
+
+// Subscribers counts the subscriptions to the updates of the build
+func (h *Hub) Subscribers(buildID string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscribers[buildID])
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers[s.buildID], s)
+	if len(h.subscribers[s.buildID]) == 0 {
+		delete(h.subscribers, s.buildID)
+	}
+}
+
+// Subscription receives the updates of a build. As every update holds the
+// whole build, one that wasn't received before the next was published is
+// replaced by it, so that slow subscribers never hold up the crawler.
+type Subscription struct {
+	hub     *Hub
+	buildID string
+	mutex   sync.Mutex
+	latest  *Update
+	final   bool
+	ready   chan struct{}
+}
+
+func (s *Subscription) offer(update *Update) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.final {
+		return
+	}
+	s.latest = update
+	s.final = update.Final()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready receives a value whenever an update is waiting to be taken by Next
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Next takes the latest update published, or nil if there is none
+func (s *Subscription) Next() *Update {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update := s.latest
+	s.latest = nil
+	return update
+}
+
+// Close stops receiving updates
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+)
+
+func Test_HubPublishesToSubscribersOfTheBuild(t *testing.T) {
+	hub := NewHub()
+	subscription := hub.Subscribe("1")
+	other := hub.Subscribe("2")
+
+	hub.Publish(&Update{BuildID: "1", State: ale.CrawlRunning})
+	select {
+	case <-subscription.Ready():
+	default:
+		t.Fatal("expected an update to be ready")
+	}
+	assert.Equal(t, ale.CrawlRunning, subscription.Next().State)
+	assert.Nil(t, subscription.Next())
+	assert.Nil(t, other.Next())
+
+	subscription.Close()
+	other.Close()
+	assert.Equal(t, 0, hub.Subscribers("1"))
+	hub.Publish(&Update{BuildID: "1", State: ale.CrawlRunning})
+}
+
+func Test_SubscriptionKeepsTheLatestUpdate(t *testing.T) {
+	hub := NewHub()
+	subscription := hub.Subscribe("1")
+	defer subscription.Close()
+
+	hub.Publish(&Update{BuildID: "1", State: ale.CrawlRunning, Build: &ale.JenkinsData{Status: "IN_PROGRESS"}})
+	hub.Publish(&Update{BuildID: "1", State: ale.CrawlFinished, Build: &ale.JenkinsData{Status: "SUCCESS"}})
+	hub.Publish(&Update{BuildID: "1", State: ale.CrawlRunning})
+
+	update := subscription.Next()
+	assert.True(t, update.Final())
+	assert.Equal(t, "SUCCESS", update.Build.Status, "nothing follows a final update")
+}
+
+func Test_IsFinal(t *testing.T) {
+	assert.False(t, IsFinal(ale.CrawlQueued))
+	assert.False(t, IsFinal(ale.CrawlRunning))
+	assert.True(t, IsFinal(ale.CrawlFinished))
+	assert.True(t, IsFinal(ale.CrawlTimeout))
+	assert.True(t, IsFinal(ale.CrawlFailed))
+}
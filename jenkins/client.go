@@ -0,0 +1,271 @@
+package jenkins
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/retry"
+)
+
+// Client is an HTTP client applying the configured credentials of each Jenkins host
+type Client struct {
+	hosts    []*host
+	fallback *http.Client
+}
+
+type host struct {
+	scheme string
+	host   string
+	// path is the folder of the configured url, without a trailing slash
+	path     string
+	username string
+	token    string
+	client   *http.Client
+}
+
+// NewClient creates a Client from the [[jenkins]] sections of the config
+func NewClient(cfg *config.Config) (*Client, error) {
+	timeout := cfg.Crawler.RequestTimeout.Duration
+	c := &Client{
+		fallback: &http.Client{Timeout: timeout},
+	}
+	for _, jc := range cfg.Jenkins {
+		h, err := newHost(jc, timeout)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"host":     jc.Host,
+			"username": jc.Username,
+		}).Info("configured jenkins credentials")
+		c.hosts = append(c.hosts, h)
+	}
+	// The most specific path should win when several hosts match
+	sort.Slice(c.hosts, func(i, j int) bool {
+		return len(c.hosts[i].path) > len(c.hosts[j].path)
+	})
+	return c, nil
+}
+
+func newHost(jc config.JenkinsConf, timeout time.Duration) (*host, error) {
+	if jc.Host == "" {
+		return nil, fmt.Errorf("jenkins config is missing host")
+	}
+	base, err := url.Parse(jc.Host)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("jenkins host %s is not an absolute url", jc.Host)
+	}
+	tlsConfig := &tls.Config{}
+	if jc.CACert != "" {
+		pem, err := ioutil.ReadFile(jc.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca bundle for %s: %v", jc.Host, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle for %s", jc.Host)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if jc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(jc.ClientCert, jc.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate for %s: %v", jc.Host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &host{
+		scheme:   strings.ToLower(base.Scheme),
+		host:     strings.ToLower(base.Host),
+		path:     strings.TrimRight(base.Path, "/"),
+		username: jc.Username,
+		token:    readTokenFile(jc.TokenFile),
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func readTokenFile(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	token, err := ioutil.ReadFile(filename)
+	if err != nil {
+		logrus.WithError(err).WithField("file", filename).Warn("unable to read jenkins token file")
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
+
+// hostFor finds the configured host the uri belongs to. Scheme and host must
+// be equal, and the path must be within the configured one, so that neither
+// jenkins.local.evil.com nor jenkins.local@evil.com get the credentials of
+// jenkins.local.
+func (c *Client) hostFor(uri string) *host {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	for _, h := range c.hosts {
+		if h.matches(u) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (h *host) matches(u *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, h.scheme) || !strings.EqualFold(u.Host, h.host) {
+		return false
+	}
+	return h.path == "" || u.Path == h.path || strings.HasPrefix(u.Path, h.path+"/")
+}
+
+// Do sends the request using the client and credentials configured for its host
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	h := c.hostFor(req.URL.String())
+	if h == nil {
+		return c.fallback.Do(req)
+	}
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.token)
+	}
+	return h.client.Do(req)
+}
+
+// Get issues a GET to the given uri
+func (c *Client) Get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Head issues a HEAD to the given uri
+func (c *Client) Head(uri string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// StatusError is returned when Jenkins responds with an unexpected status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.StatusCode, e.URL)
+}
+
+// IsPermanent reports whether retrying the request that caused err is pointless,
+// such as when the build doesn't exist or access to it is forbidden
+func IsPermanent(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return retry.Permanent(se.StatusCode)
+}
+
+// fetcher retries requests to Jenkins which failed for transient reasons
+type fetcher struct {
+	client  HTTPGetter
+	retries int
+	backoff time.Duration
+}
+
+func newFetcher(client HTTPGetter, cfg *config.Config) *fetcher {
+	return &fetcher{
+		client:  client,
+		retries: cfg.Crawler.Retries,
+		backoff: cfg.Crawler.RetryBackoff.Duration,
+	}
+}
+
+// fetch returns the body and headers of a successful response, retrying
+// connection failures and 5xx responses with a jittered exponential backoff
+// until ctx is done
+func (f *fetcher) fetch(ctx context.Context, uri string) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		body, header, err := f.fetchOnce(ctx, uri)
+		if err == nil || IsPermanent(err) || attempt >= f.retries {
+			return body, header, err
+		}
+		delay := retry.Jitter(f.backoff << uint(attempt))
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"url":     uri,
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Warn("request to jenkins failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// httpDoer is implemented by clients able to send requests bound to a
+// context, such as Client and http.Client
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func (f *fetcher) fetchOnce(ctx context.Context, uri string) ([]byte, http.Header, error) {
+	var resp *http.Response
+	var err error
+	if doer, ok := f.client.(httpDoer); ok {
+		req, rerr := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		resp, err = doer.Do(req)
+	} else {
+		resp, err = f.client.Get(uri)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, nil, &StatusError{URL: uri, StatusCode: resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Header, nil
+}
+
+// fetchJSON fetches uri and unmarshals the response into v
+func (f *fetcher) fetchJSON(ctx context.Context, uri string, v interface{}) error {
+	body, _, err := f.fetch(ctx, uri)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to parse response from %s: %v", uri, err)
+	}
+	return nil
+}
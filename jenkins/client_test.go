@@ -0,0 +1,197 @@
+package jenkins
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+)
+
+func Test_ClientAppliesCredentials(t *testing.T) {
+	var user, pass string
+	var ok bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok = r.BasicAuth()
+	}))
+	defer ts.Close()
+
+	file, _ := ioutil.TempFile(os.TempDir(), "token")
+	defer os.Remove(file.Name())
+	file.WriteString("s3cr3t\n")
+
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{
+		{Host: ts.URL, Username: "ale", TokenFile: file.Name()},
+	}
+	client, err := NewClient(cfg)
+	assert.Nil(t, err)
+
+	_, err = client.Get(ts.URL + "/job/foo/1/wfapi/describe")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ale", user)
+	assert.Equal(t, "s3cr3t", pass)
+
+	_, err = client.Head(ts.URL + "/job/foo/1/")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_ClientWithoutMatchingHost(t *testing.T) {
+	var ok bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, ok = r.BasicAuth()
+	}))
+	defer ts.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{
+		{Host: "https://jenkins.local/", Username: "ale"},
+	}
+	client, _ := NewClient(cfg)
+
+	_, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func Test_ClientPrefersLongestPrefix(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{
+		{Host: "https://jenkins.local/", Username: "generic"},
+		{Host: "https://jenkins.local/job/team/", Username: "team"},
+	}
+	client, _ := NewClient(cfg)
+
+	assert.Equal(t, "team", client.hostFor("https://jenkins.local/job/team/job/foo/1/").username)
+	assert.Equal(t, "generic", client.hostFor("https://jenkins.local/job/other/1/").username)
+	assert.Nil(t, client.hostFor("https://elsewhere.local/job/other/1/"))
+	assert.Equal(t, "generic", client.hostFor("https://jenkins.local/job/teamwork/1/").username)
+}
+
+func Test_ClientMatchesHostExactly(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{
+		{Host: "https://jenkins.local", Username: "ale"},
+	}
+	client, _ := NewClient(cfg)
+
+	assert.NotNil(t, client.hostFor("https://jenkins.local/job/foo/1/"))
+	assert.NotNil(t, client.hostFor("https://JENKINS.local/job/foo/1/"))
+	assert.Nil(t, client.hostFor("https://jenkins.local.evil.com/job/foo/1/"))
+	assert.Nil(t, client.hostFor("https://jenkins.local@evil.com/job/foo/1/"))
+	assert.Nil(t, client.hostFor("http://jenkins.local/job/foo/1/"))
+	assert.Nil(t, client.hostFor("https://jenkins.local:8443/job/foo/1/"))
+}
+
+func Test_NewClientInvalidHost(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{{Host: "jenkins.local"}}
+	_, err := NewClient(cfg)
+	assert.NotNil(t, err)
+}
+
+func Test_NewClientInvalidCA(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Jenkins = []config.JenkinsConf{
+		{Host: "https://jenkins.local/", CACert: "/does/not/exist.pem"},
+	}
+	_, err := NewClient(cfg)
+	assert.NotNil(t, err)
+}
+
+func Test_FetcherRetriesTransientFailures(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer ts.Close()
+
+	f := &fetcher{client: http.DefaultClient, retries: 3, backoff: time.Millisecond}
+	var jd ale.JobData
+	err := f.fetchJSON(ctx, ts.URL, &jd)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "SUCCESS", jd.Status)
+}
+
+func Test_FetcherGivesUp(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	f := &fetcher{client: http.DefaultClient, retries: 2, backoff: time.Millisecond}
+	_, _, err := f.fetch(ctx, ts.URL)
+
+	assert.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
+	assert.Equal(t, 3, calls)
+}
+
+func Test_FetcherStopsWithTheContext(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	cancelled, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+
+	f := &fetcher{client: http.DefaultClient, retries: 3, backoff: time.Hour}
+	started := time.Now()
+	_, _, err := f.fetch(cancelled, ts.URL)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, calls)
+	assert.True(t, time.Since(started) < time.Second, "the backoff must not outlast the context")
+
+	_, _, err = f.fetch(cancelled, ts.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls, "no request is sent once the context is done")
+}
+
+func Test_FetcherDoesNotRetryPermanentFailures(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(status)
+		}))
+
+		f := &fetcher{client: http.DefaultClient, retries: 3, backoff: time.Millisecond}
+		_, _, err := f.fetch(ctx, ts.URL)
+		ts.Close()
+
+		assert.True(t, IsPermanent(err))
+		assert.Equal(t, 1, calls)
+	}
+}
+
+func Test_FetcherRejectsHTML(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>Please log in</body></html>`))
+	}))
+	defer ts.Close()
+
+	f := &fetcher{client: http.DefaultClient}
+	var jd ale.JobData
+	assert.NotNil(t, f.fetchJSON(ctx, ts.URL, &jd))
+}
@@ -1,33 +1,36 @@
 package jenkins
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/alde/ale"
+	"github.com/alde/ale/callback"
 	"github.com/alde/ale/config"
 	"github.com/alde/ale/db"
+	"github.com/alde/ale/events"
 )
 
 // Crawler struct holds various attributes needed by the crawler
 type Crawler struct {
-	database       db.Database
-	config         *config.Config
-	processChannel chan string
-	stateChannel   chan *ale.JenkinsData
-	logChannel     chan []*ale.Log
-	httpClient     HTTPGetter
-	r              *regexp.Regexp
-	log            *logrus.Logger
+	workflow   *bool
+	database   db.Database
+	config     *config.Config
+	httpClient HTTPGetter
+	fetcher    *fetcher
+	r          *regexp.Regexp
+	log        *logrus.Logger
+	updates    *events.Hub
+	notifier   *callback.Notifier
 }
 
 // HTTPGetter is an interface only requiring Get from http.Client
@@ -36,44 +39,148 @@ type HTTPGetter interface {
 }
 
 // NewCrawler instatiates a new crawler
-func NewCrawler(db db.Database, conf *config.Config) *Crawler {
+func NewCrawler(db db.Database, conf *config.Config, client HTTPGetter) *Crawler {
 	r, err := regexp.Compile(conf.Crawler.LogPattern)
 	if err != nil {
 		logrus.WithError(err).Fatal("unable to create log matcher")
 	}
 	return &Crawler{
-		database:       db,
-		config:         conf,
-		processChannel: make(chan string, 1),
-		stateChannel:   make(chan *ale.JenkinsData, 1),
-		logChannel:     make(chan []*ale.Log, 1),
-		httpClient:     http.DefaultClient,
-		r:              r,
-		log:            logrus.New(),
+		database:   db,
+		config:     conf,
+		httpClient: client,
+		fetcher:    newFetcher(client, conf),
+		r:          r,
+		log:        logrus.New(),
 	}
 }
 
-// CrawlJenkins initiates the crawler
-func (c *Crawler) CrawlJenkins(buildURI string, buildID string) {
-	uri0 := strings.Join([]string{strings.TrimRight(buildURI, "/"), "wfapi", "describe"}, "/")
+// CrawlJenkins polls the build until Jenkins reports a final status. The
+// polls share a deadline of the maximum crawl duration, past which the build
+// is stored as timed out. A crawl stopped by cancelling ctx is left pending.
+func (c *Crawler) CrawlJenkins(ctx context.Context, buildURI string, buildID string) {
+	base := strings.TrimRight(buildURI, "/")
+	uri0 := strings.Join([]string{base, "wfapi", "describe"}, "/")
 	uri, _ := url.Parse(uri0)
+	c.workflow = nil
+	var started time.Time
+	c.recordCrawl(ctx, buildID, func(crawl *ale.Crawl) {
+		crawl.BuildURL = buildURI
+		started = crawl.Created
+	})
+	if started.IsZero() {
+		started = time.Now()
+	}
+	maxDuration := c.config.Crawler.MaxDuration.Duration
+	interval := c.config.Crawler.PollInterval.Duration
+	pollCtx := ctx
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithDeadline(ctx, started.Add(maxDuration))
+		defer cancel()
+	}
 
-	go c.updateState(buildID)
-	go c.crawlBuild(uri)
-	go c.logBuildLogs(buildID, uri)
-
-	c.processChannel <- buildID
-}
-
-func (c *Crawler) logBuildLogs(buildID string, uri *url.URL) {
+	// Polls continue from the state of the previous one, which is only loaded
+	// from the database when resuming a crawl that stored something already
+	previous := c.previousState(ctx, buildID)
+	// The deadline only bounds the requests to Jenkins, the database is
+	// written with ctx so that the final state is stored once it's reached
 	for {
+		c.recordCrawl(ctx, buildID, func(crawl *ale.Crawl) {
+			crawl.State = ale.CrawlRunning
+			crawl.Attempts++
+			crawl.LastPoll = time.Now()
+		})
+		jdata, err := c.crawlBuild(pollCtx, base, uri, buildID, previous)
+		if ctx.Err() != nil {
+			logrus.WithField("build_id", buildID).Warn("crawl cancelled, leaving it to be resumed")
+			return
+		}
+		if err != nil && pollCtx.Err() != nil {
+			c.timeout(ctx, buildID, previous)
+			return
+		}
+		if err != nil {
+			permanent := IsPermanent(err)
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"build_id":  buildID,
+				"permanent": permanent,
+			}).Error("unable to crawl build")
+			crawl := c.recordCrawl(ctx, buildID, func(crawl *ale.Crawl) {
+				crawl.LastError = err.Error()
+				if permanent {
+					crawl.State = ale.CrawlFailed
+				}
+			})
+			if permanent {
+				c.publish(buildID, nil, ale.CrawlFailed)
+				c.notify(crawl)
+				return
+			}
+		} else if c.updateState(ctx, buildID, jdata) {
+			c.logBuildLogs(buildID, uri, c.extractBuildLogs(jdata))
+			return
+		} else {
+			previous = jdata
+		}
+		if maxDuration > 0 && time.Since(started) > maxDuration {
+			c.timeout(ctx, buildID, previous)
+			return
+		}
+		logrus.WithField("interval", interval).Debug("sleeping before requerying")
 		select {
-		case jlogs := <-c.logChannel:
-			logrus.Debug("got request to log the jenkins build logs")
-			for _, jlog := range jlogs {
-				c.printBuildLog(jlog, uri, buildID)
+		case <-time.After(interval):
+		case <-pollCtx.Done():
+			if ctx.Err() != nil {
+				logrus.WithField("build_id", buildID).Warn("crawl cancelled, leaving it to be resumed")
+				return
 			}
+			c.timeout(ctx, buildID, previous)
+			return
 		}
+		interval = c.nextInterval(interval)
+	}
+}
+
+// nextInterval backs off the polling interval, up to the configured maximum
+func (c *Crawler) nextInterval(interval time.Duration) time.Duration {
+	next := time.Duration(float64(interval) * c.config.Crawler.Backoff)
+	if max := c.config.Crawler.MaxPollInterval.Duration; max > 0 && next > max {
+		return max
+	}
+	if next < interval {
+		return interval
+	}
+	return next
+}
+
+// timeout stores the last state of the build with a CRAWL_TIMEOUT status, as it didn't finish in time
+func (c *Crawler) timeout(ctx context.Context, buildID string, jdata *ale.JenkinsData) {
+	logrus.WithFields(logrus.Fields{
+		"build_id": buildID,
+	}).Warn("giving up on build which did not finish in time")
+	if jdata == nil {
+		jdata = &ale.JenkinsData{BuildID: buildID}
+	}
+	// The last poll may already have been published, so it's left untouched
+	timedOut := *jdata
+	jdata = &timedOut
+	jdata.Status = ale.CrawlTimeout
+	err := c.database.Put(ctx, jdata, buildID)
+	if err != nil {
+		logrus.WithField("build_id", buildID).WithError(err).Error("unable to add to database")
+	}
+	crawl := c.recordCrawl(ctx, buildID, func(crawl *ale.Crawl) {
+		crawl.State = ale.CrawlTimeout
+		crawl.LastError = "build did not finish within the maximum crawl duration"
+	})
+	c.publish(buildID, jdata, ale.CrawlTimeout)
+	c.notify(crawl)
+}
+
+func (c *Crawler) logBuildLogs(buildID string, uri *url.URL, jlogs []*ale.Log) {
+	logrus.Debug("logging the jenkins build logs")
+	for _, jlog := range jlogs {
+		c.printBuildLog(jlog, uri, buildID)
 	}
 }
 
@@ -86,12 +193,14 @@ func (c *Crawler) printBuildLog(jlog *ale.Log, uri *url.URL, buildID string) {
 }
 
 func (c *Crawler) extractBuildLogs(jdata *ale.JenkinsData) []*ale.Log {
+	return flattenLogs(jdata.Stages)
+}
+
+func flattenLogs(stages []*ale.JenkinsStage) []*ale.Log {
 	var jlogs []*ale.Log
-	for _, stage := range jdata.Stages {
+	for _, stage := range stages {
 		if stage.SubStages != nil && len(stage.SubStages) > 0 {
-			for _, substage := range stage.SubStages {
-				jlogs = append(jlogs, substage.Logs...)
-			}
+			jlogs = append(jlogs, flattenLogs(stage.SubStages)...)
 			continue
 		}
 		jlogs = append(jlogs, stage.Logs...)
@@ -99,122 +208,319 @@ func (c *Crawler) extractBuildLogs(jdata *ale.JenkinsData) []*ale.Log {
 	return jlogs
 }
 
-func (c *Crawler) updateState(buildID string) {
-	for {
-		select {
-		case jdata := <-c.stateChannel:
-			logrus.Debug("got request to update the state")
-			if err := c.database.Put(jdata, buildID); err != nil {
-				logrus.WithField("build_id", buildID).WithError(err).Error("unable to add to database")
-			}
-			logrus.WithField("build_id", buildID).Info("database updated")
-
-			if jdata.Status == "" || jdata.Status == "IN_PROGRESS" {
-				go func() {
-					logrus.Debug("sleeping for 5 seconds before requerying")
-					time.Sleep(5 * time.Second)
-					c.processChannel <- buildID
-				}()
-				continue
-			}
+// updateState stores the crawled data, and reports whether the build is finished
+func (c *Crawler) updateState(ctx context.Context, buildID string, jdata *ale.JenkinsData) bool {
+	err := c.database.Put(ctx, jdata, buildID)
+	if err != nil {
+		logrus.WithField("build_id", buildID).WithError(err).Error("unable to add to database")
+	} else {
+		logrus.WithField("build_id", buildID).Info("database updated")
+	}
+	finished := isFinished(jdata.Status)
+	state := ale.CrawlRunning
+	if finished {
+		state = ale.CrawlFinished
+	}
+	crawl := c.recordCrawl(ctx, buildID, func(crawl *ale.Crawl) {
+		crawl.JenkinsStatus = jdata.Status
+		crawl.LastError = errorString(err)
+		crawl.State = state
+	})
+	c.publish(buildID, jdata, state)
+	if finished {
+		logrus.WithFields(logrus.Fields{
+			"build_id": buildID,
+			"status":   jdata.Status,
+		}).Info("build finished")
+		c.notify(crawl)
+	}
+	return finished
+}
 
-			jlogs := c.extractBuildLogs(jdata)
-			logrus.Info("extracted jenkins build logs")
-			c.logChannel <- jlogs
-			logrus.Debug("build logs sent to logChannel")
+// crawlBuild polls the build once, continuing from the previous state, if any
+func (c *Crawler) crawlBuild(ctx context.Context, base string, uri *url.URL, buildID string, previous *ale.JenkinsData) (*ale.JenkinsData, error) {
+	if c.workflow == nil || !*c.workflow {
+		info, err := c.buildInfo(ctx, base)
+		if err != nil {
+			return nil, err
+		}
+		workflow := strings.HasSuffix(info.Class, ".WorkflowRun")
+		c.workflow = &workflow
+		if !workflow {
+			return c.crawlConsoleText(ctx, base, buildID, info)
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"uri":      uri.String(),
+		"build_id": buildID,
+	}).Info("crawling jenkins API")
+	jd := &ale.JobData{}
+	if err := c.fetcher.fetchJSON(ctx, uri.String(), jd); err != nil {
+		return nil, err
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"build_id": buildID,
-				"status":   jdata.Status,
-			}).Info("build finished")
-			return
+	jdata, err := c.extractLogs(ctx, jd, buildID, uri, previous)
+	if err != nil {
+		return nil, err
+	}
+	jdata.Job = jobName(base)
+	logrus.Info("extracted jenkins data")
+	return jdata, nil
+}
+
+// jobName derives the full name of the job from the build url,
+// such that https://jenkins/job/team/job/app/12 becomes team/app
+func jobName(buildURL string) string {
+	u, err := url.Parse(buildURL)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	var names []string
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "job" {
+			names = append(names, segments[i+1])
+			i++
 		}
 	}
+	return strings.Join(names, "/")
 }
 
-func (c *Crawler) crawlBuild(uri *url.URL) {
-	for {
-		select {
-		case buildID := <-c.processChannel:
-			jd := &ale.JobData{}
-			resp, err := c.httpClient.Get(uri.String())
-			if err != nil {
-				logrus.Error(err)
+// buildInfo fetches the generic description of the build, used to tell
+// pipelines apart from freestyle, matrix and maven jobs
+func (c *Crawler) buildInfo(ctx context.Context, base string) (*ale.BuildInfo, error) {
+	var info ale.BuildInfo
+	uri := base + "/api/json?tree=_class,id,fullDisplayName,building,result,timestamp,duration"
+	if err := c.fetcher.fetchJSON(ctx, uri, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// crawlConsoleText stores builds without the workflow API as a single stage
+// holding the whole console output
+func (c *Crawler) crawlConsoleText(ctx context.Context, base string, buildID string, info *ale.BuildInfo) (*ale.JenkinsData, error) {
+	logrus.WithFields(logrus.Fields{
+		"uri":      base,
+		"build_id": buildID,
+		"class":    info.Class,
+	}).Info("crawling console text of non-pipeline build")
+	body, _, err := c.fetcher.fetch(ctx, base+"/consoleText")
+	if err != nil {
+		return nil, err
+	}
+	status := consoleStatus(info)
+	endTime := 0
+	if !info.Building {
+		endTime = info.Timestamp + info.Duration
+	}
+	return &ale.JenkinsData{
+		Status:    status,
+		Name:      info.FullDisplayName,
+		Job:       jobName(base),
+		ID:        info.ID,
+		BuildID:   buildID,
+		StartTime: info.Timestamp,
+		EndTime:   endTime,
+		Duration:  info.Duration,
+		Stages: []*ale.JenkinsStage{
+			{
+				ID:        info.ID,
+				Status:    status,
+				Name:      "Console Output",
+				Logs:      c.splitLogs(string(body)),
+				LogLength: len(body),
+				StartTime: info.Timestamp,
+				Duration:  info.Duration,
+			},
+		},
+	}, nil
+}
+
+// consoleStatus maps the result of a build to the statuses used by the workflow API
+func consoleStatus(info *ale.BuildInfo) string {
+	if info.Building {
+		return "IN_PROGRESS"
+	}
+	switch info.Result {
+	case "FAILURE":
+		return "FAILED"
+	case "NOT_BUILT":
+		return "NOT_EXECUTED"
+	case "":
+		return "IN_PROGRESS"
+	}
+	return info.Result
+}
+
+// recordCrawl applies an update to the stored crawl record of the build, and
+// returns it. If the record can't be read it's left alone, rather than
+// replaced by one without its callback, and nil is returned.
+func (c *Crawler) recordCrawl(ctx context.Context, buildID string, update func(*ale.Crawl)) *ale.Crawl {
+	crawl, err := c.database.GetCrawl(ctx, buildID)
+	if err != nil && err != db.ErrNotFound {
+		logrus.WithError(err).WithField("build_id", buildID).Error("unable to read crawl state")
+		return nil
+	}
+	if err == db.ErrNotFound {
+		crawl = &ale.Crawl{
+			BuildID: buildID,
+			State:   ale.CrawlQueued,
+			Created: time.Now(),
+		}
+	}
+	update(crawl)
+	if err := c.database.PutCrawl(ctx, crawl); err != nil {
+		logrus.WithError(err).WithField("build_id", buildID).Error("unable to store crawl state")
+	}
+	return crawl
+}
+
+// publish hands the state of the build to those following its crawl
+func (c *Crawler) publish(buildID string, jdata *ale.JenkinsData, state string) {
+	if c.updates == nil {
+		return
+	}
+	c.updates.Publish(&events.Update{BuildID: buildID, Build: jdata, State: state})
+}
+
+// notify tells the callback url of the crawl, if it has one, that the crawl is over
+func (c *Crawler) notify(crawl *ale.Crawl) {
+	if c.notifier == nil {
+		return
+	}
+	c.notifier.Notify(crawl)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// previousState loads what was stored by an earlier crawl of the build, if anything
+func (c *Crawler) previousState(ctx context.Context, buildID string) *ale.JenkinsData {
+	if exists, _ := c.database.Has(ctx, buildID); !exists {
+		return nil
+	}
+	jdata, err := c.database.Get(ctx, buildID)
+	if err != nil {
+		logrus.WithError(err).WithField("build_id", buildID).Warn("unable to load previous state, crawling everything")
+		return nil
+	}
+	return jdata
+}
+
+// previousStages indexes the stages and flow nodes of a previous crawl by id.
+// Those that reached a final status won't change anymore, and the others can
+// continue reading their logs from where the previous crawl stopped.
+func previousStages(previous *ale.JenkinsData) map[string]*ale.JenkinsStage {
+	known := make(map[string]*ale.JenkinsStage)
+	if previous == nil {
+		return known
+	}
+	var index func(stages []*ale.JenkinsStage)
+	index = func(stages []*ale.JenkinsStage) {
+		for _, stage := range stages {
+			if stage.ID != "" {
+				known[stage.ID] = stage
 			}
-			defer resp.Body.Close()
-			body, err := ioutil.ReadAll(resp.Body)
-			err = json.Unmarshal(body, &jd)
-			logrus.WithFields(logrus.Fields{
-				"uri":      uri.String(),
-				"build_id": buildID,
-			}).Info("crawling jenkins API")
-
-			jdata := c.extractLogs(jd, buildID, uri)
-			logrus.Info("extracted jenkins data")
-			c.stateChannel <- jdata
-			logrus.Debug("data sent to stateChannel")
+			index(stage.SubStages)
 		}
 	}
+	index(previous.Stages)
+	return known
+}
+
+// isFinished reports whether a Jenkins status is terminal
+func isFinished(status string) bool {
+	switch status {
+	case "", "IN_PROGRESS", "PAUSED_PENDING_INPUT", "QUEUED":
+		return false
+	}
+	return true
 }
 
-func (c *Crawler) crawlJobStage(buildURL *url.URL, link string) ale.JobExecution {
+func (c *Crawler) crawlJobStage(ctx context.Context, buildURL *url.URL, link string) (*ale.JobExecution, error) {
 	stageLink := &url.URL{
 		Scheme: buildURL.Scheme,
 		Host:   buildURL.Host,
 		Path:   link,
 	}
-	resp, err := c.httpClient.Get(stageLink.String())
-	if err != nil {
-		logrus.Error(err)
+	var execution ale.JobExecution
+	if err := c.fetcher.fetchJSON(ctx, stageLink.String(), &execution); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	return &execution, nil
+}
+
+func (c *Crawler) crawlExecutionLogs(ctx context.Context, execution *ale.JobExecution, buildURL *url.URL, previous *ale.JenkinsStage) (*ale.JenkinsStage, error) {
+	stage, err := c.crawlNodeLog(ctx, buildURL, execution.Links.Log.Href, execution.Status, previous)
 	if err != nil {
-		logrus.Error(err)
+		return nil, err
 	}
-	var JobExecution ale.JobExecution
-	err = json.Unmarshal(body, &JobExecution)
+	stage.ID = execution.ID
+	stage.Name = execution.Name
+	stage.StartTime = execution.StartTimeMillis
+	stage.Duration = execution.DurationMillis
+	return stage, nil
+}
+
+func (c *Crawler) extractLogsFromFlowNode(ctx context.Context, node *ale.StageFlowNode, buildURL *url.URL, ename string, flowNodesByID map[string]*ale.StageFlowNode, previous *ale.JenkinsStage) (*ale.JenkinsStage, error) {
+	stage, err := c.crawlNodeLog(ctx, buildURL, node.Links.Log.Href, node.Status, previous)
 	if err != nil {
-		logrus.Error(err)
+		return nil, err
 	}
-	return JobExecution
+	stage.ID = node.ID
+	stage.Name = fmt.Sprintf("%s - %s", ename, node.Name)
+	stage.StartTime = node.StartTimeMillis
+	stage.Duration = node.DurationMillis
+	stage.Task = c.findTask(node, flowNodesByID)
+	stage.Description = node.ParameterDescription
+	return stage, nil
 }
 
-func (c *Crawler) crawlExecutionLogs(execution *ale.JobExecution, buildURL *url.URL) *ale.JenkinsStage {
-	logLink := &url.URL{
-		Scheme: buildURL.Scheme,
-		Host:   buildURL.Host,
-		Path:   execution.Links.Log.Href,
-	}
-	nodeLog := c.extractNodeLogs(logLink)
-	return &ale.JenkinsStage{
-		Status:    nodeLog.NodeStatus,
-		Name:      execution.Name,
-		LogLength: nodeLog.Length,
-		Logs:      c.splitLogs(nodeLog.Text),
-		StartTime: execution.StartTimeMillis,
-		Duration:  execution.DurationMillis,
+// crawlNodeLog fetches the log of a node. When a previous crawl already stored
+// part of it, only the output written since is fetched and appended.
+func (c *Crawler) crawlNodeLog(ctx context.Context, buildURL *url.URL, logHref string, status string, previous *ale.JenkinsStage) (*ale.JenkinsStage, error) {
+	if previous != nil && previous.LogOffset > 0 {
+		consoleURL := strings.TrimSuffix(logHref, "/wfapi/log") + "/log"
+		text, offset, more, err := c.progressiveText(ctx, buildURL, consoleURL, previous.LogOffset)
+		if err != nil {
+			return nil, err
+		}
+		lines, tail := c.splitProgressive(previous.LogTail+text, more)
+		logs := make([]*ale.Log, 0, len(previous.Logs)+len(lines))
+		logs = append(logs, previous.Logs...)
+		return &ale.JenkinsStage{
+			Status:    status,
+			Logs:      append(logs, lines...),
+			LogLength: offset,
+			LogOffset: offset,
+			LogTail:   tail,
+		}, nil
 	}
-}
 
-func (c *Crawler) extractLogsFromFlowNode(node *ale.StageFlowNode, buildURL *url.URL, ename string, flowNodesByID map[string]*ale.StageFlowNode) *ale.JenkinsStage {
 	logLink := &url.URL{
 		Scheme: buildURL.Scheme,
 		Host:   buildURL.Host,
-		Path:   node.Links.Log.Href,
+		Path:   logHref,
 	}
-	nodeLog := c.extractNodeLogs(logLink)
-	task := c.findTask(node, flowNodesByID)
-	return &ale.JenkinsStage{
-		Status:      nodeLog.NodeStatus,
-		Name:        fmt.Sprintf("%s - %s", ename, node.Name),
-		LogLength:   nodeLog.Length,
-		Logs:        c.splitLogs(nodeLog.Text),
-		StartTime:   node.StartTimeMillis,
-		Duration:    node.DurationMillis,
-		Task:        task,
-		Description: node.ParameterDescription,
+	nodeLog, err := c.extractNodeLogs(ctx, logLink)
+	if err != nil {
+		return nil, err
 	}
+	// The last line of a running node may still be being written, so it's held
+	// back like when continuing from the offset
+	lines, tail := c.splitProgressive(nodeLog.Text, !isFinished(nodeLog.NodeStatus))
+	return &ale.JenkinsStage{
+		Status:    nodeLog.NodeStatus,
+		LogLength: nodeLog.Length,
+		LogOffset: nodeLog.Length,
+		LogTail:   tail,
+		Logs:      lines,
+	}, nil
 }
 
 func (c *Crawler) findTask(node *ale.StageFlowNode, flowNodesByID map[string]*ale.StageFlowNode) string {
@@ -231,31 +537,106 @@ func (c *Crawler) findTask(node *ale.StageFlowNode, flowNodesByID map[string]*al
 	return c.findTask(firstParent, flowNodesByID)
 }
 
-func (c *Crawler) extractNodeLogs(logLink *url.URL) *ale.NodeLog {
-	resp, err := http.Get(logLink.String())
-	if err != nil {
-		logrus.Error(err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+func (c *Crawler) extractNodeLogs(ctx context.Context, logLink *url.URL) (*ale.NodeLog, error) {
 	var nodeLog ale.NodeLog
-	err = json.Unmarshal(body, &nodeLog)
-	if err != nil {
+	if err := c.fetcher.fetchJSON(ctx, logLink.String(), &nodeLog); err != nil {
 		logrus.WithError(err).WithField("url", logLink.String()).Error("unable to extract logs from node")
+		return nil, err
 	}
-	return &nodeLog
+	if nodeLog.HasMore && nodeLog.ConsoleURL != "" {
+		// wfapi truncates logs longer than FlowNodeLogExt.maxReturnChars
+		logrus.WithField("node", nodeLog.NodeID).Debug("log truncated by wfapi, fetching the full log")
+		text, size, _, err := c.progressiveText(ctx, logLink, nodeLog.ConsoleURL, 0)
+		if err != nil {
+			return nil, err
+		}
+		nodeLog.Text = text
+		nodeLog.Length = size
+		nodeLog.HasMore = false
+	}
+	return &nodeLog, nil
 }
 
-func (c *Crawler) crawlStageFlowNodesLogs(execution *ale.JobExecution, buildURL *url.URL) *ale.JenkinsStage {
-	logs := []*ale.JenkinsStage{}
+// progressiveText reads the log of a node from the given byte offset onwards,
+// returning the text, the offset to continue from and whether more is expected
+func (c *Crawler) progressiveText(ctx context.Context, buildURL *url.URL, consoleURL string, start int) (string, int, bool, error) {
+	textLink := &url.URL{
+		Scheme:   buildURL.Scheme,
+		Host:     buildURL.Host,
+		Path:     strings.TrimRight(consoleURL, "/") + "/progressiveText",
+		RawQuery: fmt.Sprintf("start=%d", start),
+	}
+	body, header, err := c.fetcher.fetch(ctx, textLink.String())
+	if err != nil {
+		return "", start, false, err
+	}
+	size := start + len(body)
+	if textSize, err := strconv.Atoi(header.Get("X-Text-Size")); err == nil {
+		size = textSize
+	}
+	return string(body), size, header.Get("X-More-Data") == "true", nil
+}
+
+func (c *Crawler) crawlStageFlowNodesLogs(ctx context.Context, execution *ale.JobExecution, buildURL *url.URL, known map[string]*ale.JenkinsStage) (*ale.JenkinsStage, error) {
 	var flowNodesByID = make(map[string]*ale.StageFlowNode)
 	for i := range execution.StageFlowNodes {
-		node := execution.StageFlowNodes[i]
-		flowNodesByID[node.ID] = &node
+		node := &execution.StageFlowNodes[i]
+		flowNodesByID[node.ID] = node
+	}
+	children := make(map[string][]*ale.StageFlowNode)
+	for i := range execution.StageFlowNodes {
+		node := &execution.StageFlowNodes[i]
+		block := enclosingBlock(node, flowNodesByID)
+		children[block] = append(children[block], node)
 	}
 
-	for _, node := range execution.StageFlowNodes {
+	logs, err := c.crawlFlowNodeTree(ctx, "", execution.Name, "", children, buildURL, flowNodesByID, known)
+	if err != nil {
+		return nil, err
+	}
+	return &ale.JenkinsStage{
+		ID:        execution.ID,
+		Status:    execution.Status,
+		Name:      execution.Name,
+		SubStages: logs,
+		StartTime: execution.StartTimeMillis,
+		Duration:  execution.DurationMillis,
+	}, nil
+}
+
+// crawlFlowNodeTree crawls the flow nodes enclosed by the given block. Nodes
+// with a log are steps, the others are blocks such as parallel branches and
+// nested stages, which become substages holding their own steps.
+func (c *Crawler) crawlFlowNodeTree(ctx context.Context, blockID string, name string, branch string, children map[string][]*ale.StageFlowNode, buildURL *url.URL, flowNodesByID map[string]*ale.StageFlowNode, known map[string]*ale.JenkinsStage) ([]*ale.JenkinsStage, error) {
+	logs := []*ale.JenkinsStage{}
+	for _, node := range children[blockID] {
 		if node.Links.Log.Href == "" {
+			blockName := strings.TrimPrefix(node.Name, "Branch: ")
+			blockBranch := branch
+			if strings.HasPrefix(node.Name, "Branch: ") {
+				blockBranch = blockName
+			}
+			substages, err := c.crawlFlowNodeTree(ctx, node.ID, fmt.Sprintf("%s - %s", name, blockName), blockBranch, children, buildURL, flowNodesByID, known)
+			if err != nil {
+				return nil, err
+			}
+			if len(substages) == 0 {
+				continue
+			}
+			logs = append(logs, &ale.JenkinsStage{
+				ID:        node.ID,
+				Status:    node.Status,
+				Name:      blockName,
+				Branch:    blockBranch,
+				SubStages: substages,
+				StartTime: node.StartTimeMillis,
+				Duration:  node.DurationMillis,
+			})
+			continue
+		}
+		previous := known[node.ID]
+		if previous != nil && isFinished(previous.Status) {
+			logs = append(logs, previous)
 			continue
 		}
 		logLink := &url.URL{
@@ -267,30 +648,61 @@ func (c *Crawler) crawlStageFlowNodesLogs(execution *ale.JobExecution, buildURL
 			"url":  logLink,
 			"node": node.ID,
 		}).Debug("crawling jenkins")
-		logs = append(logs, c.extractLogsFromFlowNode(&node, logLink, execution.Name, flowNodesByID))
+		stage, err := c.extractLogsFromFlowNode(ctx, node, logLink, name, flowNodesByID, previous)
+		if err != nil {
+			return nil, err
+		}
+		stage.Branch = branch
+		logs = append(logs, stage)
 	}
-	return &ale.JenkinsStage{
-		Status:    execution.Status,
-		Name:      execution.Name,
-		SubStages: logs,
-		StartTime: execution.StartTimeMillis,
-		Duration:  execution.DurationMillis,
+	return logs, nil
+}
+
+// enclosingBlock follows the parents of a flow node until it reaches a node
+// without a log of its own, which is the block the node is part of. Nodes
+// directly in the stage belong to the "" block.
+func enclosingBlock(node *ale.StageFlowNode, flowNodesByID map[string]*ale.StageFlowNode) string {
+	visited := map[string]bool{node.ID: true}
+	for len(node.Parents) > 0 {
+		parent := flowNodesByID[node.Parents[0]]
+		if parent == nil || visited[parent.ID] {
+			return ""
+		}
+		if parent.Links.Log.Href == "" {
+			return parent.ID
+		}
+		visited[parent.ID] = true
+		node = parent
 	}
+	return ""
 }
 
-func (c *Crawler) extractLogsFromExecution(execution *ale.JobExecution, buildURL *url.URL) *ale.JenkinsStage {
+func (c *Crawler) extractLogsFromExecution(ctx context.Context, execution *ale.JobExecution, buildURL *url.URL, known map[string]*ale.JenkinsStage) (*ale.JenkinsStage, error) {
 	logrus.WithField("id", execution.ID).Debug("crawling execution")
 	if execution.StageFlowNodes != nil && len(execution.StageFlowNodes) > 0 {
-		return c.crawlStageFlowNodesLogs(execution, buildURL)
+		return c.crawlStageFlowNodesLogs(ctx, execution, buildURL, known)
 	}
-	return c.crawlExecutionLogs(execution, buildURL)
+	return c.crawlExecutionLogs(ctx, execution, buildURL, known[execution.ID])
 }
 
-func (c *Crawler) extractLogs(jd *ale.JobData, buildID string, buildURL *url.URL) *ale.JenkinsData {
+func (c *Crawler) extractLogs(ctx context.Context, jd *ale.JobData, buildID string, buildURL *url.URL, previous *ale.JenkinsData) (*ale.JenkinsData, error) {
+	known := previousStages(previous)
 	var stages []*ale.JenkinsStage
 	for _, stage := range jd.Stages {
-		execution := c.crawlJobStage(buildURL, stage.Links.Self.Href)
-		stages = append(stages, c.extractLogsFromExecution(&execution, buildURL))
+		if done, ok := known[stage.ID]; ok && isFinished(done.Status) {
+			logrus.WithField("id", stage.ID).Debug("stage already finished, skipping")
+			stages = append(stages, done)
+			continue
+		}
+		execution, err := c.crawlJobStage(ctx, buildURL, stage.Links.Self.Href)
+		if err != nil {
+			return nil, err
+		}
+		jstage, err := c.extractLogsFromExecution(ctx, execution, buildURL, known)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, jstage)
 	}
 
 	sort.Slice(stages[:], func(i, j int) bool {
@@ -308,7 +720,7 @@ func (c *Crawler) extractLogs(jd *ale.JobData, buildID string, buildURL *url.URL
 		EndTime:       jd.EndTimeMillis,
 		QueueDuration: jd.QueueDurationMillis,
 		PauseDuration: jd.PauseDurationMillis,
-	}
+	}, nil
 }
 
 func (c *Crawler) splitLogs(log string) []*ale.Log {
@@ -322,6 +734,17 @@ func (c *Crawler) splitLogs(log string) []*ale.Log {
 	return l
 }
 
+// splitProgressive splits progressively fetched text into log lines. While more
+// output is expected, a trailing unterminated line is returned as the tail, to
+// be completed by the next fetch.
+func (c *Crawler) splitProgressive(text string, more bool) ([]*ale.Log, string) {
+	if !more || strings.HasSuffix(text, "\n") {
+		return c.splitLogs(text), ""
+	}
+	idx := strings.LastIndex(text, "\n")
+	return c.splitLogs(text[:idx+1]), text[idx+1:]
+}
+
 func (c *Crawler) extractTimestamp(line string) *ale.Log {
 	re := c.r.FindStringSubmatch(line)
 	if len(re) <= 1 {
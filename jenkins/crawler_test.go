@@ -1,15 +1,19 @@
 package jenkins
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/alde/ale"
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/events"
 	"github.com/alde/ale/mock"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
@@ -17,7 +21,8 @@ import (
 )
 
 var (
-	c = NewCrawler(&mock.DB{}, config.DefaultConfig())
+	c   = NewCrawler(&mock.DB{}, config.DefaultConfig(), http.DefaultClient)
+	ctx = context.Background()
 )
 
 func Test_ExtractTimestamp(t *testing.T) {
@@ -110,6 +115,51 @@ func Test_PrintBuildLog(t *testing.T) {
 	assert.Nil(t, hook.LastEntry())
 }
 
+func Test_ExtractLogsSkipsFinishedStages(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/tingle/261/execution/node/24/wfapi/describe": `{"id": "24", "name": "Build", "status": "SUCCESS", "_links": {"log": {"href": "/job/tingle/261/execution/node/24/wfapi/log"}}}`,
+			"/job/tingle/261/execution/node/24/wfapi/log":      `{"nodeId": "24", "nodeStatus": "SUCCESS", "text": "done\n"}`,
+		},
+	}
+	crawler := NewCrawler(&mock.DB{}, config.DefaultConfig(), client)
+
+	previous := &ale.JenkinsData{
+		Stages: []*ale.JenkinsStage{
+			{ID: "17", Status: "SUCCESS", Name: "Preparation", Logs: []*ale.Log{{Line: "prepared"}}},
+			{ID: "24", Status: "IN_PROGRESS", Name: "Build"},
+		},
+	}
+	jd := &ale.JobData{Status: "SUCCESS"}
+	for _, id := range []string{"17", "24"} {
+		stage := ale.JobStage{ID: id, Status: "SUCCESS"}
+		stage.Links.Self.Href = fmt.Sprintf("/job/tingle/261/execution/node/%s/wfapi/describe", id)
+		jd.Stages = append(jd.Stages, stage)
+	}
+	uri, _ := url.Parse("http://jenkins.local/job/tingle/261/wfapi/describe")
+
+	jdata, err := crawler.extractLogs(ctx, jd, "261", uri, previous)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"/job/tingle/261/execution/node/24/wfapi/describe",
+		"/job/tingle/261/execution/node/24/wfapi/log",
+	}, client.Requested)
+	assert.Len(t, jdata.Stages, 2)
+	assert.Equal(t, previous.Stages[0], jdata.Stages[0])
+	assert.Equal(t, "SUCCESS", jdata.Stages[1].Status)
+	assert.Equal(t, "done", jdata.Stages[1].Logs[0].Line)
+}
+
+func Test_IsFinished(t *testing.T) {
+	assert.False(t, isFinished(""))
+	assert.False(t, isFinished("IN_PROGRESS"))
+	assert.False(t, isFinished("PAUSED_PENDING_INPUT"))
+	assert.True(t, isFinished("SUCCESS"))
+	assert.True(t, isFinished("FAILED"))
+	assert.True(t, isFinished("ABORTED"))
+}
+
 func loadFixture(t *testing.T, name string, v interface{}) {
 	path := filepath.Join("../test_fixtures", name)
 	bytes, err := ioutil.ReadFile(path)
@@ -122,3 +172,396 @@ func loadFixture(t *testing.T, name string, v interface{}) {
 		t.Fatal(err)
 	}
 }
+
+func Test_RecordCrawl(t *testing.T) {
+	database := &mock.DB{}
+	crawler := NewCrawler(database, config.DefaultConfig(), http.DefaultClient)
+
+	crawler.recordCrawl(ctx, "1", func(crawl *ale.Crawl) {
+		crawl.Attempts++
+	})
+	crawler.recordCrawl(ctx, "1", func(crawl *ale.Crawl) {
+		crawl.Attempts++
+		crawl.State = ale.CrawlRunning
+	})
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, 2, crawl.Attempts)
+	assert.Equal(t, ale.CrawlRunning, crawl.State)
+	assert.False(t, crawl.Created.IsZero())
+}
+
+// unreadableCrawls fails to read the crawl records
+type unreadableCrawls struct {
+	*mock.DB
+}
+
+func (d unreadableCrawls) GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func Test_RecordCrawlKeepsUnreadableRecord(t *testing.T) {
+	database := &mock.DB{}
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "1", CallbackURL: "https://ci-bot.local/done"})
+	crawler := NewCrawler(unreadableCrawls{database}, config.DefaultConfig(), http.DefaultClient)
+
+	crawl := crawler.recordCrawl(ctx, "1", func(crawl *ale.Crawl) {
+		crawl.State = ale.CrawlFinished
+	})
+
+	assert.Nil(t, crawl)
+	assert.Equal(t, "https://ci-bot.local/done", database.Crawls["1"].CallbackURL)
+	assert.Empty(t, database.Crawls["1"].State)
+}
+
+func Test_UpdateStatePublishes(t *testing.T) {
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	crawler := NewCrawler(database, config.DefaultConfig(), http.DefaultClient)
+	crawler.updates = events.NewHub()
+	subscription := crawler.updates.Subscribe("1")
+	defer subscription.Close()
+
+	assert.False(t, crawler.updateState(ctx, "1", &ale.JenkinsData{Status: "IN_PROGRESS"}))
+	update := subscription.Next()
+	assert.Equal(t, ale.CrawlRunning, update.State)
+	assert.False(t, update.Final())
+
+	assert.True(t, crawler.updateState(ctx, "1", &ale.JenkinsData{Status: "SUCCESS"}))
+	update = subscription.Next()
+	assert.Equal(t, ale.CrawlFinished, update.State)
+	assert.Equal(t, "SUCCESS", update.Build.Status)
+}
+
+func Test_NextInterval(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Crawler.Backoff = 2
+	cfg.Crawler.MaxPollInterval = config.Duration{Duration: 30 * time.Second}
+	crawler := NewCrawler(&mock.DB{}, cfg, http.DefaultClient)
+
+	assert.Equal(t, 10*time.Second, crawler.nextInterval(5*time.Second))
+	assert.Equal(t, 30*time.Second, crawler.nextInterval(20*time.Second))
+
+	cfg.Crawler.Backoff = 0
+	assert.Equal(t, 5*time.Second, crawler.nextInterval(5*time.Second))
+}
+
+func Test_CrawlJenkinsTimeout(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/api/json":       `{"_class": "org.jenkinsci.plugins.workflow.job.WorkflowRun", "building": true}`,
+			"/job/foo/1/wfapi/describe": `{"id": "1", "status": "IN_PROGRESS", "stages": []}`,
+		},
+	}
+	cfg := config.DefaultConfig()
+	cfg.Crawler.PollInterval = config.Duration{Duration: time.Millisecond}
+	cfg.Crawler.MaxDuration = config.Duration{Duration: time.Nanosecond}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	crawler := NewCrawler(database, cfg, client)
+
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/foo/1/", "1")
+
+	jdata, _ := database.Get(ctx, "1")
+	assert.Equal(t, ale.CrawlTimeout, jdata.Status)
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlTimeout, crawl.State)
+	assert.Equal(t, "IN_PROGRESS", crawl.JenkinsStatus)
+}
+
+func Test_CrawlJenkinsDeadlineWhileWaiting(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/api/json":       `{"_class": "org.jenkinsci.plugins.workflow.job.WorkflowRun", "building": true}`,
+			"/job/foo/1/wfapi/describe": `{"id": "1", "name": "#1", "status": "IN_PROGRESS", "stages": []}`,
+		},
+	}
+	cfg := config.DefaultConfig()
+	cfg.Crawler.PollInterval = config.Duration{Duration: time.Hour}
+	cfg.Crawler.MaxDuration = config.Duration{Duration: 30 * time.Millisecond}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	database.PutCrawl(ctx, &ale.Crawl{
+		BuildID:     "1",
+		State:       ale.CrawlQueued,
+		Created:     time.Now(),
+		CallbackURL: "https://ci-bot.local/done",
+	})
+	crawler := NewCrawler(database, cfg, client)
+
+	started := time.Now()
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/foo/1/", "1")
+
+	assert.True(t, time.Since(started) < time.Second, "the deadline ends the wait for the next poll")
+	describes := 0
+	for _, uri := range client.Requested {
+		if uri == "/job/foo/1/wfapi/describe" {
+			describes++
+		}
+	}
+	assert.Equal(t, 1, describes, "no poll follows the deadline")
+	jdata, _ := database.Get(ctx, "1")
+	assert.Equal(t, ale.CrawlTimeout, jdata.Status)
+	assert.Equal(t, "#1", jdata.Name)
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlTimeout, crawl.State)
+	assert.Equal(t, 1, crawl.Attempts)
+	assert.Equal(t, "https://ci-bot.local/done", crawl.CallbackURL)
+}
+
+// countingDB counts the loads of stored builds
+type countingDB struct {
+	*mock.DB
+	gets int
+}
+
+func (d *countingDB) Get(ctx context.Context, buildID string) (*ale.JenkinsData, error) {
+	d.gets++
+	return d.DB.Get(ctx, buildID)
+}
+
+func Test_CrawlJenkinsKeepsPreviousState(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/api/json":       `{"_class": "org.jenkinsci.plugins.workflow.job.WorkflowRun", "building": true}`,
+			"/job/foo/1/wfapi/describe": `{"id": "1", "status": "IN_PROGRESS", "stages": []}`,
+		},
+	}
+	cfg := config.DefaultConfig()
+	cfg.Crawler.PollInterval = config.Duration{Duration: time.Millisecond}
+	cfg.Crawler.MaxPollInterval = config.Duration{Duration: time.Millisecond}
+	cfg.Crawler.MaxDuration = config.Duration{Duration: 20 * time.Millisecond}
+	database := &countingDB{DB: &mock.DB{Memory: make(map[string]*ale.JenkinsData)}}
+	crawler := NewCrawler(database, cfg, client)
+
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/foo/1/", "1")
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.True(t, crawl.Attempts > 1, "expected several polls")
+	assert.Equal(t, 0, database.gets, "polls continue from the state in memory")
+
+	database.gets = 0
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/foo/1/", "1")
+	assert.Equal(t, 1, database.gets, "a resumed crawl loads the stored state once")
+}
+
+func Test_CrawlJenkinsCancelled(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/api/json":       `{"_class": "org.jenkinsci.plugins.workflow.job.WorkflowRun", "building": true}`,
+			"/job/foo/1/wfapi/describe": `{"id": "1", "status": "IN_PROGRESS", "stages": []}`,
+		},
+	}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	crawler := NewCrawler(database, config.DefaultConfig(), client)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	crawler.CrawlJenkins(cancelled, "http://jenkins.local/job/foo/1/", "1")
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlRunning, crawl.State, "a cancelled crawl is resumed on the next start")
+}
+
+func Test_CrawlJenkinsPermanentFailure(t *testing.T) {
+	client := &mock.HTTPGetter{}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	crawler := NewCrawler(database, config.DefaultConfig(), client)
+
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/foo/404/", "404")
+
+	assert.Len(t, client.Requested, 1)
+	crawl, _ := database.GetCrawl(ctx, "404")
+	assert.Equal(t, ale.CrawlFailed, crawl.State)
+	assert.Contains(t, crawl.LastError, "404")
+}
+
+func Test_ExtractNodeLogsFetchesTruncatedLogs(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/execution/node/8/wfapi/log":           `{"nodeId": "8", "nodeStatus": "SUCCESS", "length": 10, "hasMore": true, "text": "first\n", "consoleUrl": "/job/foo/1/execution/node/8/log"}`,
+			"/job/foo/1/execution/node/8/log/progressiveText": "first\nsecond\nthird\n",
+		},
+		Headers: map[string]http.Header{
+			"/job/foo/1/execution/node/8/log/progressiveText": {"X-Text-Size": []string{"19"}},
+		},
+	}
+	crawler := NewCrawler(&mock.DB{}, config.DefaultConfig(), client)
+	logLink, _ := url.Parse("http://jenkins.local/job/foo/1/execution/node/8/wfapi/log")
+
+	nodeLog, err := crawler.extractNodeLogs(ctx, logLink)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "/job/foo/1/execution/node/8/log/progressiveText?start=0", client.Requested[1])
+	assert.Equal(t, "first\nsecond\nthird\n", nodeLog.Text)
+	assert.Equal(t, 19, nodeLog.Length)
+	assert.False(t, nodeLog.HasMore)
+}
+
+func Test_CrawlNodeLogContinuesFromOffset(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/execution/node/8/log/progressiveText": "rest of second\nthird\nfou",
+		},
+		Headers: map[string]http.Header{
+			"/job/foo/1/execution/node/8/log/progressiveText": {
+				"X-Text-Size": []string{"42"},
+				"X-More-Data": []string{"true"},
+			},
+		},
+	}
+	crawler := NewCrawler(&mock.DB{}, config.DefaultConfig(), client)
+	buildURL, _ := url.Parse("http://jenkins.local/job/foo/1/wfapi/describe")
+	previous := &ale.JenkinsStage{
+		ID:        "8",
+		Status:    "IN_PROGRESS",
+		Logs:      []*ale.Log{{Line: "first"}},
+		LogOffset: 17,
+		LogTail:   "second, ",
+	}
+
+	stage, err := crawler.crawlNodeLog(ctx, buildURL, "/job/foo/1/execution/node/8/wfapi/log", "IN_PROGRESS", previous)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/job/foo/1/execution/node/8/log/progressiveText?start=17"}, client.Requested)
+	assert.Equal(t, []*ale.Log{
+		{Line: "first"},
+		{Line: "second, rest of second"},
+		{Line: "third"},
+	}, stage.Logs)
+	assert.Equal(t, 42, stage.LogOffset)
+	assert.Equal(t, "fou", stage.LogTail)
+	assert.Len(t, previous.Logs, 1)
+}
+
+func Test_CrawlNodeLogHoldsBackPartialLine(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/foo/1/execution/node/8/wfapi/log":           `{"nodeId": "8", "nodeStatus": "IN_PROGRESS", "length": 9, "text": "first\nsec"}`,
+			"/job/foo/1/execution/node/8/log/progressiveText": "ond\n",
+		},
+		Headers: map[string]http.Header{
+			"/job/foo/1/execution/node/8/log/progressiveText": {"X-Text-Size": []string{"13"}},
+		},
+	}
+	crawler := NewCrawler(&mock.DB{}, config.DefaultConfig(), client)
+	buildURL, _ := url.Parse("http://jenkins.local/job/foo/1/wfapi/describe")
+
+	stage, err := crawler.crawlNodeLog(ctx, buildURL, "/job/foo/1/execution/node/8/wfapi/log", "IN_PROGRESS", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ale.Log{{Line: "first"}}, stage.Logs)
+	assert.Equal(t, "sec", stage.LogTail)
+	assert.Equal(t, 9, stage.LogOffset)
+
+	stage, err = crawler.crawlNodeLog(ctx, buildURL, "/job/foo/1/execution/node/8/wfapi/log", "SUCCESS", stage)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ale.Log{{Line: "first"}, {Line: "second"}}, stage.Logs)
+	assert.Empty(t, stage.LogTail)
+}
+
+func Test_SplitProgressive(t *testing.T) {
+	lines, tail := c.splitProgressive("one\ntwo", false)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "", tail)
+
+	lines, tail = c.splitProgressive("one\ntwo", true)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "two", tail)
+
+	lines, tail = c.splitProgressive("partial", true)
+	assert.Len(t, lines, 0)
+	assert.Equal(t, "partial", tail)
+}
+
+func Test_CrawlJenkinsFreestyle(t *testing.T) {
+	client := &mock.HTTPGetter{
+		Responses: map[string]string{
+			"/job/legacy/7/api/json":    `{"_class": "hudson.model.FreeStyleBuild", "id": "7", "fullDisplayName": "legacy #7", "building": false, "result": "FAILURE", "timestamp": 1000, "duration": 500}`,
+			"/job/legacy/7/consoleText": "[2019-02-14T15:38:12.376Z] Started by user ale\n[2019-02-14T15:38:13.001Z] Finished: FAILURE\n",
+		},
+	}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	crawler := NewCrawler(database, config.DefaultConfig(), client)
+
+	crawler.CrawlJenkins(ctx, "http://jenkins.local/job/legacy/7", "legacy-7")
+
+	jdata, _ := database.Get(ctx, "legacy-7")
+	assert.Equal(t, "FAILED", jdata.Status)
+	assert.Equal(t, "legacy #7", jdata.Name)
+	assert.Equal(t, "legacy", jdata.Job)
+	assert.Equal(t, 1500, jdata.EndTime)
+	assert.Len(t, jdata.Stages, 1)
+	assert.Equal(t, []*ale.Log{
+		{TimeStamp: "2019-02-14T15:38:12.376Z", Line: "Started by user ale"},
+		{TimeStamp: "2019-02-14T15:38:13.001Z", Line: "Finished: FAILURE"},
+	}, jdata.Stages[0].Logs)
+	assert.NotContains(t, client.Requested, "/job/legacy/7/wfapi/describe")
+}
+
+func Test_JobName(t *testing.T) {
+	assert.Equal(t, "team/app", jobName("https://jenkins.local/job/team/job/app/12"))
+	assert.Equal(t, "foo", jobName("http://jenkins.local/jenkins/job/foo/1/"))
+	assert.Equal(t, "", jobName("http://jenkins.local/"))
+}
+
+func Test_ConsoleStatus(t *testing.T) {
+	assert.Equal(t, "IN_PROGRESS", consoleStatus(&ale.BuildInfo{Building: true}))
+	assert.Equal(t, "SUCCESS", consoleStatus(&ale.BuildInfo{Result: "SUCCESS"}))
+	assert.Equal(t, "FAILED", consoleStatus(&ale.BuildInfo{Result: "FAILURE"}))
+	assert.Equal(t, "NOT_EXECUTED", consoleStatus(&ale.BuildInfo{Result: "NOT_BUILT"}))
+}
+
+func Test_CrawlStageFlowNodesLogsBuildsTree(t *testing.T) {
+	node := func(id string, name string, parent string, withLog bool) ale.StageFlowNode {
+		n := ale.StageFlowNode{ID: id, Name: name, Status: "SUCCESS", Parents: []string{parent}}
+		if withLog {
+			n.Links.Log.Href = fmt.Sprintf("/job/foo/1/execution/node/%s/wfapi/log", id)
+		}
+		return n
+	}
+	execution := &ale.JobExecution{
+		ID:     "5",
+		Name:   "Test",
+		Status: "SUCCESS",
+		StageFlowNodes: []ale.StageFlowNode{
+			node("6", "Checkout", "5", true),
+			node("10", "Branch: shard1", "6", false),
+			node("11", "Shell Script", "10", true),
+			node("12", "Shell Script", "11", true),
+			node("20", "Branch: shard2", "6", false),
+			node("21", "Shell Script", "20", true),
+			node("22", "Lint", "21", false),
+			node("23", "Shell Script", "22", true),
+		},
+	}
+	responses := make(map[string]string)
+	for _, id := range []string{"6", "11", "12", "21", "23"} {
+		responses[fmt.Sprintf("/job/foo/1/execution/node/%s/wfapi/log", id)] = fmt.Sprintf(`{"nodeId": "%s", "nodeStatus": "SUCCESS", "text": "line of %s\n"}`, id, id)
+	}
+	crawler := NewCrawler(&mock.DB{}, config.DefaultConfig(), &mock.HTTPGetter{Responses: responses})
+	buildURL, _ := url.Parse("http://jenkins.local/job/foo/1/wfapi/describe")
+
+	stage, err := crawler.crawlStageFlowNodesLogs(ctx, execution, buildURL, map[string]*ale.JenkinsStage{})
+
+	assert.Nil(t, err)
+	assert.Len(t, stage.SubStages, 3)
+	assert.Equal(t, "Test - Checkout", stage.SubStages[0].Name)
+
+	shard1 := stage.SubStages[1]
+	assert.Equal(t, "shard1", shard1.Name)
+	assert.Equal(t, "shard1", shard1.Branch)
+	assert.Len(t, shard1.SubStages, 2)
+	assert.Equal(t, "Test - shard1 - Shell Script", shard1.SubStages[0].Name)
+	assert.Equal(t, "shard1", shard1.SubStages[1].Branch)
+
+	shard2 := stage.SubStages[2]
+	assert.Len(t, shard2.SubStages, 2)
+	lint := shard2.SubStages[1]
+	assert.Equal(t, "Lint", lint.Name)
+	assert.Equal(t, "shard2", lint.Branch)
+	assert.Equal(t, "Test - shard2 - Lint - Shell Script", lint.SubStages[0].Name)
+	assert.Equal(t, "shard2", lint.SubStages[0].Branch)
+
+	var lines []string
+	for _, l := range flattenLogs([]*ale.JenkinsStage{stage}) {
+		lines = append(lines, l.Line)
+	}
+	assert.Equal(t, []string{"line of 6", "line of 11", "line of 12", "line of 21", "line of 23"}, lines)
+}
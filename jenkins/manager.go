@@ -0,0 +1,211 @@
+package jenkins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/callback"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+	"github.com/alde/ale/events"
+)
+
+// ErrQueueFull is returned when no more crawls can be queued
+var ErrQueueFull = errors.New("crawl queue is full")
+
+var resumeRetryInterval = time.Second
+
+// Manager distributes crawls over a fixed number of workers
+type Manager struct {
+	database db.Database
+	config   *config.Config
+	client   HTTPGetter
+	queue    chan *crawlJob
+	mutex    sync.Mutex
+	active   map[string]bool
+	updates  *events.Hub
+	notifier *callback.Notifier
+	crawl    func(ctx context.Context, buildURL string, buildID string)
+
+	// ctx is cancelled by Stop, ending the crawls in progress
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+type crawlJob struct {
+	buildURL string
+	buildID  string
+}
+
+// NewManager creates a new crawl manager, call Start to launch the workers
+func NewManager(database db.Database, cfg *config.Config, client HTTPGetter) *Manager {
+	m := &Manager{
+		database: database,
+		config:   cfg,
+		client:   client,
+		queue:    make(chan *crawlJob, cfg.Crawler.QueueSize),
+		active:   make(map[string]bool),
+		updates:  events.NewHub(),
+		notifier: callback.NewNotifier(database, cfg),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.crawl = func(ctx context.Context, buildURL string, buildID string) {
+		crawler := NewCrawler(m.database, m.config, m.client)
+		crawler.updates = m.updates
+		crawler.notifier = m.notifier
+		crawler.CrawlJenkins(ctx, buildURL, buildID)
+	}
+	return m
+}
+
+// Updates is where the state of the builds is published after every poll
+func (m *Manager) Updates() *events.Hub {
+	return m.updates
+}
+
+// Start launches the configured number of workers
+func (m *Manager) Start() {
+	workers := m.config.Crawler.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	logrus.WithFields(logrus.Fields{
+		"workers":    workers,
+		"queue_size": cap(m.queue),
+	}).Info("starting crawl workers")
+	m.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+}
+
+// Stop cancels the crawls in progress and waits for the workers to return.
+// The crawls which were queued or running are left to be resumed the next time
+// ale starts.
+func (m *Manager) Stop() {
+	m.cancel()
+	m.workers.Wait()
+}
+
+// Enqueue schedules the crawl of a build. It returns false if a crawl of the
+// same build is already queued or running, in which case that one is shared.
+func (m *Manager) Enqueue(ctx context.Context, buildURL string, buildID string) (bool, error) {
+	return m.EnqueueCrawl(ctx, &ale.Crawl{
+		BuildID:  buildID,
+		BuildURL: buildURL,
+	})
+}
+
+// Crawling tells whether a crawl of the build is queued or running
+func (m *Manager) Crawling(buildID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.active[buildID]
+}
+
+// EnqueueCrawl schedules the crawl described by the record, such as one with
+// a callback url, like Enqueue does
+func (m *Manager) EnqueueCrawl(ctx context.Context, crawl *ale.Crawl) (bool, error) {
+	if crawl.Created.IsZero() {
+		crawl.Created = time.Now()
+	}
+	return m.enqueue(ctx, crawl)
+}
+
+func (m *Manager) enqueue(ctx context.Context, crawl *ale.Crawl) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.active[crawl.BuildID] {
+		logrus.WithField("build_id", crawl.BuildID).Debug("build is already being crawled")
+		return false, nil
+	}
+	// Only enqueue sends to the queue, so with the lock held it can't fill up
+	// between this check and the send below
+	if len(m.queue) >= cap(m.queue) {
+		logrus.WithField("build_id", crawl.BuildID).Warn("crawl queue is full")
+		return false, ErrQueueFull
+	}
+	crawl.State = ale.CrawlQueued
+	if err := m.database.PutCrawl(ctx, crawl); err != nil {
+		logrus.WithError(err).WithField("build_id", crawl.BuildID).Warn("unable to store crawl state")
+	}
+	m.active[crawl.BuildID] = true
+	m.queue <- &crawlJob{buildURL: crawl.BuildURL, buildID: crawl.BuildID}
+	return true, nil
+}
+
+// Resume re-enqueues the crawls which were queued or running when ale last
+// stopped. Builds that don't fit in the queue are retried until they do, or
+// until ctx is done or the manager is stopped.
+func (m *Manager) Resume(ctx context.Context) error {
+	pending, err := m.database.PendingCrawls(ctx)
+	if err != nil {
+		return err
+	}
+	logrus.WithField("count", len(pending)).Info("resuming unfinished crawls")
+	for _, crawl := range pending {
+		if crawl.BuildURL == "" {
+			logrus.WithField("build_id", crawl.BuildID).Warn("unable to resume crawl without build url")
+			continue
+		}
+		for {
+			_, err := m.enqueue(ctx, crawl)
+			if err != ErrQueueFull {
+				break
+			}
+			select {
+			case <-time.After(resumeRetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-m.ctx.Done():
+				return m.ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manager) worker() {
+	defer m.workers.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case job := <-m.queue:
+			logrus.WithField("build_id", job.buildID).Debug("worker picked up crawl")
+			m.run(m.ctx, job)
+			m.mutex.Lock()
+			delete(m.active, job.buildID)
+			m.mutex.Unlock()
+		}
+	}
+}
+
+// run crawls the build, making sure a misbehaving crawl can't take down the worker
+func (m *Manager) run(ctx context.Context, job *crawlJob) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logrus.WithField("build_id", job.buildID).Errorf("crawl panicked: %v", r)
+		crawl, err := m.database.GetCrawl(ctx, job.buildID)
+		if err != nil {
+			crawl = &ale.Crawl{BuildID: job.buildID, BuildURL: job.buildURL, Created: time.Now()}
+		}
+		crawl.State = ale.CrawlFailed
+		crawl.LastError = fmt.Sprintf("crawl panicked: %v", r)
+		if err := m.database.PutCrawl(ctx, crawl); err != nil {
+			logrus.WithError(err).WithField("build_id", job.buildID).Error("unable to store crawl state")
+		}
+		m.updates.Publish(&events.Update{BuildID: job.buildID, State: ale.CrawlFailed})
+	}()
+	m.crawl(ctx, job.buildURL, job.buildID)
+}
@@ -0,0 +1,135 @@
+package jenkins
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/mock"
+)
+
+func Test_ManagerDeduplicates(t *testing.T) {
+	database := &mock.DB{}
+	m := NewManager(database, config.DefaultConfig(), http.DefaultClient)
+
+	assert.False(t, m.Crawling("1"))
+	queued, err := m.Enqueue(ctx, "http://jenkins.local/job/foo/1", "1")
+	assert.Nil(t, err)
+	assert.True(t, queued)
+	assert.True(t, m.Crawling("1"))
+
+	queued, err = m.Enqueue(ctx, "http://jenkins.local/job/foo/1", "1")
+	assert.Nil(t, err)
+	assert.False(t, queued)
+	assert.Len(t, m.queue, 1)
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlQueued, crawl.State)
+	assert.Equal(t, "http://jenkins.local/job/foo/1", crawl.BuildURL)
+}
+
+func Test_ManagerQueueFull(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Crawler.QueueSize = 1
+	m := NewManager(&mock.DB{}, cfg, http.DefaultClient)
+
+	_, err := m.Enqueue(ctx, "http://jenkins.local/job/foo/1", "1")
+	assert.Nil(t, err)
+	_, err = m.Enqueue(ctx, "http://jenkins.local/job/foo/2", "2")
+	assert.Equal(t, ErrQueueFull, err)
+}
+
+func Test_ManagerWorkers(t *testing.T) {
+	m := NewManager(&mock.DB{}, config.DefaultConfig(), http.DefaultClient)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	crawled := make(map[string]string)
+	m.crawl = func(_ context.Context, buildURL string, buildID string) {
+		mutex.Lock()
+		crawled[buildID] = buildURL
+		mutex.Unlock()
+		wg.Done()
+	}
+	m.Start()
+
+	wg.Add(2)
+	m.Enqueue(ctx, "http://jenkins.local/job/foo/1", "1")
+	m.Enqueue(ctx, "http://jenkins.local/job/foo/2", "2")
+	wg.Wait()
+
+	assert.Equal(t, map[string]string{
+		"1": "http://jenkins.local/job/foo/1",
+		"2": "http://jenkins.local/job/foo/2",
+	}, crawled)
+}
+
+func Test_ManagerResume(t *testing.T) {
+	database := &mock.DB{}
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "queued", BuildURL: "http://jenkins.local/job/foo/1", State: ale.CrawlQueued})
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "running", BuildURL: "http://jenkins.local/job/foo/2", State: ale.CrawlRunning, Attempts: 3})
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "finished", BuildURL: "http://jenkins.local/job/foo/3", State: ale.CrawlFinished})
+	m := NewManager(database, config.DefaultConfig(), http.DefaultClient)
+
+	assert.Nil(t, m.Resume(ctx))
+
+	assert.Len(t, m.queue, 2)
+	assert.True(t, m.active["queued"])
+	assert.True(t, m.active["running"])
+	assert.False(t, m.active["finished"])
+	crawl, _ := database.GetCrawl(ctx, "running")
+	assert.Equal(t, ale.CrawlQueued, crawl.State)
+	assert.Equal(t, 3, crawl.Attempts)
+}
+
+func Test_ManagerStopCancelsCrawls(t *testing.T) {
+	m := NewManager(&mock.DB{}, config.DefaultConfig(), http.DefaultClient)
+	started := make(chan bool)
+	var cancelled bool
+	m.crawl = func(ctx context.Context, buildURL string, buildID string) {
+		started <- true
+		<-ctx.Done()
+		cancelled = true
+	}
+	m.Start()
+	m.Enqueue(ctx, "http://jenkins.local/job/foo/1", "1")
+	<-started
+
+	m.Stop()
+	assert.True(t, cancelled)
+}
+
+func Test_ManagerStopEndsResume(t *testing.T) {
+	database := &mock.DB{}
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "1", BuildURL: "http://jenkins.local/job/foo/1", State: ale.CrawlQueued})
+	database.PutCrawl(ctx, &ale.Crawl{BuildID: "2", BuildURL: "http://jenkins.local/job/foo/2", State: ale.CrawlQueued})
+	cfg := config.DefaultConfig()
+	cfg.Crawler.QueueSize = 1
+	m := NewManager(database, cfg, http.DefaultClient)
+	defer func(interval time.Duration) { resumeRetryInterval = interval }(resumeRetryInterval)
+	resumeRetryInterval = time.Hour
+
+	resumed := make(chan error)
+	go func() { resumed <- m.Resume(ctx) }()
+	m.Stop()
+	assert.Equal(t, context.Canceled, <-resumed)
+}
+
+func Test_ManagerRecoversPanics(t *testing.T) {
+	database := &mock.DB{}
+	m := NewManager(database, config.DefaultConfig(), http.DefaultClient)
+	m.crawl = func(_ context.Context, buildURL string, buildID string) {
+		panic("boom")
+	}
+
+	m.run(ctx, &crawlJob{buildURL: "http://jenkins.local/job/foo/1", buildID: "1"})
+
+	crawl, _ := database.GetCrawl(ctx, "1")
+	assert.Equal(t, ale.CrawlFailed, crawl.State)
+	assert.Equal(t, "crawl panicked: boom", crawl.LastError)
+}
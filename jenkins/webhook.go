@@ -0,0 +1,162 @@
+package jenkins
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/alde/ale/callback"
+	"github.com/alde/ale/config"
+)
+
+// The phases of a build reported by the Notification plugin
+const (
+	PhaseQueued    = "QUEUED"
+	PhaseStarted   = "STARTED"
+	PhaseCompleted = "COMPLETED"
+	PhaseFinalized = "FINALIZED"
+)
+
+// TokenHeader holds the shared secret of the webhook, when it isn't given as the token query parameter
+const TokenHeader = "X-Ale-Token"
+
+// WebhookEvent is a build reported by a Jenkins webhook
+type WebhookEvent struct {
+	BuildURL string
+	BuildID  string
+	Job      string
+	Number   int
+	Phase    string
+}
+
+// webhookPayload covers the payload of the Notification plugin, as well as a
+// generic one only giving the url of the build
+type webhookPayload struct {
+	Name  string `json:"name"`
+	Build struct {
+		FullURL string `json:"full_url"`
+		Number  int    `json:"number"`
+		Phase   string `json:"phase"`
+		Status  string `json:"status"`
+	} `json:"build"`
+	BuildURL string `json:"buildUrl"`
+	Phase    string `json:"phase"`
+}
+
+// Webhook verifies and filters the builds reported by Jenkins
+type Webhook struct {
+	secret  string
+	include []string
+	exclude []string
+}
+
+// NewWebhook creates the webhook as configured, reading its secret
+func NewWebhook(cfg *config.Config) *Webhook {
+	return &Webhook{
+		secret:  readTokenFile(cfg.Webhook.SecretFile),
+		include: cfg.Webhook.Include,
+		exclude: cfg.Webhook.Exclude,
+	}
+}
+
+// Enabled tells whether a secret is configured, without which every request is refused
+func (w *Webhook) Enabled() bool {
+	return w.secret != ""
+}
+
+// Verify checks that the request holds the shared secret, either as is in the
+// token query parameter or the X-Ale-Token header, or as the HMAC-SHA256 of the
+// body in the X-Ale-Signature header like the callbacks sent by ale
+func (w *Webhook) Verify(r *http.Request, body []byte) bool {
+	if !w.Enabled() {
+		return false
+	}
+	if signature := r.Header.Get(callback.SignatureHeader); signature != "" {
+		return hmac.Equal([]byte(signature), []byte(callback.Sign(w.secret, body)))
+	}
+	token := r.Header.Get(TokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.secret)) == 1
+}
+
+// Accepts tells whether builds of the job should be crawled, being matched by
+// an include pattern, if there are any, and by no exclude pattern
+func (w *Webhook) Accepts(job string) bool {
+	for _, pattern := range w.exclude {
+		if matchJob(pattern, job) {
+			return false
+		}
+	}
+	if len(w.include) == 0 {
+		return true
+	}
+	for _, pattern := range w.include {
+		if matchJob(pattern, job) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchJob matches the full name of a job against a pattern such as team/*,
+// where a trailing /** also matches the jobs in nested folders
+func matchJob(pattern string, job string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		return strings.HasPrefix(job, strings.TrimSuffix(pattern, "**"))
+	}
+	matched, _ := path.Match(pattern, job)
+	return matched
+}
+
+// ParseWebhook reads the build out of the payload of a webhook
+func ParseWebhook(body []byte) (*WebhookEvent, error) {
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("unable to deserialize payload: %v", err)
+	}
+	buildURL := payload.Build.FullURL
+	if buildURL == "" {
+		buildURL = payload.BuildURL
+	}
+	buildURL = strings.TrimRight(buildURL, "/")
+	if buildURL == "" {
+		return nil, fmt.Errorf("payload has no build url, is the Jenkins URL configured?")
+	}
+	event := &WebhookEvent{
+		BuildURL: buildURL,
+		Job:      jobName(buildURL),
+		Number:   payload.Build.Number,
+		Phase:    strings.ToUpper(payload.Build.Phase),
+	}
+	if event.Phase == "" {
+		event.Phase = strings.ToUpper(payload.Phase)
+	}
+	if event.Number == 0 {
+		event.Number, _ = strconv.Atoi(buildURL[strings.LastIndex(buildURL, "/")+1:])
+	}
+	if event.Job == "" || event.Number <= 0 {
+		return nil, fmt.Errorf("%s is not the url of a build", buildURL)
+	}
+	event.BuildID = WebhookBuildID(event.Job, event.Number)
+	return event, nil
+}
+
+// buildIDEscaper escapes the characters standing for others in build ids, so
+// that no two jobs get the same id. A ~ always starts a pair, so ids can't be
+// confused either, and they stay usable as is in urls and file names.
+var buildIDEscaper = strings.NewReplacer("~", "~~", ".", "~.", "/", ".")
+
+// WebhookBuildID derives the id the builds reported by webhooks are stored
+// under from the job and number, such that build 262 of team/app is stored as
+// team.app-262. Slashes are replaced as the id is used in urls and file names,
+// and dots are escaped first so that the job team.app is stored as team~.app.
+func WebhookBuildID(job string, number int) string {
+	return fmt.Sprintf("%s-%d", buildIDEscaper.Replace(job), number)
+}
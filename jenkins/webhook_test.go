@@ -0,0 +1,109 @@
+package jenkins
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale/callback"
+	"github.com/alde/ale/config"
+)
+
+func Test_ParseWebhookNotificationPlugin(t *testing.T) {
+	event, err := ParseWebhook([]byte(`{
+		"name": "app",
+		"url": "job/team/job/app/",
+		"build": {
+			"full_url": "http://jenkins.local/job/team/job/app/262/",
+			"number": 262,
+			"phase": "COMPLETED",
+			"status": "SUCCESS"
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &WebhookEvent{
+		BuildURL: "http://jenkins.local/job/team/job/app/262",
+		BuildID:  "team.app-262",
+		Job:      "team/app",
+		Number:   262,
+		Phase:    PhaseCompleted,
+	}, event)
+}
+
+func Test_WebhookBuildIDDoesNotCollide(t *testing.T) {
+	assert.Equal(t, "team.app-1", WebhookBuildID("team/app", 1))
+	assert.Equal(t, "team~.app-1", WebhookBuildID("team.app", 1))
+	assert.Equal(t, "team~~.app-1", WebhookBuildID("team~/app", 1))
+
+	ids := make(map[string]string)
+	for _, job := range []string{"team/app", "team.app", "team~.app", "team~/app", "team/~app", "team/.app", "team./app", "team/app-1"} {
+		id := WebhookBuildID(job, 1)
+		assert.NotContains(t, ids, id, "%s and %s", job, ids[id])
+		assert.NotContains(t, id, "%")
+		ids[id] = job
+	}
+}
+
+func Test_ParseWebhookGeneric(t *testing.T) {
+	event, err := ParseWebhook([]byte(`{"buildUrl": "http://jenkins.local/job/app/7", "phase": "started"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "app-7", event.BuildID)
+	assert.Equal(t, 7, event.Number)
+	assert.Equal(t, PhaseStarted, event.Phase)
+
+	for _, payload := range []string{
+		`not json`,
+		`{"build": {"number": 1}}`,
+		`{"buildUrl": "http://jenkins.local/job/app"}`,
+		`{"buildUrl": "http://jenkins.local/view/all/7"}`,
+	} {
+		_, err := ParseWebhook([]byte(payload))
+		assert.NotNil(t, err, payload)
+	}
+}
+
+func Test_WebhookAccepts(t *testing.T) {
+	w := &Webhook{}
+	assert.True(t, w.Accepts("anything"))
+
+	w.include = []string{"team/**", "app"}
+	w.exclude = []string{"team/sandbox/*"}
+	assert.True(t, w.Accepts("app"))
+	assert.True(t, w.Accepts("team/app"))
+	assert.True(t, w.Accepts("team/sandbox"))
+	assert.True(t, w.Accepts("team/folder/app"))
+	assert.False(t, w.Accepts("team/sandbox/app"))
+	assert.False(t, w.Accepts("other/app"))
+	assert.False(t, w.Accepts("team"))
+}
+
+func Test_WebhookVerify(t *testing.T) {
+	file, _ := ioutil.TempFile(os.TempDir(), "secret")
+	defer os.Remove(file.Name())
+	file.WriteString("s3cr3t\n")
+	cfg := config.DefaultConfig()
+	cfg.Webhook.SecretFile = file.Name()
+	w := NewWebhook(cfg)
+	assert.True(t, w.Enabled())
+
+	body := []byte(`{"buildUrl": "http://jenkins.local/job/app/7"}`)
+	request := func(target string, header string, value string) *http.Request {
+		r, _ := http.NewRequest("POST", target, strings.NewReader(string(body)))
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+	assert.True(t, w.Verify(request("/?token=s3cr3t", "", ""), body))
+	assert.True(t, w.Verify(request("/", TokenHeader, "s3cr3t"), body))
+	assert.True(t, w.Verify(request("/", callback.SignatureHeader, callback.Sign("s3cr3t", body)), body))
+	assert.False(t, w.Verify(request("/", "", ""), body))
+	assert.False(t, w.Verify(request("/?token=wrong", "", ""), body))
+	assert.False(t, w.Verify(request("/?token=s3cr3t", callback.SignatureHeader, "sha256=00"), body))
+
+	assert.False(t, NewWebhook(config.DefaultConfig()).Verify(request("/?token=", "", ""), body))
+}
@@ -10,7 +10,11 @@ import (
 
 // Datastore is a mock of the Google Cloud Datastore
 type Datastore struct {
-	memory map[string]*ale.JenkinsData
+	memory map[string]*ale.DatastoreEntity
+	chunks map[string]*ale.DatastoreChunk
+	crawls map[string]*ale.Crawl
+	// summaries are kept by build id
+	summaries map[string]*ale.BuildSummary
 
 	PutFn        func(context.Context, *datastore.Key, interface{}) (*datastore.Key, error)
 	PutFnInvoked bool
@@ -23,33 +27,87 @@ type Datastore struct {
 
 	DeleteFn        func(context.Context, *datastore.Key) error
 	DeleteFnInvoked bool
+
+	DeleteMultiFn        func(context.Context, []*datastore.Key) error
+	DeleteMultiFnInvoked bool
+
+	GetAllFn        func(context.Context, *datastore.Query, interface{}) ([]*datastore.Key, error)
+	GetAllFnInvoked bool
 }
 
 // Put inserts data into the database
 func (md *Datastore) defaultPutFn(ctx context.Context, key *datastore.Key, data interface{}) (*datastore.Key, error) {
 	if md.memory == nil {
-		md.memory = make(map[string]*ale.JenkinsData)
+		md.memory = make(map[string]*ale.DatastoreEntity)
+	}
+	if md.crawls == nil {
+		md.crawls = make(map[string]*ale.Crawl)
+	}
+	if md.chunks == nil {
+		md.chunks = make(map[string]*ale.DatastoreChunk)
+	}
+	if md.summaries == nil {
+		md.summaries = make(map[string]*ale.BuildSummary)
 	}
-	d := data.(*ale.DatastoreEntity)
-	md.memory[d.Key] = &d.Value
-	return nil, nil
+	switch d := data.(type) {
+	case *ale.DatastoreEntity:
+		e := *d
+		md.memory[d.Key] = &e
+	case *ale.DatastoreChunk:
+		c := *d
+		md.chunks[key.String()] = &c
+	case *ale.Crawl:
+		c := *d
+		md.crawls[key.Name] = &c
+	case *ale.BuildSummary:
+		b := *d
+		md.summaries[key.Name] = &b
+	}
+	return key, nil
 }
 
 // Get retrieves data from the database
 func (md *Datastore) defaultGetFn(ctx context.Context, key *datastore.Key, data interface{}) error {
 	if md.memory == nil {
-		md.memory = make(map[string]*ale.JenkinsData)
+		md.memory = make(map[string]*ale.DatastoreEntity)
+	}
+	if crawl, ok := data.(*ale.Crawl); ok {
+		c, ok := md.crawls[key.Name]
+		if !ok {
+			return datastore.ErrNoSuchEntity
+		}
+		*crawl = *c
+		return nil
+	}
+	if summary, ok := data.(*ale.BuildSummary); ok {
+		b, ok := md.summaries[key.Name]
+		if !ok {
+			return datastore.ErrNoSuchEntity
+		}
+		*summary = *b
+		return nil
+	}
+	if chunk, ok := data.(*ale.DatastoreChunk); ok {
+		c, ok := md.chunks[key.String()]
+		if !ok {
+			return datastore.ErrNoSuchEntity
+		}
+		*chunk = *c
+		return nil
 	}
-	data, ok := md.memory[key.Name]
+	e, ok := md.memory[key.Name]
 	if !ok {
 		return errors.New("not found")
 	}
+	if entity, ok := data.(*ale.DatastoreEntity); ok {
+		*entity = *e
+	}
 	return nil
 }
 
 func (md *Datastore) defaultCountFn(context.Context, *datastore.Query) (int, error) {
 	if md.memory == nil {
-		md.memory = make(map[string]*ale.JenkinsData)
+		md.memory = make(map[string]*ale.DatastoreEntity)
 		return 0, errors.New("not found")
 	}
 	return 1, nil
@@ -57,7 +115,18 @@ func (md *Datastore) defaultCountFn(context.Context, *datastore.Query) (int, err
 
 func (md *Datastore) defaultDeleteFn(ctx context.Context, key *datastore.Key) error {
 	if md.memory == nil {
-		md.memory = make(map[string]*ale.JenkinsData)
+		md.memory = make(map[string]*ale.DatastoreEntity)
+	}
+	switch key.Kind {
+	case "JenkinsCrawl":
+		delete(md.crawls, key.Name)
+		return nil
+	case "JenkinsBuildChunk":
+		delete(md.chunks, key.String())
+		return nil
+	case "JenkinsBuildSummary":
+		delete(md.summaries, key.Name)
+		return nil
 	}
 	delete(md.memory, key.Name)
 	return nil
@@ -94,3 +163,22 @@ func (md *Datastore) Delete(ctx context.Context, key *datastore.Key) error {
 	}
 	return md.DeleteFn(ctx, key)
 }
+
+func (md *Datastore) GetAll(ctx context.Context, query *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	md.GetAllFnInvoked = true
+	if md.GetAllFn == nil {
+		return nil, nil
+	}
+	return md.GetAllFn(ctx, query, dst)
+}
+
+func (md *Datastore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	md.DeleteMultiFnInvoked = true
+	if md.DeleteMultiFn == nil {
+		for _, key := range keys {
+			md.defaultDeleteFn(ctx, key)
+		}
+		return nil
+	}
+	return md.DeleteMultiFn(ctx, keys)
+}
@@ -1,31 +1,117 @@
 package mock
 
-import "github.com/alde/ale"
+import (
+	"context"
+	"sort"
+
+	"github.com/alde/ale"
+)
 
 // DB holds a mocked in-memory database
 type DB struct {
 	Memory map[string]*ale.JenkinsData
+	Crawls map[string]*ale.Crawl
 }
 
 // Put inserts data into the database
-func (db *DB) Put(data *ale.JenkinsData, buildID string) error {
+func (db *DB) Put(ctx context.Context, data *ale.JenkinsData, buildID string) error {
 	db.Memory[buildID] = data
 	return nil
 }
 
 // Get retrieves data from the database
-func (db *DB) Get(buildID string) (*ale.JenkinsData, error) {
+func (db *DB) Get(ctx context.Context, buildID string) (*ale.JenkinsData, error) {
 	return db.Memory[buildID], nil
 }
 
 // Has checks the existance in the database
-func (db *DB) Has(buildID string) (bool, error) {
+func (db *DB) Has(ctx context.Context, buildID string) (bool, error) {
 	_, ok := db.Memory[buildID]
 	return ok, nil
 }
 
 // Remove deletes an entry from the database
-func (db *DB) Remove(buildID string) error {
+func (db *DB) Remove(ctx context.Context, buildID string) error {
 	delete(db.Memory, buildID)
 	return nil
 }
+
+// PutCrawl stores the crawl record
+func (db *DB) PutCrawl(ctx context.Context, crawl *ale.Crawl) error {
+	if db.Crawls == nil {
+		db.Crawls = make(map[string]*ale.Crawl)
+	}
+	c := *crawl
+	db.Crawls[crawl.BuildID] = &c
+	return nil
+}
+
+// GetCrawl retrieves the crawl record
+func (db *DB) GetCrawl(ctx context.Context, buildID string) (*ale.Crawl, error) {
+	crawl, ok := db.Crawls[buildID]
+	if !ok {
+		return nil, ale.ErrNotFound
+	}
+	c := *crawl
+	return &c, nil
+}
+
+// PendingCrawls returns the crawl records which have not yet finished
+func (db *DB) PendingCrawls(ctx context.Context) ([]*ale.Crawl, error) {
+	var pending []*ale.Crawl
+	for _, crawl := range db.Crawls {
+		if crawl.State == ale.CrawlQueued || crawl.State == ale.CrawlRunning {
+			c := *crawl
+			pending = append(pending, &c)
+		}
+	}
+	return pending, nil
+}
+
+// List returns a summary of every stored build matching the job and status of the query
+func (db *DB) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	list := &ale.BuildList{Builds: []*ale.BuildSummary{}}
+	for buildID, data := range db.Memory {
+		if query.Job != "" && data.Job != query.Job {
+			continue
+		}
+		if query.Status != "" && data.Status != query.Status {
+			continue
+		}
+		summary := &ale.BuildSummary{
+			BuildID:   buildID,
+			ID:        data.ID,
+			Name:      data.Name,
+			Job:       data.Job,
+			Status:    data.Status,
+			StartTime: data.StartTime,
+			EndTime:   data.EndTime,
+			Duration:  data.Duration,
+		}
+		if crawl, ok := db.Crawls[buildID]; ok {
+			summary.CrawlState = crawl.State
+		}
+		list.Builds = append(list.Builds, summary)
+	}
+	sort.Slice(list.Builds, func(i, j int) bool {
+		a, b := list.Builds[i], list.Builds[j]
+		if a.StartTime != b.StartTime {
+			return (a.StartTime < b.StartTime) == query.Ascending
+		}
+		return (a.BuildID < b.BuildID) == query.Ascending
+	})
+	return list, nil
+}
+
+// RemoveBuilds deletes the builds and their crawl records
+func (db *DB) RemoveBuilds(ctx context.Context, buildIDs []string) (int, error) {
+	removed := 0
+	for _, buildID := range buildIDs {
+		if _, ok := db.Memory[buildID]; ok {
+			removed++
+		}
+		delete(db.Memory, buildID)
+		delete(db.Crawls, buildID)
+	}
+	return removed, nil
+}
@@ -0,0 +1,39 @@
+package mock
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// HTTPGetter is a mock of an http client serving canned responses by path
+type HTTPGetter struct {
+	Responses map[string]string
+	Headers   map[string]http.Header
+	Requested []string
+}
+
+// Get returns the canned response for the path of the uri, or a 404.
+// The requested uris are recorded, including their query.
+func (m *HTTPGetter) Get(uri string) (*http.Response, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	m.Requested = append(m.Requested, u.RequestURI())
+	body, ok := m.Responses[u.Path]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	header := m.Headers[u.Path]
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}, nil
+}
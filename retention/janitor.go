@@ -0,0 +1,217 @@
+package retention
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+)
+
+const (
+	reasonAge   = "age"
+	reasonCount = "count"
+
+	listPageSize = 500
+)
+
+var (
+	prunedBuilds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ale_retention_pruned_builds_total",
+		Help: "Builds removed by the retention policy, or which would have been in dry-run mode.",
+	}, []string{"reason", "dry_run"})
+	runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ale_retention_runs_total",
+		Help: "Runs of the retention janitor, by outcome.",
+	}, []string{"outcome"})
+	lastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ale_retention_last_run_timestamp_seconds",
+		Help: "When the retention janitor last finished a run.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(prunedBuilds, runs, lastRun)
+}
+
+// Janitor periodically removes the builds falling outside the retention policy
+type Janitor struct {
+	database db.Database
+	config   *config.Config
+	now      func() time.Time
+}
+
+// NewJanitor creates a new janitor, call Start to run it in the background
+func NewJanitor(database db.Database, cfg *config.Config) *Janitor {
+	return &Janitor{
+		database: database,
+		config:   cfg,
+		now:      time.Now,
+	}
+}
+
+// Enabled tells whether any retention rule is configured
+func Enabled(cfg *config.Config) bool {
+	return cfg.Retention.MaxAge.Duration > 0 || cfg.Retention.MaxBuildsPerJob > 0
+}
+
+// Start runs the janitor at the configured interval, until the process exits
+func (j *Janitor) Start() {
+	interval := j.config.Retention.Interval.Duration
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	logrus.WithFields(logrus.Fields{
+		"max_age":            j.config.Retention.MaxAge.Duration,
+		"max_builds_per_job": j.config.Retention.MaxBuildsPerJob,
+		"failed_max_age":     j.config.Retention.FailedMaxAge.Duration,
+		"interval":           interval,
+		"dry_run":            j.config.Retention.DryRun,
+	}).Info("starting retention janitor")
+	for {
+		if _, err := j.Run(context.Background()); err != nil {
+			logrus.WithError(err).Error("retention janitor failed")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Run removes the builds falling outside the retention policy, or only
+// reports them in dry-run mode, and returns their IDs. Builds are judged a
+// page at a time, newest first, so that only the count of builds seen for each
+// job is kept in memory.
+func (j *Janitor) Run(ctx context.Context) ([]string, error) {
+	dryRun := j.config.Retention.DryRun
+	sweep := &sweep{config: j.config, now: j.now(), perJob: make(map[string]int)}
+	var buildIDs []string
+	listed := 0
+	err := j.eachPage(ctx, func(builds []*ale.BuildSummary) error {
+		listed += len(builds)
+		var pruned []string
+		for _, build := range builds {
+			reason, ok := sweep.expire(build)
+			if !ok {
+				continue
+			}
+			pruned = append(pruned, build.BuildID)
+			logrus.WithFields(logrus.Fields{
+				"build_id": build.BuildID,
+				"job":      build.Job,
+				"reason":   reason,
+				"dry_run":  dryRun,
+			}).Debug("pruning build")
+			prunedBuilds.WithLabelValues(reason, boolLabel(dryRun)).Inc()
+		}
+		if !dryRun && len(pruned) > 0 {
+			if _, err := j.database.RemoveBuilds(ctx, pruned); err != nil {
+				return err
+			}
+		}
+		buildIDs = append(buildIDs, pruned...)
+		return nil
+	})
+	if err != nil {
+		runs.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	runs.WithLabelValues("success").Inc()
+	lastRun.Set(float64(j.now().Unix()))
+	logrus.WithFields(logrus.Fields{
+		"builds":  listed,
+		"pruned":  len(buildIDs),
+		"dry_run": dryRun,
+	}).Info("retention janitor finished")
+	return buildIDs, nil
+}
+
+// eachPage pages through every stored build, newest first. The backends
+// walking their builds in one pass, such as the Filestore which has to read
+// every build to list a page, are walked instead and given as a single page.
+func (j *Janitor) eachPage(ctx context.Context, fn func([]*ale.BuildSummary) error) error {
+	if walker, ok := j.database.(db.Walker); ok {
+		var builds []*ale.BuildSummary
+		err := walker.Walk(ctx, "", func(build *ale.BuildSummary) error {
+			builds = append(builds, build)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(builds, func(a, b int) bool {
+			return builds[a].StartTime > builds[b].StartTime
+		})
+		return fn(builds)
+	}
+	query := &ale.BuildQuery{Limit: listPageSize}
+	for {
+		list, err := j.database.List(ctx, query)
+		if err != nil {
+			return err
+		}
+		if err := fn(list.Builds); err != nil {
+			return err
+		}
+		if list.NextCursor == "" {
+			return nil
+		}
+		query.Cursor = list.NextCursor
+	}
+}
+
+// sweep judges the builds of a run, which it has to be given newest first
+type sweep struct {
+	config *config.Config
+	now    time.Time
+	perJob map[string]int
+}
+
+// expire tells which rule removes the build, if any. Builds still being
+// crawled are always kept, and failed builds are kept until they reach the
+// failed max age even if there are too many of them. Builds without a job are
+// only removed by age.
+func (s *sweep) expire(build *ale.BuildSummary) (string, bool) {
+	policy := s.config.Retention
+	if build.CrawlState == ale.CrawlQueued || build.CrawlState == ale.CrawlRunning {
+		return "", false
+	}
+	// Builds stored before their job was recorded can't be counted per job
+	if build.Job != "" {
+		s.perJob[build.Job]++
+	}
+
+	maxAge := policy.MaxAge.Duration
+	failed := isFailed(build.Status) && policy.FailedMaxAge.Duration > 0
+	if failed {
+		maxAge = policy.FailedMaxAge.Duration
+	}
+	var age time.Duration
+	if build.StartTime > 0 {
+		age = s.now.Sub(time.Unix(0, int64(build.StartTime)*int64(time.Millisecond)))
+	}
+
+	switch {
+	case maxAge > 0 && age > maxAge:
+		return reasonAge, true
+	case policy.MaxBuildsPerJob > 0 && build.Job != "" && s.perJob[build.Job] > policy.MaxBuildsPerJob && !failed:
+		return reasonCount, true
+	}
+	return "", false
+}
+
+// isFailed tells whether the build failed, going by the statuses of the
+// workflow API which builds are stored with
+func isFailed(status string) bool {
+	return status == "FAILED" || status == "UNSTABLE"
+}
+
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
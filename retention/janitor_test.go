@@ -0,0 +1,201 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/config"
+	"github.com/alde/ale/db"
+	"github.com/alde/ale/mock"
+)
+
+var now = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func daysAgo(days int) int {
+	return int(now.Add(-time.Duration(days)*24*time.Hour).UnixNano() / int64(time.Millisecond))
+}
+
+func fixture() *mock.DB {
+	return &mock.DB{
+		Memory: map[string]*ale.JenkinsData{
+			"app-1":   {Job: "app", Status: "SUCCESS", StartTime: daysAgo(40)},
+			"app-2":   {Job: "app", Status: "FAILED", StartTime: daysAgo(35)},
+			"app-3":   {Job: "app", Status: "SUCCESS", StartTime: daysAgo(3)},
+			"app-4":   {Job: "app", Status: "SUCCESS", StartTime: daysAgo(2)},
+			"app-5":   {Job: "app", Status: "SUCCESS", StartTime: daysAgo(1)},
+			"lib-1":   {Job: "lib", Status: "SUCCESS", StartTime: daysAgo(5)},
+			"running": {Job: "lib", Status: "", StartTime: daysAgo(60)},
+		},
+		Crawls: map[string]*ale.Crawl{
+			"running": {BuildID: "running", State: ale.CrawlRunning},
+			"app-1":   {BuildID: "app-1", State: ale.CrawlFinished},
+		},
+	}
+}
+
+func newJanitor(database *mock.DB, setup func(cfg *config.Config)) *Janitor {
+	cfg := config.DefaultConfig()
+	setup(cfg)
+	j := NewJanitor(database, cfg)
+	j.now = func() time.Time { return now }
+	return j
+}
+
+func sorted(ids []string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func Test_Enabled(t *testing.T) {
+	cfg := config.DefaultConfig()
+	assert.False(t, Enabled(cfg))
+	cfg.Retention.MaxBuildsPerJob = 10
+	assert.True(t, Enabled(cfg))
+}
+
+func Test_RunMaxAge(t *testing.T) {
+	database := fixture()
+	j := newJanitor(database, func(cfg *config.Config) {
+		cfg.Retention.MaxAge = config.Duration{Duration: 30 * 24 * time.Hour}
+	})
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-2"}, sorted(removed))
+	assert.NotContains(t, database.Memory, "app-1")
+	assert.NotContains(t, database.Crawls, "app-1")
+	assert.Contains(t, database.Memory, "running", "builds being crawled are kept")
+}
+
+func Test_RunMaxBuildsPerJob(t *testing.T) {
+	database := fixture()
+	j := newJanitor(database, func(cfg *config.Config) {
+		cfg.Retention.MaxBuildsPerJob = 2
+	})
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-2", "app-3"}, sorted(removed))
+	assert.Contains(t, database.Memory, "lib-1")
+}
+
+func Test_RunKeepsFailedLonger(t *testing.T) {
+	database := fixture()
+	j := newJanitor(database, func(cfg *config.Config) {
+		cfg.Retention.MaxAge = config.Duration{Duration: 30 * 24 * time.Hour}
+		cfg.Retention.MaxBuildsPerJob = 2
+		cfg.Retention.FailedMaxAge = config.Duration{Duration: 90 * 24 * time.Hour}
+	})
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-3"}, sorted(removed))
+	assert.Contains(t, database.Memory, "app-2")
+}
+
+func Test_RunBuildsWithoutJob(t *testing.T) {
+	database := &mock.DB{
+		Memory: map[string]*ale.JenkinsData{
+			"legacy-1": {Status: "SUCCESS", StartTime: daysAgo(10)},
+			"legacy-2": {Status: "SUCCESS", StartTime: daysAgo(20)},
+			"legacy-3": {Status: "SUCCESS", StartTime: daysAgo(50)},
+		},
+	}
+	j := newJanitor(database, func(cfg *config.Config) {
+		cfg.Retention.MaxAge = config.Duration{Duration: 30 * 24 * time.Hour}
+		cfg.Retention.MaxBuildsPerJob = 1
+	})
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"legacy-3"}, removed, "builds without a job are only pruned by age")
+}
+
+func Test_RunDryRun(t *testing.T) {
+	database := fixture()
+	j := newJanitor(database, func(cfg *config.Config) {
+		cfg.Retention.MaxAge = config.Duration{Duration: 30 * 24 * time.Hour}
+		cfg.Retention.DryRun = true
+	})
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-2"}, sorted(removed))
+	assert.Len(t, database.Memory, 7)
+}
+
+type failingList struct {
+	*mock.DB
+}
+
+func (f failingList) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	return nil, errors.New("unavailable")
+}
+
+func Test_RunListError(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Retention.MaxBuildsPerJob = 1
+	j := NewJanitor(failingList{fixture()}, cfg)
+
+	removed, err := j.Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Nil(t, removed)
+}
+
+// paged lists the builds two at a time
+type paged struct {
+	*mock.DB
+}
+
+func (p paged) List(ctx context.Context, query *ale.BuildQuery) (*ale.BuildList, error) {
+	list, _ := p.DB.List(ctx, &ale.BuildQuery{})
+	pageQuery := *query
+	pageQuery.Limit = 2
+	return db.Paginate(list.Builds, &pageQuery)
+}
+
+func Test_RunPages(t *testing.T) {
+	database := fixture()
+	cfg := config.DefaultConfig()
+	cfg.Retention.MaxAge = config.Duration{Duration: 30 * 24 * time.Hour}
+	cfg.Retention.MaxBuildsPerJob = 2
+	cfg.Retention.FailedMaxAge = config.Duration{Duration: 90 * 24 * time.Hour}
+	j := NewJanitor(paged{database}, cfg)
+	j.now = func() time.Time { return now }
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-3"}, sorted(removed))
+	assert.Len(t, database.Memory, 5)
+}
+
+func Test_RunFilestore(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "retention")
+	defer os.RemoveAll(folder)
+	database, _ := db.NewFilestore(folder, db.CompressionNone)
+	source := fixture()
+	for buildID, data := range source.Memory {
+		database.Put(context.Background(), data, buildID)
+	}
+	for _, crawl := range source.Crawls {
+		database.PutCrawl(context.Background(), crawl)
+	}
+	cfg := config.DefaultConfig()
+	cfg.Retention.MaxBuildsPerJob = 2
+	j := NewJanitor(database, cfg)
+	j.now = func() time.Time { return now }
+
+	removed, err := j.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app-2", "app-3"}, sorted(removed))
+	exists, _ := database.Has(context.Background(), "app-3")
+	assert.False(t, exists)
+}
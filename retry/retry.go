@@ -0,0 +1,26 @@
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Permanent tells whether a response with the status code means that retrying
+// the request is pointless. Connection failures, reported as status 0,
+// timeouts, throttling and server errors are worth retrying.
+func Permanent(status int) bool {
+	switch status {
+	case 0, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status < 500
+}
+
+// Jitter spreads a delay over [d/2, 3d/2) so retries don't come in lockstep
+func Jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,26 @@
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Permanent(t *testing.T) {
+	for _, status := range []int{0, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway} {
+		assert.False(t, Permanent(status), "%d", status)
+	}
+	for _, status := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusGone} {
+		assert.True(t, Permanent(status), "%d", status)
+	}
+}
+
+func Test_Jitter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), Jitter(0))
+	for i := 0; i < 100; i++ {
+		delay := Jitter(time.Second)
+		assert.True(t, delay >= 500*time.Millisecond && delay < 1500*time.Millisecond, "%v", delay)
+	}
+}
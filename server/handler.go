@@ -1,16 +1,25 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alde/ale"
 	"github.com/alde/ale/db"
 	"github.com/sirupsen/logrus"
 
+	"github.com/alde/ale/callback"
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/events"
 	"github.com/alde/ale/jenkins"
 	"github.com/alde/ale/version"
 	"github.com/google/uuid"
@@ -19,14 +28,22 @@ import (
 
 // Handler holds the server context
 type Handler struct {
-	config         *config.Config
-	database       db.Database
-	crawlerCreator func(db.Database, *config.Config) *jenkins.Crawler
+	config        *config.Config
+	database      db.Database
+	jenkinsClient *jenkins.Client
+	crawls        *jenkins.Manager
+	webhook       *jenkins.Webhook
 }
 
 // NewHandler createss a new HTTP handler
-func NewHandler(cfg *config.Config, db db.Database) *Handler {
-	return &Handler{config: cfg, database: db, crawlerCreator: jenkins.NewCrawler}
+func NewHandler(cfg *config.Config, db db.Database, client *jenkins.Client, crawls *jenkins.Manager) *Handler {
+	return &Handler{
+		config:        cfg,
+		database:      db,
+		jenkinsClient: client,
+		crawls:        crawls,
+		webhook:       jenkins.NewWebhook(cfg),
+	}
 }
 
 // ServiceMetadata displays hopefully useful information about the service
@@ -43,9 +60,11 @@ func (h *Handler) ServiceMetadata() http.HandlerFunc {
 
 // ProcessRequest represents the json payload of the request
 type ProcessRequest struct {
-	BuildID  string `json:"buildId,omitempty"`
-	BuildURL string `json:"buildUrl"`
-	Recrawl  bool   `json:"forceRecrawl,omitempty"`
+	BuildID        string `json:"buildId,omitempty"`
+	BuildURL       string `json:"buildUrl"`
+	Recrawl        bool   `json:"forceRecrawl,omitempty"`
+	CallbackURL    string `json:"callbackUrl,omitempty"`
+	CallbackSecret string `json:"callbackSecret,omitempty"`
 }
 
 // ProcessResponse represents the response from a requested processing
@@ -76,64 +95,595 @@ func (h *Handler) ProcessBuild() http.HandlerFunc {
 			handleError(err, w, "build_url is required")
 			return
 		}
+		if request.CallbackURL != "" {
+			if err := callback.Validate(request.CallbackURL, h.config); err != nil {
+				writeError(http.StatusBadRequest, err.Error(), w)
+				return
+			}
+		}
 		if request.BuildID == "" {
 			request.BuildID = uuid.New().String()
 		}
+		if h.crawls.Crawling(request.BuildID) {
+			h.writeActiveCrawl(r.Context(), request.BuildID, w)
+			return
+		}
 
-		exists, err := h.database.Has(request.BuildID)
+		exists, err := h.database.Has(r.Context(), request.BuildID)
 		if err != nil {
 			logrus.WithError(err).Warn("unable to check for existance of database entry")
 		}
 		if !exists {
-			if resp0, err := http.Head(request.BuildURL); err != nil || resp0.StatusCode != http.StatusOK {
+			resp0, err := h.jenkinsClient.Head(request.BuildURL)
+			if err != nil {
+				writeJSON(http.StatusBadRequest, "error checking build_url", w)
+				return
+			}
+			defer resp0.Body.Close()
+			if resp0.StatusCode != http.StatusOK {
 				writeJSON(http.StatusBadRequest, "error checking build_url", w)
 				return
 			}
 		}
 
-		url := absURL(r, fmt.Sprintf("/api/v1/build/%s", request.BuildID), h.config)
+		location := absURL(r, fmt.Sprintf("/api/v1/build/%s", request.BuildID), h.config)
 		response := &ProcessResponse{
-			Location: url,
+			Location: location,
 		}
 		if exists && !request.Recrawl {
 			writeJSON(http.StatusFound, response, w)
 			return
 		}
 		if exists && request.Recrawl {
-			h.database.Remove(request.BuildID)
+			h.database.Remove(r.Context(), request.BuildID)
 		}
 
-		go func() {
-			crawler := h.crawlerCreator(h.database, h.config)
-			crawler.CrawlJenkins(request.BuildURL, request.BuildID)
-		}()
+		crawl := &ale.Crawl{
+			BuildID:        request.BuildID,
+			BuildURL:       request.BuildURL,
+			CallbackURL:    request.CallbackURL,
+			CallbackSecret: request.CallbackSecret,
+			Location:       location,
+		}
+		queued, err := h.crawls.EnqueueCrawl(r.Context(), crawl)
+		if err == jenkins.ErrQueueFull {
+			writeError(http.StatusTooManyRequests, err.Error(), w)
+			return
+		}
+		if !queued {
+			h.writeActiveCrawl(r.Context(), request.BuildID, w)
+			return
+		}
 		writeJSON(http.StatusCreated, response, w)
 		return
 	}
 }
 
-// GetJenkinsBuild returns data about the given build
+// writeActiveCrawl answers a request for a build which is already being
+// crawled with the state of that crawl. It neither notifies the callback of
+// the request nor honours forceRecrawl, so the caller is told about it instead.
+func (h *Handler) writeActiveCrawl(ctx context.Context, buildID string, w http.ResponseWriter) {
+	active, err := h.database.GetCrawl(ctx, buildID)
+	if err != nil {
+		writeError(http.StatusConflict, "build is already being crawled", w)
+		return
+	}
+	writeJSON(http.StatusConflict, withoutSecret(active), w)
+}
+
+// WebhookResponse tells what became of a build reported by a webhook
+type WebhookResponse struct {
+	BuildID  string `json:"buildId"`
+	Location string `json:"location"`
+	Queued   bool   `json:"queued"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ReceiveWebhook enqueues the crawl of the builds reported by the Jenkins
+// Notification plugin, or any webhook posting the url of a build
+func (h *Handler) ReceiveWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.webhook.Enabled() {
+			notFound(w)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			handleError(err, w, "unable to read payload")
+			return
+		}
+		if !h.webhook.Verify(r, body) {
+			writeError(http.StatusUnauthorized, "invalid webhook secret", w)
+			return
+		}
+		event, err := jenkins.ParseWebhook(body)
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error(), w)
+			return
+		}
+		response := &WebhookResponse{
+			BuildID:  event.BuildID,
+			Location: absURL(r, fmt.Sprintf("/api/v1/build/%s", event.BuildID), h.config),
+		}
+		fields := logrus.Fields{"build_id": event.BuildID, "job": event.Job, "phase": event.Phase}
+		if event.Phase == jenkins.PhaseQueued {
+			response.Reason = "build has not started"
+			writeJSON(http.StatusOK, response, w)
+			return
+		}
+		if !h.webhook.Accepts(event.Job) {
+			logrus.WithFields(fields).Debug("ignoring webhook for excluded job")
+			response.Reason = "job is excluded"
+			writeJSON(http.StatusOK, response, w)
+			return
+		}
+		if h.crawled(r, event.BuildID) {
+			response.Reason = "build is already crawled"
+			writeJSON(http.StatusOK, response, w)
+			return
+		}
+
+		crawl := &ale.Crawl{
+			BuildID:  event.BuildID,
+			BuildURL: event.BuildURL,
+			Location: response.Location,
+		}
+		queued, err := h.crawls.EnqueueCrawl(r.Context(), crawl)
+		if err == jenkins.ErrQueueFull {
+			writeError(http.StatusTooManyRequests, err.Error(), w)
+			return
+		}
+		if !queued {
+			response.Reason = "build is being crawled"
+			writeJSON(http.StatusOK, response, w)
+			return
+		}
+		logrus.WithFields(fields).Info("enqueued crawl from webhook")
+		response.Queued = true
+		writeJSON(http.StatusAccepted, response, w)
+	}
+}
+
+// crawled tells whether the build is stored and done with, so that the
+// webhooks of later phases of a build don't crawl it over again
+func (h *Handler) crawled(r *http.Request, buildID string) bool {
+	exists, err := h.database.Has(r.Context(), buildID)
+	if err != nil {
+		logrus.WithError(err).Warn("unable to check for existance of database entry")
+	}
+	if !exists {
+		return false
+	}
+	crawl, err := h.database.GetCrawl(r.Context(), buildID)
+	if err == db.ErrNotFound {
+		return true
+	}
+	return err == nil && crawl.State == ale.CrawlFinished
+}
+
+// GetJenkinsBuild returns data about the given build, as JSON or as plain
+// text depending on the Accept header
 func (h *Handler) GetJenkinsBuild() http.HandlerFunc {
+	return h.getBuild(false)
+}
+
+// GetBuildLogText returns the logs of the given build as plain text
+func (h *Handler) GetBuildLogText() http.HandlerFunc {
+	return h.getBuild(true)
+}
+
+func (h *Handler) getBuild(text bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 		vars := mux.Vars(r)
 		buildID := vars["id"]
-		if exists, _ := h.database.Has(buildID); !exists {
+		if !h.buildExists(w, r, buildID) {
+			return
+		}
+		data, err := h.database.Get(r.Context(), buildID)
+
+		if err != nil {
+			handleError(err, w, "unable to query from database")
+			return
+		}
+		if !text {
+			w.Header().Set("Vary", "Accept")
+		}
+		if text || prefersText(r) {
+			w.Header().Set("Content-Type", contentTypeText)
+			writeBuildText(w, data)
+			return
+		}
+		writeJSON(http.StatusOK, data, w)
+	}
+}
+
+// GetBuildLogArchive returns a gzipped tarball of the logs of the given build,
+// with one file per stage
+func (h *Handler) GetBuildLogArchive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		buildID := mux.Vars(r)["id"]
+		if !h.buildExists(w, r, buildID) {
+			return
+		}
+		data, err := h.database.Get(r.Context(), buildID)
+		if err != nil {
+			handleError(err, w, "unable to query from database")
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeTarGz)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": buildID + ".tar.gz",
+		}))
+		if err := writeBuildArchive(w, data); err != nil {
+			logrus.WithError(err).WithField("buildId", buildID).Warn("unable to write log archive")
+		}
+	}
+}
+
+// GetStages returns the stages of the given build, without their logs
+func (h *Handler) GetStages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		buildID := mux.Vars(r)["id"]
+		if !h.buildExists(w, r, buildID) {
+			return
+		}
+		stages, err := db.Stages(r.Context(), h.database, buildID)
+		if err != nil {
+			handleError(err, w, "unable to query from database")
+			return
+		}
+		writeJSON(http.StatusOK, &ale.StageList{BuildID: buildID, Stages: stages}, w)
+	}
+}
+
+// GetStageLog returns the log of a stage of the given build, picked by its
+// index or name, optionally limited to the lines from and to. It's rendered
+// as JSON or as plain text depending on the Accept header.
+func (h *Handler) GetStageLog() http.HandlerFunc {
+	return h.getStageLog(false)
+}
+
+// GetStageLogText returns the log of a stage of the given build as plain text
+func (h *Handler) GetStageLogText() http.HandlerFunc {
+	return h.getStageLog(true)
+}
+
+func (h *Handler) getStageLog(text bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		vars := mux.Vars(r)
+		buildID := vars["id"]
+		from, to, err := parseLineRange(r.URL.Query())
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error(), w)
+			return
+		}
+		if !h.buildExists(w, r, buildID) {
+			return
+		}
+		index, err := strconv.Atoi(vars["stage"])
+		if err != nil {
+			stages, err := db.Stages(r.Context(), h.database, buildID)
+			if err != nil {
+				handleError(err, w, "unable to query from database")
+				return
+			}
+			index = findStage(stages, vars["stage"])
+		}
+		log, err := db.StageLog(r.Context(), h.database, buildID, index, from, to)
+		if err == db.ErrStageNotFound {
+			writeError(http.StatusNotFound, "stage not found in build", w)
+			return
+		}
+		if err != nil {
+			handleError(err, w, "unable to query from database")
+			return
+		}
+		if !text {
+			w.Header().Set("Vary", "Accept")
+		}
+		if text || prefersText(r) {
+			w.Header().Set("Content-Type", contentTypeText)
+			writeStageText(w, log)
+			return
+		}
+		writeJSON(http.StatusOK, log, w)
+	}
+}
+
+// buildExists answers 404 if the build isn't stored
+func (h *Handler) buildExists(w http.ResponseWriter, r *http.Request, buildID string) bool {
+	if exists, _ := h.database.Has(r.Context(), buildID); !exists {
+		data := make(map[string]string)
+		data["buildID"] = buildID
+		data["message"] = "build not found in database, has it been processed?"
+		writeJSON(http.StatusNotFound, data, w)
+		return false
+	}
+	return true
+}
+
+// findStage returns the index of the stage with the given path, or else of the
+// first stage with the given name, and -1 if there is none
+func findStage(stages []*ale.StageInfo, name string) int {
+	for _, stage := range stages {
+		if stage.Path == name {
+			return stage.Index
+		}
+	}
+	for _, stage := range stages {
+		if stage.Name == name {
+			return stage.Index
+		}
+	}
+	return -1
+}
+
+// parseLineRange reads the first and last line wanted of a log, numbered from 1
+func parseLineRange(values url.Values) (int, int, error) {
+	var from, to int
+	var err error
+	if value := values.Get("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil || from < 1 {
+			return 0, 0, fmt.Errorf("from must be a positive line number")
+		}
+	}
+	if value := values.Get("to"); value != "" {
+		if to, err = strconv.Atoi(value); err != nil || to < 1 {
+			return 0, 0, fmt.Errorf("to must be a positive line number")
+		}
+		if to < from {
+			return 0, 0, fmt.Errorf("to must not be before from")
+		}
+	}
+	return from, to, nil
+}
+
+// streamHeartbeat is how often an idle stream sends a comment, to keep
+// proxies from closing the connection
+var streamHeartbeat = 15 * time.Second
+
+// StreamBuild follows the crawl of the given build with Server-Sent Events.
+// The stored state of the build is sent first, then the stages, log lines and
+// statuses discovered by every poll, until an end event once the crawl is over.
+func (h *Handler) StreamBuild() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		buildID := mux.Vars(r)["id"]
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(http.StatusInternalServerError, "streaming is not supported", w)
+			return
+		}
+		// Subscribing first, the updates published while reading the stored state aren't missed
+		subscription := h.crawls.Updates().Subscribe(buildID)
+		defer subscription.Close()
+
+		var current *ale.JenkinsData
+		if exists, _ := h.database.Has(r.Context(), buildID); exists {
+			var err error
+			if current, err = h.database.Get(r.Context(), buildID); err != nil {
+				handleError(err, w, "unable to query from database")
+				return
+			}
+		}
+		state := ale.CrawlFinished
+		crawl, err := h.database.GetCrawl(r.Context(), buildID)
+		if err == nil {
+			state = crawl.State
+		} else if current == nil {
 			data := make(map[string]string)
 			data["buildID"] = buildID
 			data["message"] = "build not found in database, has it been processed?"
 			writeJSON(http.StatusNotFound, data, w)
 			return
 		}
-		data, err := h.database.Get(buildID)
 
+		w.Header().Set("Content-Type", contentTypeEventStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		writeEvents(w, events.Diff(buildID, nil, current))
+		if events.IsFinal(state) {
+			writeEvents(w, []*events.Event{{Name: events.EventEnd, Data: events.Status(buildID, current, state)}})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-subscription.Ready():
+				update := subscription.Next()
+				if update == nil {
+					continue
+				}
+				if update.Build != nil {
+					writeEvents(w, events.Diff(buildID, current, update.Build))
+					current = update.Build
+				}
+				if update.Final() {
+					writeEvents(w, []*events.Event{{Name: events.EventEnd, Data: events.Status(buildID, current, update.State)}})
+					flusher.Flush()
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// GetCrawlStatus returns the state of the crawl of the given build
+func (h *Handler) GetCrawlStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		vars := mux.Vars(r)
+		buildID := vars["id"]
+		crawl, err := h.database.GetCrawl(r.Context(), buildID)
+		if err == db.ErrNotFound {
+			data := make(map[string]string)
+			data["buildID"] = buildID
+			data["message"] = "no crawl found for build, has it been processed?"
+			writeJSON(http.StatusNotFound, data, w)
+			return
+		}
+		if err != nil {
+			handleError(err, w, "unable to query from database")
+			return
+		}
+		writeJSON(http.StatusOK, withoutSecret(crawl), w)
+	}
+}
+
+// withoutSecret copies the crawl record to be shown, leaving out the secret of
+// the callback which is only for signing its notification
+func withoutSecret(crawl *ale.Crawl) *ale.Crawl {
+	status := *crawl
+	status.CallbackSecret = ""
+	return &status
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// ListBuilds returns a page of the stored builds, optionally filtered by job,
+// status, crawl state and start time
+func (h *Handler) ListBuilds() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		query, err := parseBuildQuery(r.URL.Query())
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error(), w)
+			return
+		}
+		list, err := h.database.List(r.Context(), query)
+		if err == db.ErrInvalidCursor {
+			writeError(http.StatusBadRequest, err.Error(), w)
+			return
+		}
 		if err != nil {
 			handleError(err, w, "unable to query from database")
 			return
 		}
-		writeJSON(http.StatusOK, data, w)
+		writeJSON(http.StatusOK, list, w)
+	}
+}
+
+func parseBuildQuery(values url.Values) (*ale.BuildQuery, error) {
+	query := &ale.BuildQuery{
+		Job:        values.Get("job"),
+		Status:     values.Get("status"),
+		CrawlState: values.Get("crawl_state"),
+		Cursor:     values.Get("cursor"),
+		Limit:      defaultListLimit,
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	var err error
+	if query.From, err = parseTime(values.Get("from")); err != nil {
+		return nil, fmt.Errorf("invalid from: %v", err)
+	}
+	if query.To, err = parseTime(values.Get("to")); err != nil {
+		return nil, fmt.Errorf("invalid to: %v", err)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return nil, fmt.Errorf("limit must be a positive number")
+		}
+		if query.Limit > maxListLimit {
+			query.Limit = maxListLimit
+		}
+	}
+	return query, nil
+}
+
+// parseTime accepts either milliseconds since the epoch, like the stored
+// build times, or an RFC3339 timestamp
+func parseTime(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if millis, err := strconv.Atoi(value); err == nil {
+		return millis, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return int(t.UnixNano() / int64(time.Millisecond)), nil
+}
+
+const defaultSearchLimit = 20
+
+// SearchLogs returns the builds whose logs contain every word of the query
+func (h *Handler) SearchLogs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		searcher, ok := h.database.(db.Searcher)
+		if !ok {
+			writeError(http.StatusNotImplemented, "search is not supported by the configured database", w)
+			return
+		}
+		values := r.URL.Query()
+		query := &ale.SearchQuery{
+			Query: strings.TrimSpace(values.Get("q")),
+			Job:   values.Get("job"),
+			Limit: defaultSearchLimit,
+		}
+		if query.Query == "" {
+			writeError(http.StatusBadRequest, "q is required", w)
+			return
+		}
+		if limit := values.Get("limit"); limit != "" {
+			var err error
+			query.Limit, err = strconv.Atoi(limit)
+			if err != nil || query.Limit < 1 {
+				writeError(http.StatusBadRequest, "limit must be a positive number", w)
+				return
+			}
+			if query.Limit > maxListLimit {
+				query.Limit = maxListLimit
+			}
+		}
+		result, err := searcher.Search(r.Context(), query)
+		if err != nil {
+			handleError(err, w, "unable to search the database")
+			return
+		}
+		writeJSON(http.StatusOK, result, w)
 	}
 }
 
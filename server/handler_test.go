@@ -1,6 +1,9 @@
 package server
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,6 +11,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"strings"
 	"testing"
 
@@ -15,6 +20,8 @@ import (
 	"github.com/alde/ale"
 	"github.com/alde/ale/config"
 	"github.com/alde/ale/db"
+	"github.com/alde/ale/events"
+	"github.com/alde/ale/jenkins"
 	"github.com/alde/ale/mock"
 
 	"github.com/gorilla/mux"
@@ -26,7 +33,7 @@ var cfg0 = config.DefaultConfig()
 func Test_ServiceMetadata(t *testing.T) {
 	m := mux.NewRouter()
 
-	h := NewHandler(cfg0, mockDatabase)
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
 	m.HandleFunc("/service-metadata", h.ServiceMetadata())
 	wr := httptest.NewRecorder()
 
@@ -52,7 +59,7 @@ func Test_ServiceMetadata(t *testing.T) {
 func Test_ProcessOptions(t *testing.T) {
 	m := mux.NewRouter()
 
-	h := NewHandler(cfg0, mockDatabase)
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
 	m.HandleFunc("/api/v1/process", h.ProcessOptions())
 	wr := httptest.NewRecorder()
 
@@ -75,9 +82,9 @@ func Test_GetJenkinsBuild(t *testing.T) {
 		BuildID: "buildId",
 		Status:  "IN_PROGRESS",
 	}
-	mockDatabase.Put(jdata, "buildId")
+	mockDatabase.Put(context.Background(), jdata, "buildId")
 
-	h := NewHandler(cfg0, mockDatabase)
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
 	m.HandleFunc("/api/v1/build/{id}", h.GetJenkinsBuild())
 	wr := httptest.NewRecorder()
 
@@ -98,7 +105,7 @@ func Test_GetJenkinsBuildNotFound(t *testing.T) {
 		Client: dbclient,
 	}
 
-	h := NewHandler(cfg0, database)
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
 	m.HandleFunc("/api/v1/build/{id}", h.GetJenkinsBuild())
 	wr := httptest.NewRecorder()
 
@@ -125,7 +132,7 @@ func Test_GetJenkinsBuildError(t *testing.T) {
 		Client: dbclient,
 	}
 
-	h := NewHandler(cfg0, database)
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
 	m.HandleFunc("/api/v1/build/{id}", h.GetJenkinsBuild())
 	wr := httptest.NewRecorder()
 
@@ -137,3 +144,502 @@ func Test_GetJenkinsBuildError(t *testing.T) {
 	body, _ := ioutil.ReadAll(io.LimitReader(wr.Body, 1048576))
 	assert.Contains(t, string(body), actual)
 }
+
+func Test_GetCrawlStatus(t *testing.T) {
+	m := mux.NewRouter()
+	crawl := &ale.Crawl{
+		BuildID:       "crawledId",
+		BuildURL:      "http://jenkins.local/job/foo/1",
+		State:         ale.CrawlRunning,
+		Attempts:      2,
+		JenkinsStatus: "IN_PROGRESS",
+	}
+	mockDatabase.PutCrawl(context.Background(), crawl)
+
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/build/{id}/status", h.GetCrawlStatus())
+	wr := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/api/v1/build/crawledId/status", nil)
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusOK, wr.Code)
+	var actual ale.Crawl
+	json.Unmarshal(wr.Body.Bytes(), &actual)
+	assert.Equal(t, crawl.State, actual.State)
+	assert.Equal(t, crawl.Attempts, actual.Attempts)
+	assert.Equal(t, crawl.JenkinsStatus, actual.JenkinsStatus)
+}
+
+func Test_GetCrawlStatusNotFound(t *testing.T) {
+	for _, database := range []db.Database{
+		&db.Datastore{Client: &mock.Datastore{}},
+		&mock.DB{},
+	} {
+		m := mux.NewRouter()
+		h := NewHandler(cfg0, database, jenkinsClient, crawls)
+		m.HandleFunc("/api/v1/build/{id}/status", h.GetCrawlStatus())
+		wr := httptest.NewRecorder()
+
+		r, _ := http.NewRequest("GET", "/api/v1/build/unknownId/status", nil)
+		m.ServeHTTP(wr, r)
+
+		assert.Equal(t, http.StatusNotFound, wr.Code)
+	}
+}
+
+func Test_ProcessBuildQueueFull(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	m := mux.NewRouter()
+	cfg := config.DefaultConfig()
+	cfg.Crawler.QueueSize = 0
+	full := jenkins.NewManager(mockDatabase, cfg, jenkinsClient)
+
+	h := NewHandler(cfg, mockDatabase, jenkinsClient, full)
+	m.HandleFunc("/api/v1/process", h.ProcessBuild())
+	wr := httptest.NewRecorder()
+
+	payload := `{"buildId": "queueFull", "buildUrl": "` + ts.URL + `/job/foo/1"}`
+	r, _ := http.NewRequest("POST", "/api/v1/process", strings.NewReader(payload))
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, wr.Code)
+}
+
+func Test_ListBuilds(t *testing.T) {
+	m := mux.NewRouter()
+	database := &mock.DB{Memory: map[string]*ale.JenkinsData{
+		"listed":   {Job: "team/app", Status: "SUCCESS"},
+		"unlisted": {Job: "other", Status: "SUCCESS"},
+	}}
+
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/builds", h.ListBuilds())
+	wr := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/api/v1/builds?job=team/app", nil)
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusOK, wr.Code)
+	var actual ale.BuildList
+	json.Unmarshal(wr.Body.Bytes(), &actual)
+	assert.Len(t, actual.Builds, 1)
+	assert.Equal(t, "listed", actual.Builds[0].BuildID)
+}
+
+func Test_ListBuildsInvalidQuery(t *testing.T) {
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/builds", h.ListBuilds())
+
+	for _, query := range []string{"limit=-1", "order=sideways", "from=yesterday"} {
+		wr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/api/v1/builds?"+query, nil)
+		m.ServeHTTP(wr, r)
+		assert.Equal(t, http.StatusBadRequest, wr.Code, query)
+	}
+}
+
+func Test_parseBuildQuery(t *testing.T) {
+	values, _ := url.ParseQuery("from=2019-01-01T00:00:00Z&to=1546304400000&order=asc&limit=1000")
+	query, err := parseBuildQuery(values)
+	assert.Nil(t, err)
+	assert.Equal(t, 1546300800000, query.From)
+	assert.Equal(t, 1546304400000, query.To)
+	assert.True(t, query.Ascending)
+	assert.Equal(t, maxListLimit, query.Limit)
+}
+
+func Test_SearchLogs(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "search")
+	defer os.RemoveAll(folder)
+	database, _ := db.NewFilestore(folder, db.CompressionGzip)
+	database.Put(context.Background(), &ale.JenkinsData{
+		Stages: []*ale.JenkinsStage{
+			{Name: "Build", Logs: []*ale.Log{{Line: "Connection reset by peer"}}},
+		},
+	}, "flaky")
+
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/search", h.SearchLogs())
+	wr := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/api/v1/search?q=reset+by+peer", nil)
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusOK, wr.Code)
+	var actual ale.SearchResult
+	json.Unmarshal(wr.Body.Bytes(), &actual)
+	assert.Len(t, actual.Builds, 1)
+	assert.Equal(t, "flaky", actual.Builds[0].BuildID)
+	assert.Equal(t, 1, actual.Builds[0].Matches[0].Line)
+}
+
+func Test_SearchLogsRequiresQuery(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "search")
+	defer os.RemoveAll(folder)
+	database, _ := db.NewFilestore(folder, db.CompressionGzip)
+
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/search", h.SearchLogs())
+	wr := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/api/v1/search", nil)
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusBadRequest, wr.Code)
+}
+
+func Test_SearchLogsNotSupported(t *testing.T) {
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/search", h.SearchLogs())
+	wr := httptest.NewRecorder()
+
+	r, _ := http.NewRequest("GET", "/api/v1/search?q=reset", nil)
+	m.ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusNotImplemented, wr.Code)
+}
+
+func stagesRouter() *mux.Router {
+	database := &mock.DB{Memory: map[string]*ale.JenkinsData{
+		"staged": {Stages: []*ale.JenkinsStage{
+			{ID: "6", Name: "Build", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}, {Line: "three"}}},
+			{ID: "9", Name: "Test", SubStages: []*ale.JenkinsStage{
+				{ID: "12", Name: "unit", Logs: []*ale.Log{{Line: "ok"}}},
+			}},
+		}},
+	}}
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/build/{id}/stages", h.GetStages())
+	m.HandleFunc("/api/v1/build/{id}/stages/{stage:.+}", h.GetStageLog())
+	return m
+}
+
+func Test_GetStages(t *testing.T) {
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/staged/stages", nil)
+	stagesRouter().ServeHTTP(wr, r)
+
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.NotContains(t, wr.Body.String(), "three")
+	var actual ale.StageList
+	json.Unmarshal(wr.Body.Bytes(), &actual)
+	assert.Len(t, actual.Stages, 3)
+	assert.Equal(t, "Test / unit", actual.Stages[2].Path)
+}
+
+func Test_GetStageLog(t *testing.T) {
+	for _, path := range []string{"0", "Build"} {
+		wr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/api/v1/build/staged/stages/"+path+"?from=2&to=2", nil)
+		stagesRouter().ServeHTTP(wr, r)
+
+		assert.Equal(t, http.StatusOK, wr.Code, path)
+		var actual ale.StageLog
+		json.Unmarshal(wr.Body.Bytes(), &actual)
+		assert.Equal(t, "Build", actual.Stage.Name)
+		assert.Equal(t, []*ale.LogLine{{Number: 2, Line: "two"}}, actual.Lines)
+	}
+
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/staged/stages/Test%20/%20unit", nil)
+	stagesRouter().ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Contains(t, wr.Body.String(), `"line":"ok"`)
+}
+
+func Test_GetStageLogNotFound(t *testing.T) {
+	for path, code := range map[string]int{
+		"/api/v1/build/missing/stages/0":            http.StatusNotFound,
+		"/api/v1/build/staged/stages/7":             http.StatusNotFound,
+		"/api/v1/build/staged/stages/Deploy":        http.StatusNotFound,
+		"/api/v1/build/staged/stages/0?to=-1":       http.StatusBadRequest,
+		"/api/v1/build/staged/stages/0?from=3&to=2": http.StatusBadRequest,
+	} {
+		wr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		stagesRouter().ServeHTTP(wr, r)
+		assert.Equal(t, code, wr.Code, path)
+	}
+}
+
+func logsRouter() *mux.Router {
+	database := &mock.DB{Memory: map[string]*ale.JenkinsData{
+		"staged": {Name: "#7", Status: "FAILURE", Stages: []*ale.JenkinsStage{
+			{Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{TimeStamp: "10:00:00", Line: "compiled"}}},
+			{Name: "Test", Status: "FAILURE", SubStages: []*ale.JenkinsStage{
+				{Name: "unit", Status: "FAILURE", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}}},
+			}},
+		}},
+	}}
+	return NewRouter(cfg0, database, jenkinsClient, crawls)
+}
+
+func Test_GetJenkinsBuildAsText(t *testing.T) {
+	expected := "#7 (FAILURE)\n\n" +
+		"=== Build (SUCCESS) ===\n[10:00:00] compiled\n\n" +
+		"=== Test (FAILURE) ===\n\n" +
+		"=== Test / unit (FAILURE) ===\none\ntwo\n"
+
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/staged", nil)
+	r.Header.Set("Accept", "text/plain")
+	logsRouter().ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, contentTypeText, wr.Header().Get("Content-Type"))
+	assert.Equal(t, expected, wr.Body.String())
+
+	wr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/v1/build/staged/log.txt", nil)
+	logsRouter().ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, expected, wr.Body.String())
+}
+
+func Test_GetStageLogText(t *testing.T) {
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/staged/stages/Test%20/%20unit/log.txt?from=2", nil)
+	logsRouter().ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "=== Test / unit (FAILURE) ===\ntwo\n", wr.Body.String())
+
+	wr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/v1/build/staged/stages/0", nil)
+	r.Header.Set("Accept", "text/plain")
+	logsRouter().ServeHTTP(wr, r)
+	assert.Equal(t, "=== Build (SUCCESS) ===\n[10:00:00] compiled\n", wr.Body.String())
+}
+
+func Test_GetBuildLogArchive(t *testing.T) {
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/staged/logs.tar.gz", nil)
+	logsRouter().ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, `attachment; filename=staged.tar.gz`, wr.Header().Get("Content-Disposition"))
+
+	zr, err := gzip.NewReader(wr.Body)
+	assert.Nil(t, err)
+	tr := tar.NewReader(zr)
+	files := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+	assert.Equal(t, map[string]string{
+		"000-Build.log":     "[10:00:00] compiled\n",
+		"001-Test.log":      "",
+		"002-Test-unit.log": "one\ntwo\n",
+	}, files)
+}
+
+// readEvents reads Server-Sent Events until the stream ends or the named event arrives
+func readEvents(r *bufio.Reader, until string) []string {
+	var names []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return names
+		}
+		if strings.HasPrefix(line, "event: ") {
+			name := strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			names = append(names, name)
+			if name == until {
+				return names
+			}
+		}
+	}
+}
+
+func Test_StreamBuild(t *testing.T) {
+	database := &mock.DB{
+		Memory: map[string]*ale.JenkinsData{
+			"running": {Status: "IN_PROGRESS", Stages: []*ale.JenkinsStage{
+				{ID: "6", Name: "Build", Status: "IN_PROGRESS", Logs: []*ale.Log{{Line: "one"}}},
+			}},
+		},
+		Crawls: map[string]*ale.Crawl{
+			"running": {BuildID: "running", State: ale.CrawlRunning},
+		},
+	}
+	manager := jenkins.NewManager(database, cfg0, jenkinsClient)
+	ts := httptest.NewServer(NewRouter(cfg0, database, jenkinsClient, manager))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/build/running/stream")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, contentTypeEventStream, resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, []string{"build", "stage", "log"}, readEvents(r, "log"))
+
+	manager.Updates().Publish(&events.Update{BuildID: "running", State: ale.CrawlFinished, Build: &ale.JenkinsData{
+		Status: "SUCCESS",
+		Stages: []*ale.JenkinsStage{
+			{ID: "6", Name: "Build", Status: "SUCCESS", Logs: []*ale.Log{{Line: "one"}, {Line: "two"}}},
+		},
+	}})
+	assert.Equal(t, []string{"build", "stage", "log", "end"}, readEvents(r, ""))
+}
+
+func Test_StreamBuildFinished(t *testing.T) {
+	database := &mock.DB{
+		Memory: map[string]*ale.JenkinsData{"done": {Status: "SUCCESS"}},
+		Crawls: make(map[string]*ale.Crawl),
+	}
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, database, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/build/{id}/stream", h.StreamBuild())
+
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/done/stream", nil)
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, []string{"build", "end"}, readEvents(bufio.NewReader(wr.Body), ""))
+
+	wr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/v1/build/missing/stream", nil)
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusNotFound, wr.Code)
+}
+
+func Test_ProcessBuildWithCallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	manager := jenkins.NewManager(database, cfg0, jenkinsClient)
+
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, database, jenkinsClient, manager)
+	m.HandleFunc("/api/v1/process", h.ProcessBuild())
+	m.HandleFunc("/api/v1/build/{id}/status", h.GetCrawlStatus())
+
+	wr := httptest.NewRecorder()
+	payload := `{"buildId": "called", "buildUrl": "` + ts.URL + `/job/foo/1", "callbackUrl": "ftp://ci-bot.local"}`
+	r, _ := http.NewRequest("POST", "/api/v1/process", strings.NewReader(payload))
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusBadRequest, wr.Code)
+
+	wr = httptest.NewRecorder()
+	payload = `{"buildId": "called", "buildUrl": "` + ts.URL + `/job/foo/1",
+		"callbackUrl": "https://ci-bot.local/done", "callbackSecret": "s3cr3t"}`
+	r, _ = http.NewRequest("POST", "/api/v1/process", strings.NewReader(payload))
+	r.Host = "ale.local"
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusCreated, wr.Code)
+
+	crawl, _ := database.GetCrawl(context.Background(), "called")
+	assert.Equal(t, "https://ci-bot.local/done", crawl.CallbackURL)
+	assert.Equal(t, "s3cr3t", crawl.CallbackSecret)
+	assert.Equal(t, "http://ale.local/api/v1/build/called", crawl.Location)
+
+	wr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/api/v1/build/called/status", nil)
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Contains(t, wr.Body.String(), "https://ci-bot.local/done")
+	assert.NotContains(t, wr.Body.String(), "s3cr3t")
+
+	wr = httptest.NewRecorder()
+	payload = `{"buildId": "called", "buildUrl": "` + ts.URL + `/job/foo/1",
+		"callbackUrl": "https://other-bot.local/done"}`
+	r, _ = http.NewRequest("POST", "/api/v1/process", strings.NewReader(payload))
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusConflict, wr.Code)
+	var active ale.Crawl
+	assert.Nil(t, json.Unmarshal(wr.Body.Bytes(), &active))
+	assert.Equal(t, "https://ci-bot.local/done", active.CallbackURL)
+	assert.Equal(t, ale.CrawlQueued, active.State)
+	assert.Empty(t, active.CallbackSecret)
+}
+
+func Test_ReceiveWebhook(t *testing.T) {
+	file, _ := ioutil.TempFile(os.TempDir(), "secret")
+	defer os.Remove(file.Name())
+	file.WriteString("s3cr3t")
+	cfg := config.DefaultConfig()
+	cfg.Webhook.SecretFile = file.Name()
+	cfg.Webhook.Exclude = []string{"sandbox/*"}
+	database := &mock.DB{Memory: make(map[string]*ale.JenkinsData)}
+	database.Put(context.Background(), &ale.JenkinsData{Name: "done"}, "app-1")
+	database.PutCrawl(context.Background(), &ale.Crawl{BuildID: "app-1", State: ale.CrawlFinished})
+	manager := jenkins.NewManager(database, cfg, jenkinsClient)
+
+	m := mux.NewRouter()
+	h := NewHandler(cfg, database, jenkinsClient, manager)
+	m.HandleFunc("/api/v1/webhook/jenkins", h.ReceiveWebhook())
+	m.HandleFunc("/api/v1/build/{id}/status", h.GetCrawlStatus())
+
+	post := func(token string, payload string) (int, *WebhookResponse) {
+		wr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/api/v1/webhook/jenkins?token="+token, strings.NewReader(payload))
+		r.Host = "ale.local"
+		m.ServeHTTP(wr, r)
+		response := &WebhookResponse{}
+		json.Unmarshal(wr.Body.Bytes(), response)
+		return wr.Code, response
+	}
+	started := `{"build": {"full_url": "http://jenkins.local/job/team/job/app/2/", "number": 2, "phase": "STARTED"}}`
+
+	code, _ := post("wrong", started)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = post("s3cr3t", `{"name": "app"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, response := post("s3cr3t", started)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, &WebhookResponse{
+		BuildID:  "team.app-2",
+		Location: "http://ale.local/api/v1/build/team.app-2",
+		Queued:   true,
+	}, response)
+	crawl, _ := database.GetCrawl(context.Background(), "team.app-2")
+	assert.Equal(t, "http://jenkins.local/job/team/job/app/2", crawl.BuildURL)
+	assert.Equal(t, "http://ale.local/api/v1/build/team.app-2", crawl.Location)
+
+	code, response = post("s3cr3t", `{"buildUrl": "http://jenkins.local/job/team.app/2", "phase": "STARTED"}`)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "team~.app-2", response.BuildID)
+	assert.Equal(t, "http://ale.local/api/v1/build/team~.app-2", response.Location)
+
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/api/v1/build/team~.app-2/status", nil)
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Contains(t, wr.Body.String(), "http://jenkins.local/job/team.app/2")
+
+	for payload, reason := range map[string]string{
+		strings.Replace(started, "STARTED", "COMPLETED", 1):                    "build is being crawled",
+		`{"buildUrl": "http://jenkins.local/job/app/3", "phase": "QUEUED"}`:    "build has not started",
+		`{"buildUrl": "http://jenkins.local/job/sandbox/job/app/3"}`:           "job is excluded",
+		`{"buildUrl": "http://jenkins.local/job/app/1", "phase": "FINALIZED"}`: "build is already crawled",
+	} {
+		code, response = post("s3cr3t", payload)
+		assert.Equal(t, http.StatusOK, code, payload)
+		assert.False(t, response.Queued, payload)
+		assert.Equal(t, reason, response.Reason, payload)
+	}
+}
+
+func Test_ReceiveWebhookDisabled(t *testing.T) {
+	m := mux.NewRouter()
+	h := NewHandler(cfg0, mockDatabase, jenkinsClient, crawls)
+	m.HandleFunc("/api/v1/webhook/jenkins", h.ReceiveWebhook())
+
+	wr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/api/v1/webhook/jenkins?token=", strings.NewReader(`{"buildUrl": "http://jenkins.local/job/app/1"}`))
+	m.ServeHTTP(wr, r)
+	assert.Equal(t, http.StatusNotFound, wr.Code)
+}
@@ -2,15 +2,25 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/events"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	contentTypeJSON = "application/json; charset=UTF-8"
+	contentTypeJSON  = "application/json; charset=UTF-8"
+	contentTypeText  = "text/plain; charset=UTF-8"
+	contentTypeTarGz = "application/gzip"
+
+	contentTypeEventStream = "text/event-stream"
 )
 
 func writeJSON(status int, data interface{}, w http.ResponseWriter) error {
@@ -19,6 +29,20 @@ func writeJSON(status int, data interface{}, w http.ResponseWriter) error {
 	return json.NewEncoder(w).Encode(data)
 }
 
+// writeEvents sends the events in the format of Server-Sent Events
+func writeEvents(w io.Writer, batch []*events.Event) error {
+	for _, event := range batch {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func notFound(w http.ResponseWriter) error {
 	return writeError(http.StatusNotFound, "Not Found", w)
 }
@@ -64,3 +88,32 @@ func absURL(r *http.Request, path string, conf *config.Config) string {
 	}
 	return url.String()
 }
+
+// prefersText tells whether the Accept header of the request ranks plain text
+// above JSON. JSON is preferred when they rank the same, or without a header.
+func prefersText(r *http.Request) bool {
+	text, json := 0.0, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/plain", "text/*":
+			if q > text {
+				text = q
+			}
+		case "application/json", "application/*", "*/*":
+			if q > json {
+				json = q
+			}
+		}
+	}
+	return text > json
+}
@@ -32,3 +32,19 @@ func Test_writeError(t *testing.T) {
 	assert.Equal(t, contentTypeJSON, wr.HeaderMap["Content-Type"][0])
 	assert.Equal(t, http.StatusInternalServerError, wr.Code)
 }
+
+func Test_prefersText(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                     false,
+		"*/*":                                  false,
+		"application/json":                     false,
+		"text/plain":                           true,
+		"text/*, application/json;q=0.5":       true,
+		"text/plain;q=0.5, application/json":   false,
+		"text/html, text/plain; charset=UTF-8": true,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		assert.Equal(t, expected, prefersText(r), accept)
+	}
+}
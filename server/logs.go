@@ -0,0 +1,96 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+)
+
+// unsafeFileName matches what is replaced in the names of the archived files
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// writeStageHeader starts the text of a stage with its path and status
+func writeStageHeader(w io.Writer, stage *ale.StageInfo) {
+	fmt.Fprintf(w, "=== %s (%s) ===\n", stage.Path, stage.Status)
+}
+
+// writeLine writes a log line, prefixed with its timestamp when it has one
+func writeLine(w io.Writer, timestamp, line string) {
+	if timestamp != "" {
+		fmt.Fprintf(w, "[%s] %s\n", timestamp, line)
+		return
+	}
+	fmt.Fprintln(w, line)
+}
+
+// writeStageText renders a range of the log of a stage as plain text
+func writeStageText(w io.Writer, log *ale.StageLog) {
+	writeStageHeader(w, log.Stage)
+	for _, line := range log.Lines {
+		writeLine(w, line.TimeStamp, line.Line)
+	}
+}
+
+// writeBuildText renders the logs of every stage of a build as plain text,
+// parents before the stages nested in them
+func writeBuildText(w io.Writer, data *ale.JenkinsData) {
+	fmt.Fprintf(w, "%s (%s)\n", data.Name, data.Status)
+	rows := db.FlattenStages(data.Stages)
+	for i, stage := range db.StageInfos(rows) {
+		fmt.Fprintln(w)
+		writeStageHeader(w, stage)
+		for _, log := range rows[i].Stage.Logs {
+			writeLine(w, log.TimeStamp, log.Line)
+		}
+	}
+}
+
+// writeBuildArchive writes a gzipped tarball holding the log of every stage of
+// a build in a file of its own, named after its index and path
+func writeBuildArchive(w io.Writer, data *ale.JenkinsData) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	rows := db.FlattenStages(data.Stages)
+	for i, stage := range db.StageInfos(rows) {
+		var content bytes.Buffer
+		for _, log := range rows[i].Stage.Logs {
+			writeLine(&content, log.TimeStamp, log.Line)
+		}
+		started := stage.StartTime
+		if started == 0 {
+			started = data.StartTime
+		}
+		header := &tar.Header{
+			Name:    archiveFileName(stage),
+			Mode:    0644,
+			Size:    int64(content.Len()),
+			ModTime: time.Unix(0, int64(started)*int64(time.Millisecond)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// archiveFileName names the file of a stage, such as 003-Test-unit.log for
+// the stage at index 3 with the path "Test / unit"
+func archiveFileName(stage *ale.StageInfo) string {
+	name := strings.Replace(stage.Path, " / ", "-", -1)
+	name = strings.Trim(unsafeFileName.ReplaceAllString(name, "_"), "_")
+	return fmt.Sprintf("%03d-%s.log", stage.Index, name)
+}
@@ -6,15 +6,17 @@ import (
 	"github.com/alde/ale/db"
 
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/jenkins"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // NewRouter is used to create a new HTTP router
-func NewRouter(cfg *config.Config, db db.Database) *mux.Router {
+func NewRouter(cfg *config.Config, db db.Database, client *jenkins.Client, crawls *jenkins.Manager) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	h := NewHandler(cfg, db)
+	h := NewHandler(cfg, db, client, crawls)
 
 	for _, route := range routes(h) {
 		router.
@@ -48,17 +50,84 @@ func routes(h *Handler) []route {
 			Pattern: "/api/v1/process",
 			Handler: h.ProcessBuild(),
 		},
+		{
+			Name:    "ReceiveWebhook",
+			Method:  "POST",
+			Pattern: "/api/v1/webhook/jenkins",
+			Handler: h.ReceiveWebhook(),
+		},
+		{
+			Name:    "ListBuilds",
+			Method:  "GET",
+			Pattern: "/api/v1/builds",
+			Handler: h.ListBuilds(),
+		},
+		{
+			Name:    "SearchLogs",
+			Method:  "GET",
+			Pattern: "/api/v1/search",
+			Handler: h.SearchLogs(),
+		},
 		{
 			Name:    "GetBuild",
 			Method:  "GET",
 			Pattern: "/api/v1/build/{id}",
 			Handler: h.GetJenkinsBuild(),
 		},
+		{
+			Name:    "GetCrawlStatus",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/status",
+			Handler: h.GetCrawlStatus(),
+		},
+		{
+			Name:    "StreamBuild",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/stream",
+			Handler: h.StreamBuild(),
+		},
+		{
+			Name:    "GetStages",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/stages",
+			Handler: h.GetStages(),
+		},
+		{
+			Name:    "GetBuildLogText",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/log.txt",
+			Handler: h.GetBuildLogText(),
+		},
+		{
+			Name:    "GetBuildLogArchive",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/logs.tar.gz",
+			Handler: h.GetBuildLogArchive(),
+		},
+		{
+			// Ahead of GetStageLog, whose stage would otherwise swallow the suffix
+			Name:    "GetStageLogText",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/stages/{stage:.+}/log.txt",
+			Handler: h.GetStageLogText(),
+		},
+		{
+			Name:    "GetStageLog",
+			Method:  "GET",
+			Pattern: "/api/v1/build/{id}/stages/{stage:.+}",
+			Handler: h.GetStageLog(),
+		},
 		{
 			Name:    "ServiceMetadata",
 			Method:  "GET",
 			Pattern: "/service-metadata",
 			Handler: h.ServiceMetadata(),
 		},
+		{
+			Name:    "Metrics",
+			Method:  "GET",
+			Pattern: "/metrics",
+			Handler: promhttp.Handler(),
+		},
 	}
 }
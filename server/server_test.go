@@ -6,6 +6,7 @@ import (
 	"github.com/alde/ale"
 
 	"github.com/alde/ale/config"
+	"github.com/alde/ale/jenkins"
 	"github.com/alde/ale/mock"
 
 	"github.com/stretchr/testify/assert"
@@ -16,11 +17,13 @@ var (
 	mockDatabase = &mock.DB{
 		Memory: make(map[string]*ale.JenkinsData),
 	}
+	jenkinsClient, _ = jenkins.NewClient(cfg)
+	crawls           = jenkins.NewManager(mockDatabase, config.DefaultConfig(), jenkinsClient)
 )
 
 func Test_NewRouter(t *testing.T) {
-	h := NewHandler(cfg, mockDatabase)
-	nr := NewRouter(cfg, mockDatabase)
+	h := NewHandler(cfg, mockDatabase, jenkinsClient, crawls)
+	nr := NewRouter(cfg, mockDatabase, jenkinsClient, crawls)
 
 	for _, r := range routes(h) {
 		assert.NotNil(t, nr.GetRoute(r.Name))
@@ -28,6 +31,6 @@ func Test_NewRouter(t *testing.T) {
 }
 
 func Test_routes(t *testing.T) {
-	h := NewHandler(cfg, mockDatabase)
-	assert.Len(t, routes(h), 4, "4 routes is the magic number.")
+	h := NewHandler(cfg, mockDatabase, jenkinsClient, crawls)
+	assert.Len(t, routes(h), 15, "15 routes is the magic number.")
 }
@@ -1,5 +1,7 @@
 package ale
 
+import "time"
+
 // Link represents a relative uri deeper into the Jenkins API
 type Link struct {
 	Href string `json:"href"`
@@ -22,6 +24,17 @@ type JobData struct {
 	PauseDurationMillis int        `json:"pauseDurationMillis"`
 }
 
+// BuildInfo holds parts of the generic Jenkins API description of a build
+type BuildInfo struct {
+	Class           string `json:"_class"`
+	ID              string `json:"id"`
+	FullDisplayName string `json:"fullDisplayName"`
+	Building        bool   `json:"building"`
+	Result          string `json:"result"`
+	Timestamp       int    `json:"timestamp"`
+	Duration        int    `json:"duration"`
+}
+
 // JobStage holds information about a stage of a job
 type JobStage struct {
 	Links struct {
@@ -76,6 +89,7 @@ type JenkinsData struct {
 	Stages        []*JenkinsStage `json:"stages"`
 	Status        string          `json:"status"`
 	Name          string          `json:"name"`
+	Job           string          `json:"job,omitempty"`
 	ID            string          `json:"id"`
 	BuildID       string          `json:"build_id"`
 	StartTime     int             `json:"start_time"`
@@ -85,13 +99,18 @@ type JenkinsData struct {
 	PauseDuration int             `json:"pause_duration"`
 }
 
-// JenkinsStage holds the output from a given stage
+// JenkinsStage holds the output from a given stage. Parallel branches and
+// nested stages are kept as a tree of SubStages, with the steps as leaves.
 type JenkinsStage struct {
+	ID          string          `json:"id,omitempty"`
 	Status      string          `json:"status"`
 	Name        string          `json:"name"`
 	Logs        []*Log          `json:"log"`
 	LogLength   int             `json:"log_length"`
+	LogOffset   int             `json:"log_offset,omitempty"`
+	LogTail     string          `json:"log_tail,omitempty"`
 	SubStages   []*JenkinsStage `json:"substage"`
+	Branch      string          `json:"branch,omitempty"`
 	StartTime   int             `json:"start_time"`
 	Duration    int             `json:"duration"`
 	Task        string          `json:"task"`
@@ -104,8 +123,161 @@ type Log struct {
 	Line      string `json:"line"`
 }
 
-// DatastoreEntity is used to store data in datastore, and prevent indexing of the huge json
+// DatastoreEntity is used to store data in datastore, and prevent indexing of the huge json.
+// Builds are stored as a compressed payload in Data, split over Chunks entities when
+// too large for one. The chunks of each version of a build are keyed by its Generation,
+// so that writing the entity switches to them at once. Value holds the builds stored
+// before compression was introduced.
 type DatastoreEntity struct {
-	Key   string      `json:"key" datastore:"key"`
-	Value JenkinsData `json:"value" datastore:"value,noindex"`
+	Key        string      `json:"key" datastore:"key"`
+	Value      JenkinsData `json:"value" datastore:"value,noindex"`
+	Data       []byte      `json:"data,omitempty" datastore:"data,noindex"`
+	Chunks     int         `json:"chunks,omitempty" datastore:"chunks,noindex"`
+	Generation int64       `json:"generation,omitempty" datastore:"generation,noindex"`
+}
+
+// DatastoreChunk holds the continuation of a payload too large for a single DatastoreEntity
+type DatastoreChunk struct {
+	Data []byte `json:"data" datastore:"data,noindex"`
+}
+
+// The states a crawl goes through
+const (
+	CrawlQueued   = "QUEUED"
+	CrawlRunning  = "CRAWLING"
+	CrawlFinished = "FINISHED"
+	CrawlFailed   = "FAILED"
+	CrawlTimeout  = "CRAWL_TIMEOUT"
+)
+
+// Crawl holds the lifecycle of the crawl of a build
+type Crawl struct {
+	BuildID       string    `json:"build_id" datastore:"build_id"`
+	BuildURL      string    `json:"build_url" datastore:"build_url,noindex"`
+	State         string    `json:"state" datastore:"state"`
+	Attempts      int       `json:"attempts" datastore:"attempts,noindex"`
+	Created       time.Time `json:"created" datastore:"created"`
+	LastPoll      time.Time `json:"last_poll" datastore:"last_poll,noindex"`
+	LastError     string    `json:"last_error,omitempty" datastore:"last_error,noindex"`
+	JenkinsStatus string    `json:"jenkins_status,omitempty" datastore:"jenkins_status"`
+
+	// CallbackURL is notified once the crawl is over, with a body signed using CallbackSecret
+	CallbackURL    string     `json:"callback_url,omitempty" datastore:"callback_url,noindex"`
+	CallbackSecret string     `json:"callback_secret,omitempty" datastore:"callback_secret,noindex"`
+	Location       string     `json:"location,omitempty" datastore:"location,noindex"`
+	Deliveries     []Delivery `json:"deliveries,omitempty" datastore:"deliveries,noindex"`
+}
+
+// Delivery records an attempt at notifying the callback url of a crawl
+type Delivery struct {
+	Attempt    int       `json:"attempt" datastore:"attempt,noindex"`
+	Time       time.Time `json:"time" datastore:"time,noindex"`
+	StatusCode int       `json:"status_code,omitempty" datastore:"status_code,noindex"`
+	Error      string    `json:"error,omitempty" datastore:"error,noindex"`
+}
+
+// BuildQuery holds the filters and the page requested when listing builds.
+// From and To bound the start time of the builds, in milliseconds.
+type BuildQuery struct {
+	Job        string
+	Status     string
+	CrawlState string
+	From       int
+	To         int
+	Ascending  bool
+	Cursor     string
+	Limit      int
+}
+
+// BuildSummary describes a stored build, without its stages
+type BuildSummary struct {
+	BuildID    string `json:"build_id" datastore:"build_id"`
+	ID         string `json:"id" datastore:"id,noindex"`
+	Name       string `json:"name" datastore:"name,noindex"`
+	Job        string `json:"job" datastore:"job"`
+	Status     string `json:"status" datastore:"status"`
+	CrawlState string `json:"crawl_state,omitempty" datastore:"crawl_state"`
+	StartTime  int    `json:"start_time" datastore:"start_time"`
+	EndTime    int    `json:"end_time" datastore:"end_time,noindex"`
+	Duration   int    `json:"build_duration" datastore:"build_duration,noindex"`
+}
+
+// BuildList is a page of a build listing
+type BuildList struct {
+	Builds     []*BuildSummary `json:"builds"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// SearchQuery holds the text to look for in the logs of the stored builds
+type SearchQuery struct {
+	Query string
+	Job   string
+	Limit int
+}
+
+// SearchMatch is a log line matching a search
+type SearchMatch struct {
+	Stage     string `json:"stage"`
+	StageID   string `json:"stage_id,omitempty"`
+	Line      int    `json:"line"`
+	TimeStamp string `json:"timestamp,omitempty"`
+	Snippet   string `json:"snippet"`
+}
+
+// SearchHit is a build with log lines matching a search
+type SearchHit struct {
+	BuildID   string         `json:"build_id"`
+	Name      string         `json:"name"`
+	Job       string         `json:"job,omitempty"`
+	Status    string         `json:"status"`
+	StartTime int            `json:"start_time"`
+	Matches   []*SearchMatch `json:"matches"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// SearchResult holds the builds matching a search, most recent first
+type SearchResult struct {
+	Query  string       `json:"query"`
+	Builds []*SearchHit `json:"builds"`
+}
+
+// StageInfo describes a stage of a build without its logs. Stages are indexed
+// in the order of the tree, parents before the stages nested in them, and
+// named by their path in the tree like the matches of a search.
+type StageInfo struct {
+	Index       int    `json:"index"`
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Parent      *int   `json:"parent,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	Status      string `json:"status"`
+	StartTime   int    `json:"start_time"`
+	Duration    int    `json:"duration"`
+	Task        string `json:"task"`
+	Description string `json:"description"`
+	LogLength   int    `json:"log_length"`
+	Lines       int    `json:"lines"`
+}
+
+// StageList holds the stages of a build
+type StageList struct {
+	BuildID string       `json:"build_id"`
+	Stages  []*StageInfo `json:"stages"`
+}
+
+// LogLine is a log line numbered from 1 within its stage
+type LogLine struct {
+	Number    int    `json:"line_no"`
+	TimeStamp string `json:"timestamp"`
+	Line      string `json:"line"`
+}
+
+// StageLog holds the lines From to To of the log of a stage
+type StageLog struct {
+	BuildID string     `json:"build_id"`
+	Stage   *StageInfo `json:"stage"`
+	From    int        `json:"from"`
+	To      int        `json:"to"`
+	Lines   []*LogLine `json:"lines"`
 }
@@ -0,0 +1,245 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+)
+
+// pageSize is the number of builds listed from the source at a time
+const pageSize = 500
+
+// Record is one line of an archive, holding a build and its crawl record if any
+type Record struct {
+	BuildID string           `json:"build_id"`
+	Build   *ale.JenkinsData `json:"build"`
+	Crawl   *ale.Crawl       `json:"crawl,omitempty"`
+}
+
+// Stats counts what happened to the builds of an export, import or copy
+type Stats struct {
+	Copied  int
+	Skipped int
+	Failed  int
+}
+
+func (s *Stats) fields() logrus.Fields {
+	return logrus.Fields{
+		"copied":  s.Copied,
+		"skipped": s.Skipped,
+		"failed":  s.Failed,
+	}
+}
+
+// Options tune how builds are written to the destination
+type Options struct {
+	// Overwrite replaces the builds already in the destination, which are skipped otherwise
+	Overwrite bool
+	// Checkpoint is a file remembering how far a copy got, so that it can be resumed
+	Checkpoint string
+}
+
+// Export writes every build of the database to w, as one JSON record per line.
+// The secrets of the callbacks are left out, as archives are meant to be shared.
+func Export(ctx context.Context, database db.Database, w io.Writer) (*Stats, error) {
+	stats := &Stats{}
+	enc := json.NewEncoder(w)
+	err := walk(ctx, database, "", func(record *Record) error {
+		if record.Crawl != nil && record.Crawl.CallbackSecret != "" {
+			crawl := *record.Crawl
+			crawl.CallbackSecret = ""
+			record.Crawl = &crawl
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+		stats.Copied++
+		return nil
+	}, stats, nil)
+	return stats, err
+}
+
+// Import reads the records written by Export, gzipped or not, into the database
+func Import(ctx context.Context, database db.Database, r io.Reader, opts Options) (*Stats, error) {
+	stats := &Stats{}
+	r, err := Decompress(r)
+	if err != nil {
+		return stats, err
+	}
+	scanner := bufio.NewScanner(r)
+	// A build is a single line, which can be large
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return stats, fmt.Errorf("line %d: %v", line, err)
+		}
+		if record.BuildID == "" || record.Build == nil {
+			return stats, fmt.Errorf("line %d: record without a build_id or build", line)
+		}
+		put(ctx, database, &record, opts, stats)
+	}
+	return stats, scanner.Err()
+}
+
+// Copy streams every build from one database to another. With a checkpoint,
+// an interrupted copy resumes after the last page which was fully copied.
+func Copy(ctx context.Context, from, to db.Database, opts Options) (*Stats, error) {
+	stats := &Stats{}
+	cursor := ""
+	if opts.Checkpoint != "" {
+		b, err := ioutil.ReadFile(opts.Checkpoint)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		cursor = strings.TrimSpace(string(b))
+		if cursor != "" {
+			logrus.WithField("checkpoint", opts.Checkpoint).Info("resuming interrupted copy")
+		}
+	}
+	started := time.Now()
+	err := walk(ctx, from, cursor, func(record *Record) error {
+		put(ctx, to, record, opts, stats)
+		return nil
+	}, stats, func(next string) error {
+		logrus.WithFields(stats.fields()).
+			WithField("elapsed", time.Since(started).Round(time.Second)).
+			Info("copying builds")
+		if opts.Checkpoint == "" || next == "" {
+			return nil
+		}
+		return ioutil.WriteFile(opts.Checkpoint, []byte(next), 0644)
+	})
+	if err == nil && opts.Checkpoint != "" {
+		if err := os.Remove(opts.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+	return stats, err
+}
+
+// Decompress returns a reader of the stream, decompressing it if it's gzipped
+func Decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// walk pages through the builds of the database, oldest first, starting after
+// the cursor. onPage is called after every page with the cursor of the next one.
+// Backends which can go through their builds in one pass are walked instead.
+func walk(ctx context.Context, database db.Database, cursor string, fn func(*Record) error, stats *Stats, onPage func(next string) error) error {
+	copyBuild := func(build *ale.BuildSummary) error {
+		data, err := database.Get(ctx, build.BuildID)
+		if err != nil || data == nil {
+			logrus.WithError(err).WithField("build_id", build.BuildID).Warn("skipping unreadable build")
+			stats.Failed++
+			return nil
+		}
+		record := &Record{BuildID: build.BuildID, Build: data}
+		if crawl, err := database.GetCrawl(ctx, build.BuildID); err == nil {
+			record.Crawl = crawl
+		}
+		return fn(record)
+	}
+	if walker, ok := database.(db.Walker); ok {
+		return walkAll(ctx, walker, cursor, copyBuild, onPage)
+	}
+
+	query := &ale.BuildQuery{Ascending: true, Limit: pageSize, Cursor: cursor}
+	for {
+		list, err := database.List(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, build := range list.Builds {
+			if err := copyBuild(build); err != nil {
+				return err
+			}
+		}
+		if onPage != nil {
+			if err := onPage(list.NextCursor); err != nil {
+				return err
+			}
+		}
+		if list.NextCursor == "" {
+			return nil
+		}
+		query.Cursor = list.NextCursor
+	}
+}
+
+// walkAll goes through the builds of a Walker in the order of their IDs,
+// starting after the build of the cursor. onPage is called like for walk,
+// with cursors pointing at the last build walked.
+func walkAll(ctx context.Context, walker db.Walker, cursor string, fn func(*ale.BuildSummary) error, onPage func(next string) error) error {
+	after := ""
+	if last, err := db.DecodeCursor(cursor); err != nil {
+		return err
+	} else if last != nil {
+		after = last.BuildID
+	}
+	walked := 0
+	err := walker.Walk(ctx, after, func(build *ale.BuildSummary) error {
+		if err := fn(build); err != nil {
+			return err
+		}
+		walked++
+		if onPage != nil && walked%pageSize == 0 {
+			return onPage(db.EncodeCursor(&ale.BuildSummary{BuildID: build.BuildID}))
+		}
+		return nil
+	})
+	if err != nil || onPage == nil {
+		return err
+	}
+	return onPage("")
+}
+
+// put writes the record to the database, unless the build is already there
+func put(ctx context.Context, database db.Database, record *Record, opts Options, stats *Stats) {
+	fields := logrus.Fields{"build_id": record.BuildID}
+	if !opts.Overwrite {
+		// Some backends report missing builds as errors
+		if exists, _ := database.Has(ctx, record.BuildID); exists {
+			logrus.WithFields(fields).Debug("skipping build already in the destination")
+			stats.Skipped++
+			return
+		}
+	}
+	if err := database.Put(ctx, record.Build, record.BuildID); err != nil {
+		logrus.WithError(err).WithFields(fields).Error("unable to write build")
+		stats.Failed++
+		return
+	}
+	if record.Crawl != nil {
+		if err := database.PutCrawl(ctx, record.Crawl); err != nil {
+			logrus.WithError(err).WithFields(fields).Error("unable to write crawl record")
+		}
+	}
+	stats.Copied++
+}
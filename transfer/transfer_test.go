@@ -0,0 +1,177 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alde/ale"
+	"github.com/alde/ale/db"
+	"github.com/alde/ale/mock"
+)
+
+var ctx = context.Background()
+
+func fixture() *mock.DB {
+	return &mock.DB{
+		Memory: map[string]*ale.JenkinsData{
+			"first": {Job: "app", Status: "SUCCESS", StartTime: 100, Stages: []*ale.JenkinsStage{
+				{Name: "Build", Logs: []*ale.Log{{Line: "compiling"}}},
+			}},
+			"second": {Job: "app", Status: "FAILURE", StartTime: 200},
+		},
+		Crawls: map[string]*ale.Crawl{
+			"first": {BuildID: "first", State: ale.CrawlFinished},
+		},
+	}
+}
+
+func emptyDB() *mock.DB {
+	return &mock.DB{
+		Memory: make(map[string]*ale.JenkinsData),
+		Crawls: make(map[string]*ale.Crawl),
+	}
+}
+
+func Test_ExportImport(t *testing.T) {
+	var archive bytes.Buffer
+	stats, err := Export(ctx, fixture(), &archive)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Copied)
+	assert.Equal(t, 2, strings.Count(archive.String(), "\n"))
+
+	destination := emptyDB()
+	stats, err = Import(ctx, destination, &archive, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Copied)
+	assert.Equal(t, fixture().Memory, destination.Memory)
+	assert.Equal(t, ale.CrawlFinished, destination.Crawls["first"].State)
+}
+
+func Test_ExportLeavesOutSecrets(t *testing.T) {
+	database := fixture()
+	database.Crawls["first"].CallbackURL = "https://ci-bot.local/done"
+	database.Crawls["first"].CallbackSecret = "s3cr3t"
+	var archive bytes.Buffer
+	_, err := Export(ctx, database, &archive)
+	assert.Nil(t, err)
+	assert.Contains(t, archive.String(), "https://ci-bot.local/done")
+	assert.NotContains(t, archive.String(), "s3cr3t")
+	assert.Equal(t, "s3cr3t", database.Crawls["first"].CallbackSecret)
+}
+
+func Test_ImportGzipped(t *testing.T) {
+	var archive bytes.Buffer
+	w := gzip.NewWriter(&archive)
+	Export(ctx, fixture(), w)
+	w.Close()
+
+	destination := emptyDB()
+	stats, err := Import(ctx, destination, &archive, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Copied)
+	assert.Len(t, destination.Memory, 2)
+}
+
+func Test_ImportSkipsExisting(t *testing.T) {
+	var archive bytes.Buffer
+	Export(ctx, fixture(), &archive)
+	content := archive.String()
+
+	destination := emptyDB()
+	destination.Memory["first"] = &ale.JenkinsData{Status: "ABORTED"}
+	stats, err := Import(ctx, destination, strings.NewReader(content), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Copied)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.Equal(t, "ABORTED", destination.Memory["first"].Status)
+
+	stats, err = Import(ctx, destination, strings.NewReader(content), Options{Overwrite: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Copied)
+	assert.Equal(t, "SUCCESS", destination.Memory["first"].Status)
+}
+
+func Test_ImportInvalid(t *testing.T) {
+	_, err := Import(ctx, emptyDB(), strings.NewReader("{\"build_id\": \"first\"}\n"), Options{})
+	assert.NotNil(t, err)
+	_, err = Import(ctx, emptyDB(), strings.NewReader("not json\n"), Options{})
+	assert.NotNil(t, err)
+}
+
+func Test_CopyResumes(t *testing.T) {
+	folder, _ := ioutil.TempDir(os.TempDir(), "transfer")
+	defer os.RemoveAll(folder)
+	source, _ := db.NewFilestore(folder, db.CompressionGzip)
+	for buildID, data := range fixture().Memory {
+		source.Put(ctx, data, buildID)
+	}
+
+	// As left by a copy interrupted after the first build
+	checkpoint := filepath.Join(folder, "checkpoint")
+	cursor := db.EncodeCursor(&ale.BuildSummary{BuildID: "first", StartTime: 100})
+	ioutil.WriteFile(checkpoint, []byte(cursor), 0644)
+
+	destination := emptyDB()
+	stats, err := Copy(ctx, source, destination, Options{Checkpoint: checkpoint})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Copied)
+	assert.Contains(t, destination.Memory, "second")
+	assert.NotContains(t, destination.Memory, "first")
+	_, err = os.Stat(checkpoint)
+	assert.True(t, os.IsNotExist(err), "the checkpoint is removed once the copy is done")
+
+	stats, err = Copy(ctx, source, destination, Options{Checkpoint: checkpoint})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Copied)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.Contains(t, destination.Memory, "first")
+}
+
+// numbered walks through builds named by their number
+type numbered int
+
+func (n numbered) Walk(ctx context.Context, after string, fn func(*ale.BuildSummary) error) error {
+	for i := 0; i < int(n); i++ {
+		buildID := fmt.Sprintf("%04d", i)
+		if buildID <= after {
+			continue
+		}
+		if err := fn(&ale.BuildSummary{BuildID: buildID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_WalkAllCheckpoints(t *testing.T) {
+	walked := 0
+	var cursors []string
+	err := walkAll(ctx, numbered(pageSize+10), "", func(*ale.BuildSummary) error {
+		walked++
+		return nil
+	}, func(next string) error {
+		cursors = append(cursors, next)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, pageSize+10, walked)
+	assert.Len(t, cursors, 2)
+	assert.Empty(t, cursors[1], "the last page has no next one")
+
+	walked = 0
+	err = walkAll(ctx, numbered(pageSize+10), cursors[0], func(*ale.BuildSummary) error {
+		walked++
+		return nil
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, walked, "resuming skips the builds before the cursor")
+}